@@ -0,0 +1,210 @@
+// Package jellyfinfake is a tiny fake jellyfin server, it serves the few endpoints fluffywatch uses
+// with items kept in memory
+package jellyfinfake
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Item mirrors the fields of a jellyfin BaseItemDto that fluffywatch uses
+type Item struct {
+	Id                string `json:"Id"`
+	Name              string `json:"Name"`
+	Type              string `json:"Type"` // CollectionFolder, Folder, Movie, Series, Season, Episode
+	ParentId          string `json:"ParentId,omitempty"`
+	SeriesId          string `json:"SeriesId,omitempty"`
+	SeriesName        string `json:"SeriesName,omitempty"`
+	IndexNumber       int    `json:"IndexNumber,omitempty"`
+	ParentIndexNumber int    `json:"ParentIndexNumber,omitempty"`
+	ProductionYear    int    `json:"ProductionYear,omitempty"`
+	RunTimeTicks      int64  `json:"RunTimeTicks,omitempty"`
+	Path              string `json:"Path,omitempty"`
+	IsFolder          bool   `json:"IsFolder"`
+}
+
+type itemsResult struct {
+	Items            []Item `json:"Items"`
+	TotalRecordCount int    `json:"TotalRecordCount"`
+}
+
+type Server struct {
+	APIKey string
+	UserID string
+
+	mu       sync.Mutex
+	items    []Item
+	requests []string
+}
+
+func New(apiKey, userID string) *Server {
+	return &Server{APIKey: apiKey, UserID: userID}
+}
+
+// AddItem adds an item, folders and series should be added before their children
+func (s *Server) AddItem(item Item) {
+	switch item.Type {
+	case "CollectionFolder", "Folder", "Series", "Season":
+		item.IsFolder = true
+	}
+
+	s.mu.Lock()
+	s.items = append(s.items, item)
+	s.mu.Unlock()
+}
+
+// Requests returns the request uris received so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]string, len(s.requests))
+	copy(out, s.requests)
+	return out
+}
+
+// Start starts listening on a random local port, the url is in the returned server's URL field
+func (s *Server) Start() *httptest.Server {
+	return httptest.NewServer(s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+	s.mu.Unlock()
+
+	if s.APIKey != "" && r.Header.Get("X-Emby-Token") != s.APIKey {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	result, found := s.route(r)
+	s.mu.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) route(r *http.Request) (interface{}, bool) {
+	split := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	switch {
+	case len(split) == 3 && split[0] == "Users" && split[1] == s.UserID && split[2] == "Views":
+		return s.result(func(item Item) bool {
+			return item.ParentId == "" && item.Type == "CollectionFolder"
+		}), true
+
+	case len(split) == 3 && split[0] == "Users" && split[1] == s.UserID && split[2] == "Items":
+		result := s.result(s.queryFilter(query))
+		if limit, err := strconv.Atoi(query.Get("Limit")); err == nil && limit < len(result.Items) {
+			result.Items = result.Items[:limit]
+		}
+		return result, true
+
+	case len(split) == 4 && split[0] == "Users" && split[1] == s.UserID && split[2] == "Items":
+		for _, item := range s.items {
+			if item.Id == split[3] {
+				return item, true
+			}
+		}
+
+	case len(split) == 3 && split[0] == "Shows" && split[2] == "Episodes":
+		return s.result(func(item Item) bool {
+			return item.Type == "Episode" && item.SeriesId == split[1]
+		}), true
+	}
+
+	return nil, false
+}
+
+func (s *Server) result(filter func(Item) bool) itemsResult {
+	result := itemsResult{Items: make([]Item, 0)}
+	for _, item := range s.items {
+		if filter(item) {
+			result.Items = append(result.Items, item)
+		}
+	}
+	result.TotalRecordCount = len(result.Items)
+	return result
+}
+
+func (s *Server) queryFilter(query url.Values) func(Item) bool {
+	parent := query.Get("ParentId")
+	recursive := strings.EqualFold(query.Get("Recursive"), "true")
+	search := strings.ToLower(query.Get("SearchTerm"))
+	year, _ := strconv.Atoi(query.Get("Years"))
+
+	var types []string
+	if t := query.Get("IncludeItemTypes"); t != "" {
+		types = strings.Split(t, ",")
+	}
+
+	return func(item Item) bool {
+		if parent != "" {
+			if recursive {
+				if !s.isDescendant(item, parent) {
+					return false
+				}
+			} else if item.ParentId != parent {
+				return false
+			}
+		} else if !recursive && item.ParentId != "" {
+			return false
+		}
+
+		if len(types) > 0 {
+			found := false
+			for _, t := range types {
+				if t == item.Type {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+
+		if search != "" && !strings.Contains(strings.ToLower(item.Name), search) {
+			return false
+		}
+
+		if year != 0 && item.ProductionYear != year {
+			return false
+		}
+		return true
+	}
+}
+
+func (s *Server) isDescendant(item Item, ancestor string) bool {
+	// Guard against cycles in badly set up test data
+	for i := 0; i < 100 && item.ParentId != ""; i++ {
+		if item.ParentId == ancestor {
+			return true
+		}
+
+		found := false
+		for _, parent := range s.items {
+			if parent.Id == item.ParentId {
+				item = parent
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+// Package plexfake is a tiny fake plex media server, it serves just enough of the plex api for
+// fluffywatch's search and playlist adding to work without a real server
+package plexfake
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Episode struct {
+	RatingKey string
+	Title     string
+	Season    int
+	Index     int
+	File      string
+	Duration  int // milliseconds
+}
+
+type Show struct {
+	RatingKey string
+	Title     string
+	Year      int
+	Episodes  []Episode
+}
+
+type Movie struct {
+	RatingKey string
+	Title     string
+	Year      int
+	File      string
+	Duration  int // milliseconds
+}
+
+type Server struct {
+	// If set requests without this token are rejected
+	Token string
+
+	mu       sync.Mutex
+	shows    []Show
+	movies   []Movie
+	requests []string
+}
+
+func New(token string) *Server {
+	return &Server{Token: token}
+}
+
+func (s *Server) AddShow(show Show) {
+	s.mu.Lock()
+	s.shows = append(s.shows, show)
+	s.mu.Unlock()
+}
+
+func (s *Server) AddMovie(movie Movie) {
+	s.mu.Lock()
+	s.movies = append(s.movies, movie)
+	s.mu.Unlock()
+}
+
+// Requests returns the request uris received so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]string, len(s.requests))
+	copy(out, s.requests)
+	return out
+}
+
+// Start starts listening on a random local port, the url is in the returned server's URL field
+func (s *Server) Start() *httptest.Server {
+	return httptest.NewServer(s)
+}
+
+type mediaContainer struct {
+	XMLName     xml.Name    `xml:"MediaContainer"`
+	Size        int         `xml:"size,attr"`
+	Directories []directory `xml:"Directory"`
+	Videos      []video     `xml:"Video"`
+}
+
+type directory struct {
+	RatingKey string `xml:"ratingKey,attr"`
+	Key       string `xml:"key,attr"`
+	Type      string `xml:"type,attr"`
+	Title     string `xml:"title,attr"`
+	Year      int    `xml:"year,attr,omitempty"`
+	LeafCount int    `xml:"leafCount,attr"`
+}
+
+type video struct {
+	RatingKey        string  `xml:"ratingKey,attr"`
+	Key              string  `xml:"key,attr"`
+	Type             string  `xml:"type,attr"`
+	Title            string  `xml:"title,attr"`
+	GrandparentTitle string  `xml:"grandparentTitle,attr,omitempty"`
+	ParentIndex      string  `xml:"parentIndex,attr,omitempty"`
+	Index            string  `xml:"index,attr,omitempty"`
+	Year             int     `xml:"year,attr,omitempty"`
+	Duration         int     `xml:"duration,attr"`
+	Media            []media `xml:"Media"`
+}
+
+type media struct {
+	Duration int    `xml:"duration,attr"`
+	Parts    []part `xml:"Part"`
+}
+
+type part struct {
+	Key      string `xml:"key,attr"`
+	File     string `xml:"file,attr"`
+	Duration int    `xml:"duration,attr"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+	s.mu.Unlock()
+
+	if s.Token != "" {
+		token := r.Header.Get("X-Plex-Token")
+		if token == "" {
+			token = r.URL.Query().Get("X-Plex-Token")
+		}
+		if token != s.Token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	container, found := s.route(r)
+	s.mu.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	container.Size = len(container.Directories) + len(container.Videos)
+	w.Header().Set("Content-Type", "text/xml;charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(container)
+}
+
+func (s *Server) route(r *http.Request) (mediaContainer, bool) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	var container mediaContainer
+
+	if path == "/library/all" {
+		title := strings.ToLower(r.URL.Query().Get("title"))
+		switch r.URL.Query().Get("type") {
+		case "1":
+			for _, m := range s.movies {
+				if strings.Contains(strings.ToLower(m.Title), title) {
+					container.Videos = append(container.Videos, movieVideo(m))
+				}
+			}
+		case "2":
+			for _, show := range s.shows {
+				if strings.Contains(strings.ToLower(show.Title), title) {
+					container.Directories = append(container.Directories, showDirectory(show))
+				}
+			}
+		}
+		return container, true
+	}
+
+	if !strings.HasPrefix(path, "/library/metadata/") {
+		return container, false
+	}
+
+	split := strings.Split(strings.TrimPrefix(path, "/library/metadata/"), "/")
+	key := split[0]
+
+	if len(split) == 2 && split[1] == "allLeaves" {
+		for _, show := range s.shows {
+			if show.RatingKey == key {
+				container.Videos = showEpisodes(show)
+				return container, true
+			}
+		}
+		return container, false
+	}
+
+	if len(split) != 1 {
+		return container, false
+	}
+
+	for _, m := range s.movies {
+		if m.RatingKey == key {
+			container.Videos = []video{movieVideo(m)}
+			return container, true
+		}
+	}
+	for _, show := range s.shows {
+		if show.RatingKey == key {
+			container.Directories = []directory{showDirectory(show)}
+			return container, true
+		}
+		for _, ep := range show.Episodes {
+			if ep.RatingKey == key {
+				container.Videos = []video{episodeVideo(show, ep)}
+				return container, true
+			}
+		}
+	}
+	return container, false
+}
+
+func showDirectory(show Show) directory {
+	return directory{
+		RatingKey: show.RatingKey,
+		Key:       "/library/metadata/" + show.RatingKey + "/children",
+		Type:      "show",
+		Title:     show.Title,
+		Year:      show.Year,
+		LeafCount: len(show.Episodes),
+	}
+}
+
+func movieVideo(m Movie) video {
+	return video{
+		RatingKey: m.RatingKey,
+		Key:       "/library/metadata/" + m.RatingKey,
+		Type:      "movie",
+		Title:     m.Title,
+		Year:      m.Year,
+		Duration:  m.Duration,
+		Media:     mediaFor(m.RatingKey, m.File, m.Duration),
+	}
+}
+
+func showEpisodes(show Show) []video {
+	episodes := make([]Episode, len(show.Episodes))
+	copy(episodes, show.Episodes)
+	sort.SliceStable(episodes, func(i, j int) bool {
+		if episodes[i].Season != episodes[j].Season {
+			return episodes[i].Season < episodes[j].Season
+		}
+		return episodes[i].Index < episodes[j].Index
+	})
+
+	videos := make([]video, 0, len(episodes))
+	for _, ep := range episodes {
+		videos = append(videos, episodeVideo(show, ep))
+	}
+	return videos
+}
+
+func episodeVideo(show Show, ep Episode) video {
+	return video{
+		RatingKey:        ep.RatingKey,
+		Key:              "/library/metadata/" + ep.RatingKey,
+		Type:             "episode",
+		Title:            ep.Title,
+		GrandparentTitle: show.Title,
+		ParentIndex:      fmt.Sprint(ep.Season),
+		Index:            fmt.Sprint(ep.Index),
+		Duration:         ep.Duration,
+		Media:            mediaFor(ep.RatingKey, ep.File, ep.Duration),
+	}
+}
+
+func mediaFor(ratingKey, file string, duration int) []media {
+	return []media{{
+		Duration: duration,
+		Parts: []part{{
+			Key:      "/library/parts/" + ratingKey + "/file",
+			File:     file,
+			Duration: duration,
+		}},
+	}}
+}
@@ -0,0 +1,377 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultBrowsePerPage = 50
+	MaxBrowsePerPage     = 200
+)
+
+type BrowseRequest struct {
+	Path    string `json:"path"`   // Empty lists the media roots
+	Search  string `json:"search"` // Searches filenames recursively under path if set
+	Page    int    `json:"page"`
+	PerPage int    `json:"perPage"`
+}
+
+type BrowseEntry struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	IsDir    bool   `json:"isDir"`
+	Size     int64  `json:"size"`
+	Duration int    `json:"duration"` // Duration in milliseconds, 0 if probing failed
+}
+
+type BrowseReply struct {
+	Path    string        `json:"path"`
+	Parent  string        `json:"parent"` // Empty if path is a root
+	Search  string        `json:"search"`
+	Entries []BrowseEntry `json:"entries"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"perPage"`
+	Total   int           `json:"total"`
+}
+
+type ThumbnailRequest struct {
+	Path string `json:"path"`
+}
+
+type ThumbnailReply struct {
+	Path  string `json:"path"`
+	Image string `json:"image"` // data uri
+}
+
+// Lists a directory inside the media roots, or the roots themselves
+func (s *Server) handleBrowse(session fnet.Session, req BrowseRequest) {
+	if !s.checkRole(session, s.addRole(), true) {
+		return
+	}
+
+	reply, err := s.browse(req)
+	if s.checkError(session, err, EvtBrowse) {
+		return
+	}
+
+	err = s.netEngine.CreateAndSend(session, EvtBrowse, reply)
+	if err != nil {
+		log.Println("Error sending browse reply: ", err)
+	}
+}
+
+func (s *Server) browse(req BrowseRequest) (*BrowseReply, error) {
+	if req.PerPage < 1 {
+		req.PerPage = DefaultBrowsePerPage
+	}
+	if req.PerPage > MaxBrowsePerPage {
+		req.PerPage = MaxBrowsePerPage
+	}
+	if req.Page < 0 {
+		req.Page = 0
+	}
+
+	reply := &BrowseReply{
+		Search:  req.Search,
+		Page:    req.Page,
+		PerPage: req.PerPage,
+	}
+
+	var entries []BrowseEntry
+	if req.Path == "" && req.Search == "" {
+		entries = s.rootEntries()
+	} else {
+		if req.Path == "" {
+			return nil, errors.New("Searching requires a path")
+		}
+
+		dir, err := s.ResolveMediaPath(req.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Search != "" {
+			entries, err = s.searchDir(dir, req.Search)
+		} else {
+			entries, err = s.listDir(dir)
+		}
+		if err != nil {
+			log.Println("Failed browsing", dir, err)
+			return nil, errors.New("Failed reading directory")
+		}
+
+		reply.Path = dir
+		if !s.isRoot(dir) {
+			reply.Parent = filepath.Dir(dir)
+		}
+	}
+
+	reply.Total = len(entries)
+
+	start := req.Page * req.PerPage
+	if start > len(entries) {
+		start = len(entries)
+	}
+	end := start + req.PerPage
+	if end > len(entries) {
+		end = len(entries)
+	}
+	reply.Entries = entries[start:end]
+
+	// Only probe what we actually send
+	s.probeEntries(reply.Entries)
+	return reply, nil
+}
+
+func (s *Server) isRoot(dir string) bool {
+	for _, r := range s.mediaRoots() {
+		if r == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) rootEntries() []BrowseEntry {
+	roots := s.mediaRoots()
+	entries := make([]BrowseEntry, 0, len(roots))
+	for _, r := range roots {
+		entries = append(entries, BrowseEntry{
+			Name:  filepath.Base(r),
+			Path:  r,
+			IsDir: true,
+		})
+	}
+	return entries
+}
+
+// Lists directories and video files, directories first
+func (s *Server) listDir(dir string) ([]BrowseEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]BrowseEntry, 0, len(infos))
+	for _, info := range infos {
+		entry, ok := s.browseEntry(dir, info)
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	sortBrowseEntries(entries)
+	return entries, nil
+}
+
+var errStopWalk = errors.New("Stop walking")
+
+// Recursively finds directories and video files with names containing search
+func (s *Server) searchDir(dir, search string) ([]BrowseEntry, error) {
+	search = strings.ToLower(search)
+	entries := make([]BrowseEntry, 0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.Contains(strings.ToLower(info.Name()), search) {
+			return nil
+		}
+
+		entry, ok := s.browseEntry(filepath.Dir(path), info)
+		if ok {
+			entries = append(entries, entry)
+		}
+
+		if len(entries) >= MaxDirItems {
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, err
+	}
+
+	sortBrowseEntries(entries)
+	return entries, nil
+}
+
+func (s *Server) browseEntry(dir string, info os.FileInfo) (BrowseEntry, bool) {
+	if strings.HasPrefix(info.Name(), ".") {
+		return BrowseEntry{}, false
+	}
+
+	path := filepath.Join(dir, info.Name())
+	isDir := info.IsDir()
+
+	// Follow symlinks, but only those staying inside the roots
+	if info.Mode()&os.ModeSymlink != 0 {
+		resolved, err := s.ResolveMediaPath(path)
+		if err != nil {
+			return BrowseEntry{}, false
+		}
+		target, err := os.Stat(resolved)
+		if err != nil {
+			return BrowseEntry{}, false
+		}
+		info = target
+		isDir = target.IsDir()
+	}
+
+	if !isDir && !IsVideoFile(path) {
+		return BrowseEntry{}, false
+	}
+
+	entry := BrowseEntry{
+		Name:  info.Name(),
+		Path:  path,
+		IsDir: isDir,
+	}
+	if !isDir {
+		entry.Size = info.Size()
+	}
+	return entry, true
+}
+
+func sortBrowseEntries(entries []BrowseEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return naturalLess(strings.ToLower(entries[i].Name), strings.ToLower(entries[j].Name))
+	})
+}
+
+// Probes the files a couple at a time
+func (s *Server) probeEntries(entries []BrowseEntry) {
+	var wg sync.WaitGroup
+	sem := make(chan bool, 4)
+
+	for i := range entries {
+		if entries[i].IsDir {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- true
+		go func(e *BrowseEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			result, err := s.ProbeFile(e.Path)
+			if err != nil {
+				log.Println("Failed probing", e.Path, err)
+				return
+			}
+			e.Duration = result.Duration
+		}(&entries[i])
+	}
+
+	wg.Wait()
+}
+
+// Responds with a thumbnail of a video file, generated once and then cached on disk
+func (s *Server) handleThumbnail(session fnet.Session, req ThumbnailRequest) {
+	if !s.checkRole(session, s.addRole(), true) {
+		return
+	}
+
+	path, err := s.ResolveMediaFile(req.Path)
+	if s.checkError(session, err, EvtThumbnail) {
+		return
+	}
+
+	img, err := s.Thumbnail(path)
+	if err != nil {
+		log.Println("Failed creating thumbnail for", path, err)
+		s.sendErrResp(session, errors.New("Failed creating thumbnail"), EvtThumbnail)
+		return
+	}
+
+	reply := ThumbnailReply{
+		Path:  req.Path,
+		Image: "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(img),
+	}
+	err = s.netEngine.CreateAndSend(session, EvtThumbnail, reply)
+	if err != nil {
+		log.Println("Error sending thumbnail: ", err)
+	}
+}
+
+func (s *Server) cacheDir(sub string) string {
+	s.configLock.RLock()
+	dir := s.config.CacheDir
+	s.configLock.RUnlock()
+
+	if dir == "" {
+		dir = "cache"
+	}
+	return filepath.Join(dir, sub)
+}
+
+// Thumbnail returns a jpeg thumbnail of the video, cached by path, size and modification time
+func (s *Server) Thumbnail(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d", path, info.Size(), info.ModTime().Unix())))
+	dir := s.cacheDir("thumbnails")
+	cachePath := filepath.Join(dir, fmt.Sprintf("%x.jpg", hash))
+
+	if img, err := ioutil.ReadFile(cachePath); err == nil {
+		return img, nil
+	}
+
+	// Dont spawn a ffmpeg per request when someone scrolls through a big folder
+	s.thumbnailLock.Lock()
+	defer s.thumbnailLock.Unlock()
+
+	err = os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, err
+	}
+
+	// Grab a frame a bit into the video to skip intros and black frames
+	seek := 60
+	if result, err := s.ProbeFile(path); err == nil && result.Duration > 0 && result.Duration/1000/10 < seek {
+		seek = result.Duration / 1000 / 10
+	}
+
+	ffmpeg, _ := s.ffmpegPaths()
+	cmd := exec.Command(ffmpeg, "-y", "-v", "error",
+		"-ss", fmt.Sprint(seek),
+		"-i", path,
+		"-frames:v", "1",
+		"-vf", "scale=320:trunc(ow/a/2)*2",
+		cachePath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.New(err.Error() + ": " + string(output))
+	}
+
+	return ioutil.ReadFile(cachePath)
+}
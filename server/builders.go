@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+func (r *Room) buildStatusMessage() ([]byte, error) {
+	v := make(map[string]bool)
+
+	r.viewersMutex.RLock()
+	for name, _ := range r.viewers {
+		v[name] = true
+	}
+	r.viewersMutex.RUnlock()
+
+	var stReply StatusReply
+	player := r.Player
+	err := player.call(func() error {
+		timestamp := 0
+		if player.Playing {
+			d := time.Now().Sub(player.StartedPlaying)
+			timestamp = int(d.Seconds())
+		} else {
+			d := player.StoppedPlaying.Sub(player.StartedPlaying)
+			timestamp = int(d.Seconds())
+		}
+
+		action := "Playing"
+		if !player.Playing {
+			if player.ManualStop {
+				action = "Paused"
+			} else {
+				action = "Finished"
+			}
+		}
+
+		stReply = StatusReply{
+			Timestamp: timestamp,
+			Action:    action,
+			Viewers:   v,
+			Playing:   player.Playing,
+			Mode:      player.Mode,
+		}
+		if player.transcode != nil {
+			stReply.Speed = player.transcode.Progress().Speed
+		}
+		if enabled, _ := r.voteSettings(); enabled {
+			stReply.Votes = r.voteTallies()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wm, err := r.server.netEngine.CreateWireMessage(EvtStatus, stReply)
+	return wm, err
+}
+
+func (r *Room) buildPlaylistMessage() ([]byte, error) {
+	var pl Playlist
+	err := r.Player.call(func() error {
+		pl = r.Player.CurrentPlaylist
+		// It's encoded after we're off the player goroutine
+		pl.Items = make([]PlaylistItem, len(r.Player.CurrentPlaylist.Items))
+		copy(pl.Items, r.Player.CurrentPlaylist.Items)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wm, err := r.server.netEngine.CreateWireMessage(EvtPlaylist, pl)
+	return wm, err
+}
+
+type SettingsReply struct {
+	TranscoderSettings
+	Profiles []string `json:"profiles"` // What can be picked with the profile field
+}
+
+func (r *Room) buildSettingsMessage() ([]byte, error) {
+	var settings TranscoderSettings
+	err := r.Player.call(func() error {
+		settings = r.Player.Settings
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reply := SettingsReply{
+		TranscoderSettings: settings,
+		Profiles:           r.server.transcoderProfileNames(),
+	}
+	wm, err := r.server.netEngine.CreateWireMessage(EvtSettings, reply)
+	return wm, err
+}
+
+func (r *Room) broadcastPlaylistStatus() {
+	wm1, err := r.buildPlaylistMessage()
+	if err != nil {
+		fmt.Println("Error broadcasting playliststatus: ", err)
+		return
+	}
+	r.Broadcast(wm1)
+
+	r.broadcastStatus()
+}
+
+func (r *Room) broadcastStatus() {
+	wm, err := r.buildStatusMessage()
+	if err != nil {
+		fmt.Println("Error broadcasting status: ", err)
+		return
+	}
+	r.Broadcast(wm)
+}
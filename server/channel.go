@@ -0,0 +1,632 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// In channel mode the playlist is swapped out for a lineup built from the configured sources, and it
+// plays around the clock like a tv channel. Where in the lineup we are is saved so after a restart it
+// picks up where it would have been had it kept running
+
+const (
+	DefaultChannelName       = "fluffywatch"
+	DefaultChannelGuideHours = 24
+
+	// Stop building the guide after this many programs, in case the lineup is all short clips
+	MaxGuidePrograms = 1000
+)
+
+var (
+	ErrChannelActive   = errors.New("Channel mode is already on")
+	ErrChannelInactive = errors.New("Channel mode is not on")
+	ErrChannelEmpty    = errors.New("Nothing in the channel sources is playable")
+)
+
+type ChannelConfig struct {
+	Enabled    bool     `json:"enabled"`    // Start in channel mode
+	Name       string   `json:"name"`       // Shown in the guide
+	Sources    []string `json:"sources"`    // Folders inside the media roots or playlist files, the lineup takes turns between them
+	GuideHours int      `json:"guideHours"` // How far ahead the guide goes
+}
+
+type Channel struct {
+	sync.Mutex
+	StatePath string
+	Active    bool
+
+	// What was going on before the channel took over, put back when it's turned off
+	stashed        Playlist
+	stashedHistory PlaylistHistory
+	stashedMode    PlaybackMode
+	stashedSeek    string
+
+	saved channelState
+	room  *Room
+}
+
+// channelState is what's persisted, the program that was on and when it started
+type channelState struct {
+	Active  bool      `json:"active"`
+	Path    string    `json:"path"`
+	Started time.Time `json:"started"`
+}
+
+type GuideProgram struct {
+	Start time.Time    `json:"start"`
+	Stop  time.Time    `json:"stop"`
+	Item  PlaylistItem `json:"item"`
+}
+
+func NewChannel(room *Room, statePath string) *Channel {
+	return &Channel{StatePath: statePath, room: room}
+}
+
+func (r *Room) channelSettings() ChannelConfig {
+	c := r.settings().Channel
+	if c.Name == "" {
+		c.Name = DefaultChannelName
+		if r.Name != MainRoom {
+			c.Name += "-" + r.Name
+		}
+	}
+	if c.GuideHours < 1 {
+		c.GuideHours = DefaultChannelGuideHours
+	}
+	return c
+}
+
+func (c *Channel) loadState() (channelState, error) {
+	var state channelState
+	data, err := ioutil.ReadFile(c.StatePath)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// the caller must hold the lock
+func (c *Channel) saveState(state channelState) error {
+	if state == c.saved {
+		return nil
+	}
+
+	marshalled, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(c.StatePath); dir != "" {
+		err = os.MkdirAll(dir, 0775)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmpPath := c.StatePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, marshalled, 0664)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, c.StatePath)
+	if err == nil {
+		c.saved = state
+	}
+	return err
+}
+
+// Run starts the channel if it was on when we stopped or if it's enabled in the config, then keeps
+// the saved position up to date
+func (c *Channel) Run() {
+	state, err := c.loadState()
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed loading channel state:", err)
+	}
+	c.Lock()
+	c.saved = state
+	c.Unlock()
+
+	if state.Active || c.room.channelSettings().Enabled {
+		err = c.Start()
+		if err != nil {
+			log.Println("Failed starting channel:", err)
+		} else {
+			c.room.broadcastPlaylistStatus()
+		}
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.update() {
+				c.room.broadcastGuide()
+			}
+		case <-c.room.quit:
+			return
+		}
+	}
+}
+
+// update saves the position if a new program started, returns true if it did
+func (c *Channel) update() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.Active {
+		return false
+	}
+
+	player := c.room.Player
+	var state channelState
+	player.do(func() {
+		if !player.Playing || player.nowPlaying.Path == "" {
+			return
+		}
+		// StartedPlaying is moved back by the seek, so it's when the program would have started
+		state = channelState{Active: true, Path: player.nowPlaying.Path, Started: player.StartedPlaying.Truncate(time.Second)}
+	})
+
+	if !state.Active {
+		return false
+	}
+	if state.Path == c.saved.Path && state.Started.Equal(c.saved.Started) {
+		return false
+	}
+	err := c.saveState(state)
+	if err != nil {
+		log.Println("Failed saving channel state:", err)
+	}
+	return true
+}
+
+// stash returns what the channel put aside when it started, ok is false if it's not on
+func (c *Channel) stash() (playlist Playlist, mode PlaybackMode, seek string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.stashed, c.stashedMode, c.stashedSeek, c.Active
+}
+
+func (c *Channel) IsActive() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.Active
+}
+
+// Start swaps the playlist for the channel lineup and starts playing wherever the channel is at now
+func (c *Channel) Start() error {
+	lineup := c.room.server.buildLineup(c.room.channelSettings().Sources)
+	if len(lineup) < 1 {
+		return ErrChannelEmpty
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Active {
+		return ErrChannelActive
+	}
+
+	index, offset := channelPosition(lineup, c.saved, time.Now())
+
+	player := c.room.Player
+	player.do(func() {
+		c.stashed = player.CurrentPlaylist
+		c.stashedHistory = player.History
+		c.stashedMode = player.Mode
+		c.stashedSeek = player.Settings.Seek
+
+		player.CurrentPlaylist = Playlist{Items: lineup}
+		player.History = PlaylistHistory{}
+		player.Mode = PlaybackMode{Repeat: RepeatAll}
+		player.jumpTo(index)
+		if player.Playing {
+			// The seek is cleared when the item playing now stops, so the program starts from the beginning
+			player.Settings.Seek = ""
+			player.stopTranscode()
+		} else {
+			player.Settings.Seek = ""
+			if seconds := int(offset.Seconds()); seconds > 0 {
+				player.Settings.Seek = StringLocation(seconds)
+			}
+			player.start()
+		}
+	})
+
+	c.Active = true
+	state := c.saved
+	state.Active = true
+	err := c.saveState(state)
+	if err != nil {
+		log.Println("Failed saving channel state:", err)
+	}
+
+	log.Printf("Channel started with %d programs\n", len(lineup))
+	return nil
+}
+
+// Stop puts back the playlist from before the channel started, either paused or
+// carrying on with it right away
+func (c *Channel) Stop(pause bool) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.Active {
+		return ErrChannelInactive
+	}
+
+	player := c.room.Player
+	player.do(func() {
+		player.CurrentPlaylist = c.stashed
+		player.History = c.stashedHistory
+		player.Mode = c.stashedMode
+		player.jumpTo(c.stashed.CurrentIndex)
+		if player.Playing {
+			// Jumping makes the play loop drop the position of the program when it stops
+			player.ManualStop = pause
+			player.stopTranscode()
+		} else {
+			player.Settings.Seek = c.stashedSeek
+		}
+	})
+
+	c.stashed = Playlist{}
+	c.stashedHistory = PlaylistHistory{}
+	c.Active = false
+
+	state := c.saved
+	state.Active = false
+	err := c.saveState(state)
+	if err != nil {
+		log.Println("Failed saving channel state:", err)
+	}
+
+	log.Println("Channel stopped")
+	return nil
+}
+
+// buildLineup finds the programs in the sources, taking turns between them
+// Programs without a known duration are left out since the guide can't be made without it
+func (s *Server) buildLineup(sources []string) []PlaylistItem {
+	blocks := make([][]PlaylistItem, 0, len(sources))
+	for _, source := range sources {
+		items, err := s.channelSourceItems(source)
+		if err != nil {
+			log.Println("Failed loading channel source", source, err)
+			continue
+		}
+
+		withDuration := make([]PlaylistItem, 0, len(items))
+		for _, item := range items {
+			item.Duration = s.itemDuration(item)
+			if item.Duration <= 0 {
+				log.Println("Leaving out of the channel, unknown duration:", item.Path)
+				continue
+			}
+			withDuration = append(withDuration, item)
+		}
+		blocks = append(blocks, withDuration)
+	}
+
+	lineup := make([]PlaylistItem, 0)
+	for i := 0; ; i++ {
+		added := false
+		for _, block := range blocks {
+			if i < len(block) {
+				lineup = append(lineup, block[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	return lineup
+}
+
+func (s *Server) channelSourceItems(source string) ([]PlaylistItem, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		path, err := s.ResolveMediaPath(source)
+		if err != nil {
+			return nil, err
+		}
+		return s.ScanMediaDir(path)
+	}
+	if IsVideoFile(source) {
+		path, err := s.ResolveMediaFile(source)
+		if err != nil {
+			return nil, err
+		}
+		return []PlaylistItem{s.newMediaItem(path)}, nil
+	}
+	return s.readPlaylistFile(source)
+}
+
+// itemDuration returns the duration in milliseconds, probing the file if it's not known
+func (s *Server) itemDuration(item PlaylistItem) int {
+	if item.Duration > 0 {
+		return item.Duration
+	}
+	if entry, ok := s.library.Get(item.Path); ok && entry.Duration > 0 {
+		return entry.Duration
+	}
+
+	probed, err := s.ProbeFile(item.Path)
+	if err != nil {
+		log.Println("Failed probing", item.Path, err)
+		return 0
+	}
+	return probed.Duration
+}
+
+func itemLength(item PlaylistItem) time.Duration {
+	return time.Duration(item.Duration) * time.Millisecond
+}
+
+// channelPosition works out where in the lineup the channel is at now, going by what was on when the
+// state was saved. Starts from the top if that program is gone
+func channelPosition(lineup []PlaylistItem, state channelState, now time.Time) (int, time.Duration) {
+	index := -1
+	if state.Path != "" {
+		index = findPlaylistItem(lineup, state.Path, 0)
+	}
+	if index == -1 || state.Started.IsZero() || state.Started.After(now) {
+		return 0, 0
+	}
+
+	total := time.Duration(0)
+	for _, item := range lineup {
+		total += itemLength(item)
+	}
+
+	elapsed := now.Sub(state.Started)
+	if current := itemLength(lineup[index]); elapsed >= current {
+		// Skip whole laps of the lineup if we were down for long
+		elapsed = current + (elapsed-current)%total
+	}
+
+	for elapsed >= itemLength(lineup[index]) {
+		elapsed -= itemLength(lineup[index])
+		index = (index + 1) % len(lineup)
+	}
+	return index, elapsed
+}
+
+// Guide returns the programs from the one on now and the next hours ahead
+func (c *Channel) Guide(hours int) []GuideProgram {
+	c.Lock()
+	defer c.Unlock()
+
+	programs := make([]GuideProgram, 0)
+	if !c.Active {
+		return programs
+	}
+
+	now := time.Now()
+	start := now
+	var items []PlaylistItem
+	index := 0
+
+	player := c.room.Player
+	player.do(func() {
+		items = make([]PlaylistItem, len(player.CurrentPlaylist.Items))
+		copy(items, player.CurrentPlaylist.Items)
+		index = player.CurrentPlaylist.CurrentIndex
+
+		if player.Playing && !player.jumped {
+			start = player.StartedPlaying
+		} else if player.Settings.Seek != "" {
+			h, m, s := ParseLocationStr(player.Settings.Seek)
+			start = now.Add(-time.Duration(h*3600+m*60+s) * time.Second)
+		}
+	})
+
+	if len(items) < 1 {
+		return programs
+	}
+	if index < 0 || index >= len(items) {
+		index = 0
+	}
+
+	end := now.Add(time.Duration(hours) * time.Hour)
+	unknown := 0 // Items in a row without a duration, a whole lap of them means there's nothing to put in the guide
+	for start.Before(end) && len(programs) < MaxGuidePrograms && unknown < len(items) {
+		item := items[index]
+		index = (index + 1) % len(items)
+		if item.Duration <= 0 {
+			// Added by hand or the probe failed, no idea how long it is
+			unknown++
+			continue
+		}
+		unknown = 0
+
+		stop := start.Add(itemLength(item))
+		programs = append(programs, GuideProgram{Start: start.Truncate(time.Second), Stop: stop.Truncate(time.Second), Item: item})
+		start = stop
+	}
+	return programs
+}
+
+type ChannelRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type ChannelGuideReply struct {
+	Active   bool           `json:"active"`
+	Name     string         `json:"name"`
+	Programs []GuideProgram `json:"programs"`
+}
+
+func (r *Room) buildGuideReply() ChannelGuideReply {
+	settings := r.channelSettings()
+	return ChannelGuideReply{
+		Active:   r.Channel.IsActive(),
+		Name:     settings.Name,
+		Programs: r.Channel.Guide(settings.GuideHours),
+	}
+}
+
+func (s *Server) handleChannel(session fnet.Session, req ChannelRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	var err error
+	if req.Enabled {
+		err = room.Channel.Start()
+	} else {
+		err = room.Channel.Stop(true)
+	}
+	if s.checkError(session, err, EvtChannel) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	if req.Enabled {
+		room.broadcastNotification(fmt.Sprintf("%s Turned on the channel", name), true)
+	} else {
+		room.broadcastNotification(fmt.Sprintf("%s Turned off the channel", name), true)
+	}
+	room.broadcastPlaylistStatus()
+	room.broadcastGuide()
+}
+
+// Responds with the program guide
+func (s *Server) handleChannelGuide(session fnet.Session) {
+	err := s.netEngine.CreateAndSend(session, EvtChannelGuide, s.sessionRoom(session).buildGuideReply())
+	if err != nil {
+		log.Println("Error sending channel guide: ", err)
+	}
+}
+
+func (r *Room) broadcastGuide() {
+	err := r.CreateAndBroadcast(EvtChannelGuide, r.buildGuideReply())
+	if err != nil {
+		log.Println("Error broadcasting channel guide: ", err)
+	}
+}
+
+// XMLTV, see http://wiki.xmltv.org/index.php/XMLTVFormat
+
+const xmltvTimeFormat = "20060102150405 -0700"
+
+type xmltvDoc struct {
+	XMLName   xml.Name         `xml:"tv"`
+	Generator string           `xml:"generator-info-name,attr"`
+	Channels  []xmltvChannel   `xml:"channel"`
+	Programs  []xmltvProgramme `xml:"programme"`
+}
+
+type xmltvChannel struct {
+	ID          string `xml:"id,attr"`
+	DisplayName string `xml:"display-name"`
+}
+
+type xmltvProgramme struct {
+	Start    string      `xml:"start,attr"`
+	Stop     string      `xml:"stop,attr"`
+	Channel  string      `xml:"channel,attr"`
+	Title    string      `xml:"title"`
+	SubTitle string      `xml:"sub-title,omitempty"`
+	Desc     string      `xml:"desc,omitempty"`
+	Date     string      `xml:"date,omitempty"`
+	Icon     *xmltvIcon  `xml:"icon"`
+	Episode  *xmltvEpNum `xml:"episode-num"`
+}
+
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+type xmltvEpNum struct {
+	System string `xml:"system,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// xmltv_ns counts from 0, and leaves out what's not known
+func xmltvEpisodeNum(season, episode int) string {
+	s, e := "", ""
+	if season > 0 {
+		s = fmt.Sprint(season - 1)
+	}
+	if episode > 0 {
+		e = fmt.Sprint(episode - 1)
+	}
+	return s + "." + e + "."
+}
+
+// ChannelXMLTV returns the guide as an XMLTV document
+func ChannelXMLTV(name string, programs []GuideProgram) ([]byte, error) {
+	doc := xmltvDoc{
+		Generator: "fluffywatch",
+		Channels:  []xmltvChannel{{ID: name, DisplayName: name}},
+		Programs:  make([]xmltvProgramme, 0, len(programs)),
+	}
+
+	for _, program := range programs {
+		item := program.Item
+		p := xmltvProgramme{
+			Start:   program.Start.Format(xmltvTimeFormat),
+			Stop:    program.Stop.Format(xmltvTimeFormat),
+			Channel: name,
+			Title:   item.Title,
+			Desc:    item.Plot,
+		}
+		if item.Kind == ITEMTYPETV && item.ShowTitle != "" {
+			p.Title = item.ShowTitle
+			p.SubTitle = item.Title
+			if item.Season > 0 || item.Episode > 0 {
+				p.Episode = &xmltvEpNum{System: "xmltv_ns", Value: xmltvEpisodeNum(item.Season, item.Episode)}
+			}
+		}
+		if item.Year > 0 {
+			p.Date = fmt.Sprint(item.Year)
+		}
+		if item.Poster != "" {
+			p.Icon = &xmltvIcon{Src: item.Poster}
+		}
+		doc.Programs = append(doc.Programs, p)
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header+"<!DOCTYPE tv SYSTEM \"xmltv.dtd\">\n"), out...), nil
+}
+
+// Serves the guide for IPTV clients
+func (s *Server) handleXMLTVHTTP(w http.ResponseWriter, r *http.Request) {
+	room := s.httpRoom(w, r)
+	if room == nil {
+		return
+	}
+
+	settings := room.channelSettings()
+	out, err := ChannelXMLTV(settings.Name, room.Channel.Guide(settings.GuideHours))
+	if err != nil {
+		log.Println("Failed building xmltv:", err)
+		http.Error(w, "Failed building the guide", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(out)
+}
@@ -0,0 +1,45 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jogramming/fluffywatch/server"
+	"github.com/jogramming/fluffywatch/transcoderfake"
+)
+
+func TestChannelGuideUnknownDurations(t *testing.T) {
+	_, room, paths := newTestServer(t, transcoderfake.New(), "a.mkv", "b.mkv")
+	room.Channel.Lock()
+	room.Channel.Active = true
+	room.Channel.Unlock()
+
+	guide := func() []server.GuideProgram {
+		done := make(chan []server.GuideProgram, 1)
+		go func() { done <- room.Channel.Guide(2) }()
+		select {
+		case programs := <-done:
+			return programs
+		case <-time.After(waitTimeout):
+			t.Fatal("Guide didn't return")
+			return nil
+		}
+	}
+
+	// Nothing has a duration
+	if programs := guide(); len(programs) != 0 {
+		t.Errorf("got %d programs, want none", len(programs))
+	}
+
+	// Only the one with a duration shows up, over and over
+	room.Player.AddPlaylistItem(server.PlaylistItem{Path: paths[0], Duration: int(time.Hour / time.Millisecond)})
+	programs := guide()
+	if len(programs) < 2 || len(programs) > 3 {
+		t.Fatalf("got %d programs, want 2 or 3 hour long ones", len(programs))
+	}
+	for _, p := range programs {
+		if p.Stop.Sub(p.Start) != time.Hour {
+			t.Errorf("program is %s long", p.Stop.Sub(p.Start))
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"log"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Validate checks the config before it's used, so a typo doesn't replace a working one
+func (c *Config) Validate() error {
+	if c.AddRole != "" {
+		if err := ValidateRole(c.AddRole); err != nil {
+			return fmt.Errorf("addRole: %s", err)
+		}
+	}
+	if c.VoteThreshold < 0 || c.VoteThreshold > 1 {
+		return errors.New("voteThreshold has to be between 0 and 1")
+	}
+	if c.SuggestionLimit < 0 {
+		return errors.New("suggestionLimit can't be negative")
+	}
+	if c.SuggestionCooldown < -1 {
+		return errors.New("suggestionCooldown has to be -1 or more")
+	}
+	if c.LibraryScanInterval < 0 {
+		return errors.New("libraryScanInterval can't be negative")
+	}
+	if c.TimeZone != "" {
+		if _, err := time.LoadLocation(c.TimeZone); err != nil {
+			return fmt.Errorf("timeZone: %s", err)
+		}
+	}
+	if c.HTTPBaseURL != "" {
+		if _, err := url.Parse(c.HTTPBaseURL); err != nil {
+			return fmt.Errorf("httpBaseUrl: %s", err)
+		}
+	}
+	if c.Plex.URL != "" {
+		if _, err := url.Parse(c.Plex.URL); err != nil {
+			return fmt.Errorf("plex url: %s", err)
+		}
+	}
+	if c.Jellyfin.URL != "" {
+		if _, err := url.Parse(c.Jellyfin.URL); err != nil {
+			return fmt.Errorf("jellyfin url: %s", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, rc := range c.Rooms {
+		if rc.Name == MainRoom || !roomNameRegex.MatchString(rc.Name) {
+			return fmt.Errorf("Invalid room name %q", rc.Name)
+		}
+		if seen[rc.Name] {
+			return fmt.Errorf("Room %s is in there twice", rc.Name)
+		}
+		seen[rc.Name] = true
+		if rc.VoteThreshold < 0 || rc.VoteThreshold > 1 {
+			return fmt.Errorf("Room %s: voteThreshold has to be between 0 and 1", rc.Name)
+		}
+	}
+
+	return c.FFmpeg.Validate()
+}
+
+// These are only read when starting, changing them in a running server would leave things half moved
+var restartOnlyFields = []string{"Listen", "HTTPListen", "SegmentDir", "HLSPlaylistPath", "CacheDir", "SchedulePath"}
+
+// copyRestartOnly copies the fields that need a restart from src to dst, the rooms' segment paths included
+func copyRestartOnly(dst, src *Config) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src).Elem()
+	for _, name := range restartOnlyFields {
+		dv.FieldByName(name).Set(sv.FieldByName(name))
+	}
+
+	rooms := make([]RoomConfig, len(dst.Rooms))
+	copy(rooms, dst.Rooms)
+	for i := range rooms {
+		for _, rc := range src.Rooms {
+			if rc.Name == rooms[i].Name {
+				rooms[i].SegmentDir = rc.SegmentDir
+				rooms[i].HLSPlaylistPath = rc.HLSPlaylistPath
+			}
+		}
+	}
+	dst.Rooms = rooms
+}
+
+// configChanges returns the json names of the top level fields that differ
+func configChanges(old, c *Config) []string {
+	ov := reflect.ValueOf(old).Elem()
+	cv := reflect.ValueOf(c).Elem()
+	t := ov.Type()
+
+	changed := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), cv.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// restartOnlyChanges returns the json names of the fields that need a restart to change between a and b
+func restartOnlyChanges(a, b *Config) []string {
+	av := reflect.ValueOf(a).Elem()
+	bv := reflect.ValueOf(b).Elem()
+	t := av.Type()
+
+	changed := make([]string, 0)
+	for _, name := range restartOnlyFields {
+		if !reflect.DeepEqual(av.FieldByName(name).Interface(), bv.FieldByName(name).Interface()) {
+			field, _ := t.FieldByName(name)
+			changed = append(changed, strings.Split(field.Tag.Get("json"), ",")[0])
+		}
+	}
+
+	// Rooms are created at startup, and their segments can't move while they're streaming
+	roomsChanged := len(a.Rooms) != len(b.Rooms)
+	for i := 0; !roomsChanged && i < len(a.Rooms); i++ {
+		ra, rb := a.Rooms[i], b.Rooms[i]
+		roomsChanged = ra.Name != rb.Name || ra.SegmentDir != rb.SegmentDir || ra.HLSPlaylistPath != rb.HLSPlaylistPath
+	}
+	if roomsChanged {
+		changed = append(changed, "rooms")
+	}
+	return changed
+}
+
+// reloadConfig loads the config file and swaps it in if it's valid. Fields that need a restart keep
+// their running values, and masters are told what changed
+func (s *Server) reloadConfig(path string) {
+	c, err := loadConfig(path)
+	if err != nil {
+		log.Println("Failed reloading config, keeping the old one:", err)
+		s.notifyMasters("Config has an error, keeping the old one: " + err.Error())
+		return
+	}
+
+	live, restart := s.applyConfig(c)
+	if len(live) < 1 && len(restart) < 1 {
+		return
+	}
+
+	msg := "Config reloaded"
+	if len(live) > 0 {
+		msg += ", applied changes to " + strings.Join(live, ", ")
+	}
+	if len(restart) > 0 {
+		msg += ". Changes to " + strings.Join(restart, ", ") + " need a restart"
+	}
+	log.Println(msg)
+	s.notifyMasters(msg)
+}
+
+// applyConfig swaps in c, a freshly loaded config file, keeping the running restart only values.
+// Returns the fields that changed and the ones that need a restart, those only the first time they change
+func (s *Server) applyConfig(c *Config) (live, restart []string) {
+	s.configLock.Lock()
+	old := s.config
+	// What the file had last time, the running config keeps the old restart only values
+	prevFile := s.config
+	if s.pendingConfig != nil {
+		prevFile = s.pendingConfig
+	}
+
+	pending := *c
+	copyRestartOnly(c, old)
+	live = configChanges(old, c)
+
+	// Only warn about what changed in the file this time and is still different from what's running
+	restart = make([]string, 0)
+	waiting := restartOnlyChanges(old, &pending)
+	for _, name := range restartOnlyChanges(prevFile, &pending) {
+		if containsString(waiting, name) {
+			restart = append(restart, name)
+		}
+	}
+
+	s.config = c
+	s.pendingConfig = nil
+	if len(waiting) > 0 {
+		// Saved instead of the running values so changes from in here don't throw away the new ones
+		s.pendingConfig = &pending
+	}
+	mediaRootsChanged := !reflect.DeepEqual(old.MediaRoots, c.MediaRoots)
+	s.configLock.Unlock()
+
+	if mediaRootsChanged && s.library != nil {
+		s.library.Rescan()
+	}
+	return live, restart
+}
+
+// configForSave is the config as it should be written to disk, with restart only values that are
+// waiting for a restart instead of the running ones
+// the caller must hold configLock
+func (s *Server) configForSave() ([]byte, error) {
+	c := *s.config
+	if s.pendingConfig != nil {
+		copyRestartOnly(&c, s.pendingConfig)
+	}
+	return json.MarshalIndent(&c, "", "\t")
+}
+
+// notifyMasters sends a notification to the masters of every room
+func (s *Server) notifyMasters(msg string) {
+	s.roomsLock.RLock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.roomsLock.RUnlock()
+
+	for _, room := range rooms {
+		room.viewersMutex.RLock()
+		sessions := make([]fnet.Session, 0, len(room.viewers))
+		for _, session := range room.viewers {
+			sessions = append(sessions, session)
+		}
+		room.viewersMutex.RUnlock()
+
+		for _, session := range sessions {
+			if s.checkMaster(session, false) {
+				s.sendNotification(session, msg, true)
+			}
+		}
+	}
+}
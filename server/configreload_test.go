@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCopyRestartOnly(t *testing.T) {
+	src := &Config{
+		Listen:     ":1",
+		SegmentDir: "/old/segments",
+		CacheDir:   "/old/cache",
+		VoteMode:   true,
+		Rooms:      []RoomConfig{{Name: "a", SegmentDir: "/old/a", HLSPlaylistPath: "/old/a.m3u8", Master: "old"}},
+	}
+	dst := &Config{
+		Listen:     ":2",
+		SegmentDir: "/new/segments",
+		CacheDir:   "/new/cache",
+		Rooms: []RoomConfig{
+			{Name: "a", SegmentDir: "/new/a", HLSPlaylistPath: "/new/a.m3u8", Master: "new"},
+			{Name: "b", SegmentDir: "/new/b"},
+		},
+	}
+	rooms := dst.Rooms
+
+	copyRestartOnly(dst, src)
+	if dst.Listen != ":1" || dst.SegmentDir != "/old/segments" || dst.CacheDir != "/old/cache" {
+		t.Errorf("restart only fields weren't copied: %+v", dst)
+	}
+	if dst.VoteMode {
+		t.Error("live field was copied")
+	}
+	if dst.Rooms[0].SegmentDir != "/old/a" || dst.Rooms[0].HLSPlaylistPath != "/old/a.m3u8" || dst.Rooms[0].Master != "new" {
+		t.Errorf("room a is %+v, want the old paths and the new master", dst.Rooms[0])
+	}
+	if dst.Rooms[1].SegmentDir != "/new/b" {
+		t.Errorf("new room b got segment dir %s", dst.Rooms[1].SegmentDir)
+	}
+	if rooms[0].SegmentDir != "/new/a" {
+		t.Error("rooms of dst were changed in place")
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	base := Config{Listen: ":1", Mods: []string{"a"}, Rooms: []RoomConfig{{Name: "a"}}}
+	cases := []struct {
+		name        string
+		edit        func(c *Config)
+		wantChanged []string
+		wantRestart []string
+	}{
+		{"nothing", func(c *Config) {}, []string{}, []string{}},
+		{"live field", func(c *Config) { c.VoteMode = true }, []string{"voteMode"}, []string{}},
+		{"live list", func(c *Config) { c.Mods = []string{"a", "b"} }, []string{"mods"}, []string{}},
+		{"restart only field", func(c *Config) { c.Listen = ":2" }, []string{"listen"}, []string{"listen"}},
+		{"several", func(c *Config) { c.CacheDir = "/c"; c.SegmentDir = "/s" }, []string{"segment_dir", "cacheDir"}, []string{"segment_dir", "cacheDir"}},
+		{"room added", func(c *Config) { c.Rooms = append(c.Rooms, RoomConfig{Name: "b"}) }, []string{"rooms"}, []string{"rooms"}},
+		{"room renamed", func(c *Config) { c.Rooms = []RoomConfig{{Name: "b"}} }, []string{"rooms"}, []string{"rooms"}},
+		{"room segments moved", func(c *Config) { c.Rooms = []RoomConfig{{Name: "a", SegmentDir: "/a"}} }, []string{"rooms"}, []string{"rooms"}},
+		{"room mods", func(c *Config) { c.Rooms = []RoomConfig{{Name: "a", Mods: []string{"x"}}} }, []string{"rooms"}, []string{}},
+	}
+
+	for _, c := range cases {
+		old := base
+		changed := base
+		changed.Rooms = append([]RoomConfig(nil), base.Rooms...)
+		c.edit(&changed)
+
+		if got := configChanges(&old, &changed); !reflect.DeepEqual(got, c.wantChanged) {
+			t.Errorf("%s: configChanges = %q, want %q", c.name, got, c.wantChanged)
+		}
+		if got := restartOnlyChanges(&old, &changed); !reflect.DeepEqual(got, c.wantRestart) {
+			t.Errorf("%s: restartOnlyChanges = %q, want %q", c.name, got, c.wantRestart)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluffywatch-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	running := &Config{Master: "m", Listen: ":1", SegmentDir: "/segments", Rooms: []RoomConfig{{Name: "a"}}}
+	s := &Server{config: running}
+
+	write := func(c Config) {
+		t.Helper()
+		marshalled, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, marshalled, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func() (live, restart []string) {
+		t.Helper()
+		c, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.applyConfig(c)
+	}
+
+	// An invalid file keeps the old config
+	ioutil.WriteFile(path, []byte(`{"listen": `), 0664)
+	s.reloadConfig(path)
+	write(Config{Master: "m", Listen: ":1", VoteThreshold: 2})
+	s.reloadConfig(path)
+	if s.config != running {
+		t.Fatal("an invalid config replaced the running one")
+	}
+
+	steps := []struct {
+		name        string
+		file        Config
+		wantLive    []string
+		wantRestart []string
+		check       func(c *Config) string
+	}{
+		{
+			name:        "live field",
+			file:        Config{Master: "m", Listen: ":1", SegmentDir: "/segments", Rooms: []RoomConfig{{Name: "a"}}, VoteMode: true},
+			wantLive:    []string{"voteMode"},
+			wantRestart: []string{},
+			check: func(c *Config) string {
+				if !c.VoteMode {
+					return "voteMode wasn't applied"
+				}
+				return ""
+			},
+		},
+		{
+			name:        "restart only field",
+			file:        Config{Master: "m", Listen: ":2", SegmentDir: "/segments", Rooms: []RoomConfig{{Name: "a"}}, VoteMode: true},
+			wantLive:    []string{},
+			wantRestart: []string{"listen"},
+			check: func(c *Config) string {
+				if c.Listen != ":1" {
+					return "listen was applied without a restart"
+				}
+				return ""
+			},
+		},
+		{
+			name:        "restart only field again",
+			file:        Config{Master: "m2", Listen: ":2", SegmentDir: "/segments", Rooms: []RoomConfig{{Name: "a"}}, VoteMode: true},
+			wantLive:    []string{"master"},
+			wantRestart: []string{},
+			check: func(c *Config) string {
+				if c.Listen != ":1" || c.Master != "m2" {
+					return "wrong listen or master"
+				}
+				return ""
+			},
+		},
+		{
+			name:        "room added and renamed",
+			file:        Config{Master: "m2", Listen: ":2", SegmentDir: "/segments", Rooms: []RoomConfig{{Name: "b"}, {Name: "c"}}, VoteMode: true},
+			wantLive:    []string{"rooms"},
+			wantRestart: []string{"rooms"},
+			check: func(c *Config) string {
+				if len(c.Rooms) != 2 || c.Rooms[0].Name != "b" {
+					return "rooms weren't updated"
+				}
+				return ""
+			},
+		},
+	}
+
+	for _, step := range steps {
+		write(step.file)
+		live, restart := reload()
+		if !reflect.DeepEqual(live, step.wantLive) {
+			t.Errorf("%s: live changes %q, want %q", step.name, live, step.wantLive)
+		}
+		if !reflect.DeepEqual(restart, step.wantRestart) {
+			t.Errorf("%s: restart changes %q, want %q", step.name, restart, step.wantRestart)
+		}
+		if msg := step.check(s.config); msg != "" {
+			t.Errorf("%s: %s", step.name, msg)
+		}
+	}
+
+	// Saving keeps the value waiting for the restart, and goes through a temp file
+	if err = s.saveConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Listen != ":2" || saved.Master != "m2" {
+		t.Errorf("saved listen %s and master %s, want :2 and m2", saved.Listen, saved.Master)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temp file was left behind")
+	}
+}
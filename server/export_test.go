@@ -0,0 +1,12 @@
+package server
+
+// VoteContext is what a vote for action in the room is about right now
+func (r *Room) VoteContext(action string) (string, error) {
+	var context string
+	err := r.Player.call(func() error {
+		var err error
+		context, err = r.Player.voteContext(action)
+		return err
+	})
+	return context, err
+}
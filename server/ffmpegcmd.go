@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FFmpegCommand is a full ffmpeg invocation, Args turns it into the argument list
+type FFmpegCommand struct {
+	Binary   string
+	Realtime bool          // Read the input at its native rate, needed for live streaming
+	Seek     string        // h:m:s to start at, empty starts at the beginning
+	Duration time.Duration // How much to encode, 0 for all of it
+	Input    string
+	Streams  []int    // Input streams to map, ffmpeg picks if empty
+	Filters  []Filter // Video filters, applied in order
+
+	InputArgs  []string // Extra args put before the input, see validateExtraArgs
+	OutputArgs []string // Extra args put before the output
+
+	AudioCodec   string
+	AudioRate    int  // Hz
+	AudioVBR     int  // 1-5, 5 is highest
+	NoVideo      bool // Audio only, the video fields are ignored
+	VideoCodec   string
+	VideoProfile string
+	Preset       string // x264 preset
+	MaxRate      int    // kbit/s, the buffer is twice this
+	X264Params   string
+
+	Output HLSOutput
+}
+
+// HLSOutput is where the stream is written
+type HLSOutput struct {
+	Playlist    string // Path of the .m3u8, segments end up next to it
+	StartNumber int    // Number of the first segment
+}
+
+// Filter is one ffmpeg filter, the args are escaped when it's turned into a string
+type Filter struct {
+	Name string
+	Args []string
+}
+
+// NewFFmpegCommand returns the command a job is transcoded with
+func NewFFmpegCommand(job TranscodeJob) *FFmpegCommand {
+	profile := job.Profile
+	if profile.AudioRate == 0 {
+		profile.AudioRate = 44100
+	}
+	if profile.AudioVBR == 0 {
+		profile.AudioVBR = 5
+	}
+	if profile.VideoProfile == "" {
+		profile.VideoProfile = "baseline"
+	}
+	if profile.Keyint == 0 {
+		profile.Keyint = 100
+	}
+
+	c := &FFmpegCommand{
+		Binary:     "ffmpeg",
+		Realtime:   job.Realtime,
+		Duration:   job.Duration,
+		Input:      job.Item.Path,
+		Streams:    job.Settings.Streams,
+		InputArgs:  profile.InputArgs,
+		OutputArgs: profile.OutputArgs,
+		AudioCodec: "aac",
+		AudioRate:  profile.AudioRate,
+		AudioVBR:   profile.AudioVBR,
+		NoVideo:    profile.AudioOnly,
+		Output: HLSOutput{
+			Playlist:    job.Output,
+			StartNumber: job.StartSegment,
+		},
+	}
+
+	if job.Settings.Seek != "" && LocationSeconds(job.Settings.Seek) > 0 {
+		c.Seek = job.Settings.Seek
+	}
+	if c.NoVideo {
+		return c
+	}
+
+	c.VideoCodec = "libx264"
+	c.VideoProfile = profile.VideoProfile
+	c.Preset = job.Settings.Preset
+	c.MaxRate = job.Settings.MaxRate
+	// Fixed keyframe interval so segments are the same length
+	c.X264Params = fmt.Sprintf("keyint=%d:no-scenecut=1", profile.Keyint)
+	c.Filters = []Filter{
+		{Name: "scale", Args: []string{strconv.Itoa(job.Settings.ScaleWidth), "trunc(ow/a/2)*2"}},
+	}
+	if job.Subs {
+		c.Filters = append(c.Filters, Filter{Name: "subtitles", Args: []string{job.Item.Path}})
+	}
+	return c
+}
+
+func (c *FFmpegCommand) Args() []string {
+	args := make([]string, 0, 50)
+	if c.Realtime {
+		args = append(args, "-re")
+	}
+	if c.Seek != "" {
+		args = append(args, "-ss", c.Seek)
+	}
+	args = append(args, c.InputArgs...)
+	args = append(args, "-i", c.Input)
+	for _, s := range c.Streams {
+		args = append(args, "-map", fmt.Sprintf("0:%d", s))
+	}
+
+	args = append(args,
+		"-strict", "-2", // Enable experimental codecs
+		"-c:a", c.AudioCodec,
+		"-ar", strconv.Itoa(c.AudioRate),
+		"-vbr", strconv.Itoa(c.AudioVBR),
+	)
+	if c.NoVideo {
+		args = append(args, "-vn")
+	} else {
+		args = append(args,
+			"-c:v", c.VideoCodec,
+			"-profile:v", c.VideoProfile,
+			"-preset", c.Preset,
+			"-maxrate", fmt.Sprintf("%dk", c.MaxRate),
+			"-bufsize", fmt.Sprintf("%dk", c.MaxRate*2),
+		)
+		if len(c.Filters) > 0 {
+			args = append(args, "-vf", FilterChain(c.Filters))
+		}
+		if c.X264Params != "" {
+			args = append(args, "-x264-params", c.X264Params)
+		}
+	}
+	args = append(args, c.OutputArgs...)
+	if c.Duration > 0 {
+		args = append(args, "-t", fmt.Sprintf("%.3f", c.Duration.Seconds()))
+	}
+
+	args = append(args,
+		"-f", "hls",
+		"-start_number", strconv.Itoa(c.Output.StartNumber),
+		"-hls_allow_cache", "0",
+		"-hls_flags", "discont_start", // Players need to know the timestamps jump between items
+		c.Output.Playlist,
+	)
+	return args
+}
+
+// String returns the command as it would be typed in a shell
+func (c *FFmpegCommand) String() string {
+	args := c.Args()
+	quoted := make([]string, 0, len(args)+1)
+	quoted = append(quoted, shellQuote(c.Binary))
+	for _, a := range args {
+		quoted = append(quoted, shellQuote(a))
+	}
+	return strings.Join(quoted, " ")
+}
+
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+func shellQuote(s string) string {
+	if shellSafeRegex.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+var (
+	// Option values are split on : so those need escaping
+	filterArgReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	// Then the whole graph is split on , ; and [ ] so it needs escaping again on top of that
+	filterGraphReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`)
+)
+
+// EscapeFilterArg escapes a filter argument so it can be put in a -vf or -filter_complex as is
+func EscapeFilterArg(arg string) string {
+	return filterGraphReplacer.Replace(filterArgReplacer.Replace(arg))
+}
+
+func (f Filter) String() string {
+	if len(f.Args) < 1 {
+		return f.Name
+	}
+	escaped := make([]string, len(f.Args))
+	for i, a := range f.Args {
+		escaped[i] = EscapeFilterArg(a)
+	}
+	return f.Name + "=" + strings.Join(escaped, ":")
+}
+
+// FilterChain joins filters into a chain for -vf
+func FilterChain(filters []Filter) string {
+	parts := make([]string, len(filters))
+	for i, f := range filters {
+		parts[i] = f.String()
+	}
+	return strings.Join(parts, ",")
+}
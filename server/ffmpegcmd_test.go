@@ -0,0 +1,109 @@
+package server
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// A subtitle path with everything that needs escaping in a filter graph
+const awkwardPath = `/media/It's [a]: test, \ movie.mkv`
+
+var ffmpegCommandCases = []struct {
+	name string
+	job  TranscodeJob
+}{
+	{"ffmpeg_default", TranscodeJob{
+		Item:         PlaylistItem{Path: "/media/movie.mkv"},
+		Settings:     TranscoderSettings{ScaleWidth: 1280, MaxRate: 2000, Preset: "veryfast"},
+		Profile:      defaultProfiles[DefaultProfile],
+		StartSegment: 0,
+		Output:       "/tmp/hls/stream.m3u8",
+		Realtime:     true,
+	}},
+	{"ffmpeg_subs_seek", TranscodeJob{
+		Item:         PlaylistItem{Path: awkwardPath},
+		Settings:     TranscoderSettings{ScaleWidth: 854, MaxRate: 800, Preset: "veryfast", Seek: "0:12:30", Streams: []int{0, 2, 5}},
+		Profile:      defaultProfiles["low"],
+		Subs:         true,
+		StartSegment: 42,
+		Output:       "/tmp/hls/stream.m3u8",
+		Realtime:     true,
+	}},
+	{"ffmpeg_hd_extra_args", TranscodeJob{
+		Item:     PlaylistItem{Path: "/media/movie.mkv"},
+		Settings: TranscoderSettings{ScaleWidth: 1920, MaxRate: 5000, Preset: "fast"},
+		Profile: TranscoderProfile{
+			AudioRate:    48000,
+			VideoProfile: "main",
+			Keyint:       50,
+			InputArgs:    []string{"-hwaccel", "auto"},
+			OutputArgs:   []string{"-tune", "film", "-strict", "-2"},
+		},
+		StartSegment: 7,
+		Output:       "/tmp/hls/stream.m3u8",
+		Realtime:     true,
+	}},
+	{"ffmpeg_audio_only", TranscodeJob{
+		Item:     PlaylistItem{Path: awkwardPath},
+		Settings: TranscoderSettings{Seek: "1:00:00"},
+		Profile:  defaultProfiles["audio-only"],
+		Subs:     true, // Ignored without video
+		Output:   "/tmp/hls/stream.m3u8",
+		Realtime: true,
+	}},
+	{"ffmpeg_preview", TranscodeJob{
+		Item:     PlaylistItem{Path: "/media/movie.mkv"},
+		Settings: TranscoderSettings{ScaleWidth: 1280, MaxRate: 2000, Preset: "veryfast"},
+		Profile:  defaultProfiles[DefaultProfile],
+		Output:   "/tmp/preview/preview.m3u8",
+		Duration: 5 * time.Second,
+	}},
+}
+
+func TestFFmpegCommandGolden(t *testing.T) {
+	for _, c := range ffmpegCommandCases {
+		t.Run(c.name, func(t *testing.T) {
+			cmd := NewFFmpegCommand(c.job)
+			// One arg per line, then the shell version
+			got := strings.Join(cmd.Args(), "\n") + "\n\n" + cmd.String() + "\n"
+
+			path := filepath.Join("testdata", c.name+".golden")
+			if *updateGolden {
+				if err := ioutil.WriteFile(path, []byte(got), 0664); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("args don't match %s, run with -update if the change is intended\ngot:\n%s\nwant:\n%s", path, got, want)
+			}
+		})
+	}
+}
+
+func TestEscapeFilterArg(t *testing.T) {
+	cases := map[string]string{
+		"plain.mkv":      "plain.mkv",
+		`a:b`:            `a\\:b`,
+		`a,b`:            `a\,b`,
+		`a'b`:            `a\\\'b`,
+		`[a]`:            `\[a\]`,
+		`a;b`:            `a\;b`,
+		`a\b`:            `a\\\\b`,
+		"/media/x y.mkv": "/media/x y.mkv",
+	}
+	for in, want := range cases {
+		if got := EscapeFilterArg(in); got != want {
+			t.Errorf("EscapeFilterArg(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,690 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"log"
+	"os"
+	"time"
+)
+
+type ErrResp struct {
+	Err string `json:"error"`
+}
+
+func (s *Server) sendErrResp(session fnet.Session, err error, evtId int32) {
+	errSend := s.netEngine.CreateAndSend(session, evtId, ErrResp{err.Error()})
+	if errSend != nil {
+		log.Println("Error sending error response: ", err)
+		return
+	}
+}
+
+func (s *Server) checkError(session fnet.Session, err error, evtId int32) bool {
+	if err != nil {
+		log.Println("Error occured while handling a request: ", err)
+		s.sendErrResp(session, err, evtId)
+		return true
+	}
+
+	return false
+}
+
+func (s *Server) checkBanned(session fnet.Session, respond bool) bool {
+	id, _ := session.Data.GetString("id")
+	settings := s.sessionRoom(session).settings()
+	// Check if banned
+	for _, b := range settings.Bans {
+		if b == id {
+			// banned!
+			if respond {
+				s.sendNotification(session, "You're banned from the chat, if you got unfairly banned message /u/jonas747", true)
+			}
+			return true
+		}
+	}
+	ownIp := session.Conn.IP()
+	for _, ip := range settings.IPBans {
+		//log.Printf(ip, ownIp)
+		if ip == ownIp {
+			if respond {
+				s.sendNotification(session, "You're banned from the chat, if you got unfairly banned message /u/jonas747", true)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// viewerKey identifies the viewer for limits and votes, names can be changed at will so it's the id,
+// or the ip for viewers that havent authenticated
+func viewerKey(session fnet.Session) string {
+	if id, ok := session.Data.GetString("id"); ok && id != "" {
+		return "id:" + id
+	}
+	return "ip:" + session.Conn.IP()
+}
+
+func (s *Server) checkMod(session fnet.Session, respond bool) bool {
+	settings := s.sessionRoom(session).settings()
+
+	if settings.Master == "*" {
+		return true
+	}
+
+	id, _ := session.Data.GetString("id")
+
+	if id != "" && id == settings.Master {
+		return true
+	}
+
+	for _, m := range settings.Mods {
+		if m == id {
+			return true
+		}
+	}
+
+	if respond {
+		s.sendNotification(session, "You're not a mod", true)
+	}
+	return false
+}
+
+func (s *Server) checkMaster(session fnet.Session, respond bool) bool {
+	settings := s.sessionRoom(session).settings()
+
+	if settings.Master == "*" {
+		return true
+	}
+
+	id, _ := session.Data.GetString("id")
+	if id != "" && settings.Master == id {
+		return true
+	}
+
+	if respond {
+		s.sendNotification(session, "You're not an admin", true)
+	}
+	return false
+}
+
+type SetNameData struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+}
+
+func (s *Server) handlerUserSetName(session fnet.Session, user SetNameData) {
+	if user.Name == "" {
+		user.Name = ">:)"
+	}
+	if len(user.Name) > 30 {
+		user.Name = user.Name[:29]
+	}
+
+	room := s.sessionRoom(session)
+	room.viewersMutex.Lock()
+	_, found := room.viewers[user.Name]
+	if found {
+		s.sendErrResp(session, errors.New("Name already in use"), EvtError)
+		room.viewersMutex.Unlock()
+		return
+	}
+
+	// Change the registered name
+	oldName, _ := session.Data.GetString("name")
+
+	temp := room.viewers[oldName]
+	delete(room.viewers, oldName)
+	room.viewers[user.Name] = temp
+	room.viewersMutex.Unlock()
+
+	// And finally here
+	session.Data.Set("name", user.Name)
+
+	user.Old = oldName
+
+	err := s.netEngine.CreateAndSend(session, EvtSetName, user)
+	if err != nil {
+		log.Println("Error sending message: ", err)
+		return
+	}
+
+	room.broadcastNotification(fmt.Sprintf("%s Changed their name to %s", oldName, user.Name), false)
+
+	room.broadcastStatus()
+	log.Printf("'%s' changed their name to '%s'\n", oldName, user.Name)
+}
+
+type SearchQuery struct {
+	Title  string `json:"title"`
+	Kind   string `json:"kind"` // One of tv, movie
+	Year   int    `json:"year"`
+	Show   string `json:"show"`
+	Source string `json:"source"` // One of local, plex, jellyfin. Defaults to local
+}
+
+type SearchReply struct {
+	Items  []MediaItem `json:"items"`
+	Kind   string      `json:"kind"`
+	Source string      `json:"source"`
+}
+
+type AddByPathData struct {
+	Path     string `json:"path"`
+	PlayNext bool   `json:"playNext"` // Insert after the current item instead of at the end
+}
+
+// Adds a file, or all video files in a directory and its subdirectories
+func (s *Server) handleAddByPath(session fnet.Session, data AddByPathData) {
+	if !s.checkRole(session, s.addRole(), true) {
+		return
+	}
+
+	log.Printf("Adding %s to the playlist...\n", data.Path)
+
+	path, err := s.ResolveMediaPath(data.Path)
+	if s.checkError(session, err, EvtAddByPath) {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		s.sendErrResp(session, ErrMediaNotFound, EvtAddByPath)
+		return
+	}
+
+	room := s.sessionRoom(session)
+	name, _ := session.Data.GetString("name")
+	if !info.IsDir() {
+		items := []PlaylistItem{s.newMediaItem(path)}
+		setItemOwner(session, items)
+		if data.PlayNext {
+			room.Player.InsertNext(name, items)
+		} else {
+			room.Player.AppendItems(name, items)
+		}
+		room.broadcastPlaylistStatus()
+		return
+	}
+
+	items, err := s.ScanMediaDir(path)
+	if err != nil {
+		log.Println("Failed scanning directory:", err)
+		s.sendErrResp(session, errors.New("Failed scanning directory"), EvtAddByPath)
+		return
+	}
+
+	// Symlinks inside the directory may point outside the roots
+	items = s.filterAllowedItems(items)
+	if len(items) < 1 {
+		s.sendErrResp(session, errors.New("No video files found in directory"), EvtAddByPath)
+		return
+	}
+
+	setItemOwner(session, items)
+	if data.PlayNext {
+		room.Player.InsertNext(name, items)
+	} else {
+		room.Player.AppendItems(name, items)
+	}
+
+	room.broadcastNotification(fmt.Sprintf("%s Added %d items to the playlist", name, len(items)), true)
+	room.broadcastPlaylistStatus()
+}
+
+type StatusReply struct {
+	Timestamp int                  `json:"timestamp"`
+	Action    string               `json:"action"`
+	Viewers   map[string]bool      `json:"viewers"`
+	Playing   bool                 `json:"playing"`
+	Mode      PlaybackMode         `json:"mode"`
+	Votes     map[string]VoteTally `json:"votes,omitempty"` // Only in vote mode
+	Speed     float64              `json:"speed,omitempty"` // Transcode speed, viewers will buffer if it's below 1
+}
+
+// Responds with the status
+func (s *Server) handleStatus(session fnet.Session) {
+	log.Println("Handling status")
+
+	wm, err := s.sessionRoom(session).buildStatusMessage()
+	if s.checkError(session, err, EvtStatus) {
+		return
+	}
+	session.Conn.Send(wm)
+}
+
+// Responds with the current playlist
+func (s *Server) handlePlaylist(session fnet.Session) {
+	log.Println("Handling playlist")
+
+	wm, err := s.sessionRoom(session).buildPlaylistMessage()
+	if s.checkError(session, err, EvtPlaylist) {
+		return
+	}
+	session.Conn.Send(wm)
+}
+
+// Responds with the settings
+func (s *Server) handleSettings(session fnet.Session) {
+	log.Println("Handling settings")
+
+	wm, err := s.sessionRoom(session).buildSettingsMessage()
+	if s.checkError(session, err, EvtSettings) {
+		return
+	}
+	session.Conn.Send(wm)
+}
+
+type PlayRequest struct {
+	Index int `json:"index"`
+}
+
+func (s *Server) handlePlay(session fnet.Session, pr PlayRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	var err error
+	if pr.Index != -1 {
+		// Play a specified playlist element instead
+		err = room.Player.Jump(pr.Index)
+	} else {
+		err = room.Player.Play()
+	}
+	if s.checkError(session, err, EvtPlay) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Pressed play", name), true)
+}
+
+func (s *Server) handlePause(session fnet.Session) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	err := room.Player.Pause()
+	if s.checkError(session, err, EvtPause) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Pressed pause", name), true)
+}
+
+func (s *Server) handleNext(session fnet.Session) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	err := room.Player.Next()
+	if s.checkError(session, err, EvtNext) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Pressed next", name), true)
+}
+func (s *Server) handlePrevious(session fnet.Session) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	err := room.Player.Prev()
+	if s.checkError(session, err, EvtPrev) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Pressed previous", name), true)
+}
+
+type SeekRequest struct {
+	Position string `json:"position"` // h:m:s
+}
+
+func (s *Server) handleSeek(session fnet.Session, req SeekRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	err := room.Player.Seek(req.Position)
+	if s.checkError(session, err, EvtSeek) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Seeked to %s", name, req.Position), true)
+}
+
+func (s *Server) handlePlaylistClear(session fnet.Session) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	name, _ := session.Data.GetString("name")
+	room.Player.Clear(name)
+	room.broadcastNotification(fmt.Sprintf("%s Cleared the playlist", name), true)
+	room.broadcastPlaylistStatus()
+}
+
+func (s *Server) handleSetSettings(session fnet.Session, settings TranscoderSettings) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+
+	// Check if the settings are valid, better here than when ffmpeg falls over mid stream
+	settings, _, err := s.resolveSettings(room, settings)
+	if err != nil {
+		s.sendErrResp(session, err, EvtSetSettings)
+		return
+	}
+
+	err = room.Player.SetSettings(settings)
+	if s.checkError(session, err, EvtSetSettings) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Changed the transcoder settings", name), true)
+	if settings.Subs {
+		log.Println("Subs are enabled!")
+	} else {
+		log.Println("Subs are disabled!")
+	}
+
+}
+
+type FFmpegCommandRequest struct {
+	Index int `json:"index"` // -1 for the current item
+}
+
+type FFmpegCommandReply struct {
+	Command string   `json:"command"` // For pasting in a shell
+	Args    []string `json:"args"`
+}
+
+// Dry run, shows mods the ffmpeg command an item would be played with without running it
+func (s *Server) handleFFmpegCommand(session fnet.Session, req FFmpegCommandRequest) {
+	if !s.checkMod(session, true) {
+		return
+	}
+
+	c, err := s.sessionRoom(session).Player.FFmpegCommand(req.Index)
+	if s.checkError(session, err, EvtFFmpegCommand) {
+		return
+	}
+
+	reply := FFmpegCommandReply{
+		Command: c.String(),
+		Args:    c.Args(),
+	}
+	err = s.netEngine.CreateAndSend(session, EvtFFmpegCommand, reply)
+	if err != nil {
+		log.Println("Error sending ffmpeg command: ", err)
+	}
+}
+
+type WatchingStatusUpdate struct {
+	Watching bool `json:"watching"`
+}
+
+func (s *Server) handleWatchingStatusUpdate(session fnet.Session, wsu WatchingStatusUpdate) {
+	name, _ := session.Data.GetString("name")
+	//vChangeChan <- ViewerChange{Name: name, Watching: wsu.Watching}
+	session.Data.Set("watching", wsu.Watching)
+
+	isWatching := "watching"
+	if !wsu.Watching {
+		isWatching = "not watching"
+	}
+
+	s.sessionRoom(session).broadcastNotification(fmt.Sprintf("%s changed state to: %s", name, isWatching), false)
+}
+
+type ChatMessage struct {
+	Msg  string `json:"msg"`
+	From string `json:"from"`
+	Kind string `json:"kind"`
+}
+
+func (s *Server) handleChatMessage(session fnet.Session, cm ChatMessage) {
+	id, exists := session.Data.GetString("id")
+	if !exists {
+		s.sendNotification(session, "You do not appear to have an id?..", true)
+		return
+	}
+
+	// Check if banned
+	if s.checkBanned(session, true) {
+		return
+	}
+
+	if len(cm.Msg) > 1000 {
+		s.sendNotification(session, "Too long chat message, cant be longer than 1k characters", true)
+		return
+	}
+
+	last, exists := session.Data.Get("lastchat")
+	if exists {
+		cast := last.(time.Time)
+
+		since := time.Since(cast)
+		if since.Seconds() < 0.5 {
+			s.sendNotification(session, "You can send a maximum of 1 chat message per 0.5 second", true)
+			return
+		}
+	}
+	session.Data.Set("lastchat", time.Now())
+
+	from, _ := session.Data.GetString("name")
+
+	bcm := ChatMessage{Msg: cm.Msg, From: from}
+
+	if s.checkMaster(session, false) {
+		bcm.Kind = "master"
+	} else if s.checkMod(session, false) {
+		bcm.Kind = "mod"
+	} else {
+		bcm.Kind = "user"
+	}
+
+	log.Printf("Chat msg {%s}[%s][%s]'%s':%s\n", session.Conn.IP(), id, bcm.Kind, bcm.From, bcm.Msg)
+	err := s.sessionRoom(session).CreateAndBroadcast(EvtChatMessage, bcm)
+	if err != nil {
+		log.Println("Error creating and sending chat message", err)
+		return
+	}
+}
+
+func (s *Server) handleAuth(session fnet.Session, key string) {
+	log.Println("Attempting to authenticate with key ", key)
+
+	last, exists := session.Data.Get("lastauth")
+	if exists {
+		cast := last.(time.Time)
+
+		since := time.Since(cast)
+		if since.Seconds() < 5 {
+			s.sendNotification(session, "Maximum 1 login try every 5 second", true)
+			return
+		}
+	}
+	session.Data.Set("lastauth", time.Now())
+	session.Data.Set("id", key)
+}
+
+type chatCmd struct {
+	Cmd    string `json:"cmd"`
+	Target string `json:"target"`
+}
+
+func (s *Server) handleChatCmd(session fnet.Session, data chatCmd) {
+	log.Println("Handling chatcmd", data.Cmd)
+
+	room := s.sessionRoom(session)
+	room.viewersMutex.RLock()
+	targetSession, exists := room.viewers[data.Target]
+	room.viewersMutex.RUnlock()
+
+	if !exists {
+		s.sendNotification(session, "couldn't find user '"+data.Target+"'", true)
+		return
+	}
+
+	targetId, found := targetSession.Data.GetString("id")
+	if !found {
+		s.sendNotification(session, "User has no id '"+data.Target+"'", true)
+		return
+	}
+
+	ownName, _ := session.Data.GetString("name")
+	ownId, _ := session.Data.GetString("id")
+
+	switch data.Cmd {
+	case "/mod":
+		log.Println("Adding mod", data.Target)
+		if !s.checkMaster(session, true) {
+			return
+		}
+		err := s.addMod(room.Name, targetId)
+		if err != nil {
+			s.sendNotification(session, "Error: "+err.Error(), true)
+		}
+		s.sendNotification(session, "Added mod "+data.Target, true)
+	case "/demod":
+		if !s.checkMaster(session, true) {
+			return
+		}
+		err := s.removeMod(room.Name, targetId)
+		if err != nil {
+			s.sendNotification(session, "Error: "+err.Error(), true)
+		}
+		s.sendNotification(session, "Removed mod "+data.Target, true)
+	case "/ban":
+		if !s.checkMod(session, true) {
+			return
+		}
+		if s.checkMod(targetSession, false) {
+			s.sendNotification(session, "Cannot ban other mods", true)
+			return
+		}
+
+		err := s.banUser(room.Name, targetId)
+		if err != nil {
+			s.sendNotification(session, "Error: "+err.Error(), true)
+		}
+		s.sendNotification(session, "Banned user "+data.Target, true)
+		log.Printf("{%s}[%s] '%s' Banned '%s' [%s]\n", targetSession.Conn.IP(), ownId, ownName, data.Target, targetId)
+	case "/unban":
+		if !s.checkMod(session, true) {
+			return
+		}
+
+		err := s.unBanUser(room.Name, targetId)
+		if err != nil {
+			s.sendNotification(session, "Error: "+err.Error(), true)
+		}
+		s.sendNotification(session, "Unbanned user "+data.Target, true)
+		log.Printf("{%s}[%s] '%s' UnBanned '%s' [%s]\n", targetSession.Conn.IP(), ownId, ownName, data.Target, targetId)
+
+	case "/ipban":
+		if !s.checkMod(session, true) {
+			return
+		}
+		err := s.banIP(room.Name, targetSession.Conn.IP())
+		if err != nil {
+			s.sendNotification(session, "Error: "+err.Error(), true)
+		}
+		s.sendNotification(session, "banned ip "+data.Target, true)
+		log.Printf("{%s}[%s] '%s' ipbanned '%s' [%s]\n", targetSession.Conn.IP(), ownId, ownName, data.Target, targetSession.Conn.IP())
+
+	case "/ipunban":
+		if !s.checkMod(session, true) {
+			return
+		}
+
+		err := s.unBanIP(room.Name, targetSession.Conn.IP())
+		if err != nil {
+			s.sendNotification(session, "Error: "+err.Error(), true)
+		}
+		s.sendNotification(session, "unbanned ip "+data.Target, true)
+		log.Printf("{%s}[%s] '%s' ip unbanned '%s' [%s]\n", targetSession.Conn.IP(), ownId, ownName, data.Target, targetSession.Conn.IP())
+	}
+}
+
+func (s *Server) handleReloadPlaylist(session fnet.Session) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+	room := s.sessionRoom(session)
+	path := room.reloadPath()
+	if path == "" {
+		s.sendErrResp(session, errors.New("This room has no playlist file"), EvtReloadPlaylist)
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	err := s.loadPlaylist(room.Player, path, name)
+	if s.checkError(session, err, EvtReloadPlaylist) {
+		return
+	}
+	room.broadcastPlaylistStatus()
+}
+
+type PlaylistExportRequest struct {
+	Format string `json:"format"` // One of m3u, pls, xspf, json
+}
+
+type PlaylistExportReply struct {
+	Format   string `json:"format"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// Responds with the current playlist as a document the client can offer as a download
+func (s *Server) handlePlaylistExport(session fnet.Session, req PlaylistExportRequest) {
+	if req.Format == "" {
+		req.Format = PlaylistFormatM3U
+	}
+	err := ValidatePlaylistFormat(req.Format)
+	if s.checkError(session, err, EvtPlaylistExport) {
+		return
+	}
+
+	var items []PlaylistItem
+	player := s.sessionRoom(session).Player
+	player.do(func() {
+		items = make([]PlaylistItem, len(player.CurrentPlaylist.Items))
+		copy(items, player.CurrentPlaylist.Items)
+	})
+
+	var buf bytes.Buffer
+	err = WritePlaylist(&buf, req.Format, items)
+	if s.checkError(session, err, EvtPlaylistExport) {
+		return
+	}
+
+	reply := PlaylistExportReply{
+		Format:   req.Format,
+		Filename: fmt.Sprintf("fluffywatch-%s.%s", time.Now().Format("2006-01-02"), req.Format),
+		MimeType: playlistMimeTypes[req.Format],
+		Data:     buf.String(),
+	}
+	err = s.netEngine.CreateAndSend(session, EvtPlaylistExport, reply)
+	if err != nil {
+		log.Println("Error sending playlist export: ", err)
+	}
+}
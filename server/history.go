@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+)
+
+// How many playlist changes can be undone
+const MaxPlaylistHistory = 50
+
+// Playlist change actions
+const (
+	PlaylistActionAdd    = "add"
+	PlaylistActionRemove = "remove"
+	PlaylistActionMove   = "move"
+	PlaylistActionClear  = "clear"
+	PlaylistActionReload = "reload"
+)
+
+var (
+	ErrNothingToUndo = errors.New("Nothing to undo")
+	ErrNothingToRedo = errors.New("Nothing to redo")
+)
+
+// PlaylistChange is the state of the playlist before a change was made
+type PlaylistChange struct {
+	Action       string
+	By           string
+	Items        []PlaylistItem
+	CurrentIndex int
+}
+
+type PlaylistHistory struct {
+	undo []PlaylistChange
+	redo []PlaylistChange
+}
+
+func pushChange(stack []PlaylistChange, change PlaylistChange) []PlaylistChange {
+	stack = append(stack, change)
+	if len(stack) > MaxPlaylistHistory {
+		stack = append(stack[:0], stack[len(stack)-MaxPlaylistHistory:]...)
+	}
+	return stack
+}
+
+// snapshot returns a copy of the current playlist as a change
+// runs on the player goroutine
+func (p *Player) snapshot(action, by string) PlaylistChange {
+	items := make([]PlaylistItem, len(p.CurrentPlaylist.Items))
+	copy(items, p.CurrentPlaylist.Items)
+	return PlaylistChange{
+		Action:       action,
+		By:           by,
+		Items:        items,
+		CurrentIndex: p.CurrentPlaylist.CurrentIndex,
+	}
+}
+
+// recordChange should be called right before the playlist is changed
+// runs on the player goroutine
+func (p *Player) recordChange(action, by string) {
+	p.History.undo = pushChange(p.History.undo, p.snapshot(action, by))
+	p.History.redo = nil
+}
+
+// Undo restores the playlist to how it was before the last change, and returns that change
+func (p *Player) Undo() (PlaylistChange, error) {
+	var change PlaylistChange
+	err := p.call(func() error {
+		if len(p.History.undo) < 1 {
+			return ErrNothingToUndo
+		}
+
+		change = p.History.undo[len(p.History.undo)-1]
+		p.History.undo = p.History.undo[:len(p.History.undo)-1]
+		p.History.redo = pushChange(p.History.redo, p.snapshot(change.Action, change.By))
+
+		p.restore(change)
+		return nil
+	})
+	return change, err
+}
+
+// Redo reapplies the last undone change, and returns it
+func (p *Player) Redo() (PlaylistChange, error) {
+	var change PlaylistChange
+	err := p.call(func() error {
+		if len(p.History.redo) < 1 {
+			return ErrNothingToRedo
+		}
+
+		change = p.History.redo[len(p.History.redo)-1]
+		p.History.redo = p.History.redo[:len(p.History.redo)-1]
+		p.History.undo = pushChange(p.History.undo, p.snapshot(change.Action, change.By))
+
+		p.restore(change)
+		return nil
+	})
+	return change, err
+}
+
+// restore replaces the playlist with the one in change, keeping CurrentIndex at the item that's
+// playing (or paused) if it's in there. Playback has moved on since the change was recorded
+// so its CurrentIndex is only used if the current item can't be found
+// runs on the player goroutine
+func (p *Player) restore(change PlaylistChange) {
+	var current *PlaylistItem
+	if p.Playing {
+		current = &p.nowPlaying
+	} else if p.CurrentPlaylist.CurrentIndex >= 0 && p.CurrentPlaylist.CurrentIndex < len(p.CurrentPlaylist.Items) {
+		current = &p.CurrentPlaylist.Items[p.CurrentPlaylist.CurrentIndex]
+	}
+
+	index := -1
+	if current != nil {
+		index = findPlaylistItem(change.Items, current.Path, p.CurrentPlaylist.CurrentIndex)
+	}
+
+	p.CurrentPlaylist.Items = change.Items
+	if index != -1 {
+		p.CurrentPlaylist.CurrentIndex = index
+		p.jumped = false
+		return
+	}
+
+	index = change.CurrentIndex
+	if index < 0 {
+		index = 0
+	}
+	if index > len(change.Items) {
+		index = len(change.Items)
+	}
+
+	p.Settings.Seek = ""
+	p.jumpTo(index)
+}
+
+// findPlaylistItem returns the index of the item with path, the one closest to near if there's
+// duplicates. -1 if not found
+func findPlaylistItem(items []PlaylistItem, path string, near int) int {
+	found := -1
+	for i, item := range items {
+		if item.Path != path {
+			continue
+		}
+		if found == -1 || absInt(i-near) < absInt(found-near) {
+			found = i
+		}
+	}
+	return found
+}
+
+func absInt(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+func describeChange(change PlaylistChange) string {
+	if change.By == "" {
+		return "the " + change.Action
+	}
+	return change.By + "'s " + change.Action
+}
+
+func (s *Server) handlePlaylistUndo(session fnet.Session) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	change, err := room.Player.Undo()
+	if s.checkError(session, err, EvtPlaylistUndo) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s undid %s", name, describeChange(change)), true)
+	room.broadcastPlaylistStatus()
+}
+
+func (s *Server) handlePlaylistRedo(session fnet.Session) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	change, err := room.Player.Redo()
+	if s.checkError(session, err, EvtPlaylistRedo) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s redid %s", name, describeChange(change)), true)
+	room.broadcastPlaylistStatus()
+}
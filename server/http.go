@@ -0,0 +1,36 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+func (s *Server) AddHTTPHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/artwork", s.handleArtworkHTTP)
+	mux.HandleFunc("/schedule.ics", s.handleScheduleICalHTTP)
+	mux.HandleFunc("/xmltv.xml", s.handleXMLTVHTTP)
+}
+
+func (s *Server) serveHTTP(server *http.Server, listener net.Listener) {
+	log.Println("HTTP listening on", listener.Addr())
+	err := server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		log.Println("HTTP server stopped:", err)
+	}
+}
+
+// httpRoom returns the room in the room query parameter, the main room if there's none
+// responds with a 404 and returns nil if it doesnt exist
+func (s *Server) httpRoom(w http.ResponseWriter, r *http.Request) *Room {
+	name := r.URL.Query().Get("room")
+	if name == "" {
+		name = MainRoom
+	}
+
+	room := s.getRoom(name)
+	if room == nil {
+		http.Error(w, ErrRoomNotFound.Error(), http.StatusNotFound)
+	}
+	return room
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const icalTimeFormat = "20060102T150405"
+
+// Schedules without anything known to play are assumed to last this long in the calendar
+const defaultEventDuration = 2 * time.Hour
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeICalLine writes a content line folded at 75 octets as rfc 5545 wants, the space starting a
+// continuation counts so those only get 74 of the line
+func writeICalLine(b *strings.Builder, line string) {
+	max := 75
+	for len(line) > max {
+		// Dont split utf8 sequences
+		cut := max
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		max = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// icalLocalTime is a wall clock time in the zone of a VTIMEZONE, so repeats keep it across daylight saving
+func icalLocalTime(name, tzid string, t time.Time) string {
+	return name + ";TZID=" + tzid + ":" + t.Format(icalTimeFormat)
+}
+
+// icalTZID is the name the time zone goes by in the calendar, time.Local is just "Local" so it gets the
+// system's zone name if we can find it
+func icalTZID(loc *time.Location) string {
+	name := loc.String()
+	if name != "Local" {
+		return name
+	}
+
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" && !filepath.IsAbs(tz) {
+		return tz
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if i := strings.Index(target, "zoneinfo/"); i != -1 {
+			return target[i+len("zoneinfo/"):]
+		}
+	}
+	return "fluffywatch-local"
+}
+
+// zoneTransition is a change of utc offset in a time zone
+type zoneTransition struct {
+	at         time.Time
+	offsetFrom int
+	offsetTo   int
+	name       string // Of the zone after
+	dst        bool   // If it's daylight saving after
+}
+
+// zoneTransitions returns the offset changes in loc between from and to
+func zoneTransitions(loc *time.Location, from, to time.Time) []zoneTransition {
+	transitions := make([]zoneTransition, 0)
+	_, offset := from.In(loc).Zone()
+	for t := from; t.Before(to); t = t.Add(24 * time.Hour) {
+		next := t.Add(24 * time.Hour)
+		if _, nextOffset := next.In(loc).Zone(); nextOffset == offset {
+			continue
+		}
+
+		// Narrow it down to the second
+		lo, hi := t, next
+		for hi.Sub(lo) > time.Second {
+			mid := lo.Add(hi.Sub(lo) / 2)
+			if _, o := mid.In(loc).Zone(); o == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+
+		after := hi.In(loc)
+		name, nextOffset := after.Zone()
+		transitions = append(transitions, zoneTransition{
+			at:         hi,
+			offsetFrom: offset,
+			offsetTo:   nextOffset,
+			name:       name,
+			dst:        after.IsDST(),
+		})
+		offset = nextOffset
+	}
+	return transitions
+}
+
+// local is when the transition happens on the clock from before it, which is what a VTIMEZONE DTSTART is in
+func (z zoneTransition) local() time.Time {
+	return z.at.In(time.FixedZone("", z.offsetFrom))
+}
+
+// yearlyRule returns the RRULE that gives this transition every year, like the second sunday of march.
+// "last" picks the last weekday of the month instead of counting from the start
+func (z zoneTransition) yearlyRule(last bool) string {
+	t := z.local()
+	n := (t.Day()-1)/7 + 1
+	if last {
+		if t.AddDate(0, 0, 7).Month() == t.Month() {
+			return ""
+		}
+		n = -1
+	}
+	return fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%d%s", t.Month(), n, strings.ToUpper(t.Weekday().String()[:2]))
+}
+
+// sameRule returns the yearly rule all the transitions follow, they need to be a year apart at the
+// same time of day. Empty if there isn't one
+func sameRule(transitions []zoneTransition) string {
+	if len(transitions) < 2 {
+		return ""
+	}
+	for i := 1; i < len(transitions); i++ {
+		prev, cur := transitions[i-1].local(), transitions[i].local()
+		if cur.Year() != prev.Year()+1 || cur.Format("150405") != prev.Format("150405") {
+			return ""
+		}
+	}
+
+	for _, last := range []bool{false, true} {
+		rule := transitions[0].yearlyRule(last)
+		for _, z := range transitions[1:] {
+			if z.yearlyRule(last) != rule {
+				rule = ""
+				break
+			}
+		}
+		if rule != "" {
+			return rule
+		}
+	}
+	return ""
+}
+
+func icalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	s := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+	if offset%60 != 0 {
+		s += fmt.Sprintf("%02d", offset%60)
+	}
+	return s
+}
+
+func writeZoneObservance(b *strings.Builder, z zoneTransition, rule string) {
+	kind := "STANDARD"
+	if z.dst {
+		kind = "DAYLIGHT"
+	}
+	writeICalLine(b, "BEGIN:"+kind)
+	writeICalLine(b, "DTSTART:"+z.local().Format(icalTimeFormat))
+	if rule != "" {
+		writeICalLine(b, "RRULE:"+rule)
+	}
+	writeICalLine(b, "TZOFFSETFROM:"+icalOffset(z.offsetFrom))
+	writeICalLine(b, "TZOFFSETTO:"+icalOffset(z.offsetTo))
+	writeICalLine(b, "TZNAME:"+icalEscaper.Replace(z.name))
+	writeICalLine(b, "END:"+kind)
+}
+
+// Years of offset changes looked at for the VTIMEZONE, the rules found in them are repeated after
+const icalZoneYears = 5
+
+// writeVTimezone writes loc as a VTIMEZONE, good from the start of the year before from. Offset changes
+// that happen every year by the same rule are written as one with an RRULE, so they keep going after the
+// years that were looked at
+func writeVTimezone(b *strings.Builder, tzid string, loc *time.Location, from time.Time) {
+	start := time.Date(from.In(loc).Year()-1, 1, 1, 0, 0, 0, 0, loc)
+	transitions := zoneTransitions(loc, start, start.AddDate(icalZoneYears, 0, 0))
+
+	writeICalLine(b, "BEGIN:VTIMEZONE")
+	writeICalLine(b, "TZID:"+tzid)
+
+	if len(transitions) == 0 {
+		name, offset := start.Zone()
+		writeZoneObservance(b, zoneTransition{at: start, offsetFrom: offset, offsetTo: offset, name: name}, "")
+		writeICalLine(b, "END:VTIMEZONE")
+		return
+	}
+
+	// Group the changes by what they change to, like all the switches to summer time, then write the
+	// last run of them that follows one rule as a repeating one and the rest as they are
+	type zoneKey struct {
+		offsetFrom, offsetTo int
+		name                 string
+		dst                  bool
+	}
+	groups := make(map[zoneKey][]zoneTransition)
+	keys := make([]zoneKey, 0)
+	for _, z := range transitions {
+		key := zoneKey{z.offsetFrom, z.offsetTo, z.name, z.dst}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], z)
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		run := len(group) - 1
+		for run > 0 && sameRule(group[run-1:]) != "" {
+			run--
+		}
+		for _, z := range group[:run] {
+			writeZoneObservance(b, z, "")
+		}
+		writeZoneObservance(b, group[run], sameRule(group[run:]))
+	}
+	writeICalLine(b, "END:VTIMEZONE")
+}
+
+// ScheduleICal returns the schedules of the room as an iCalendar document
+func (s *Server) ScheduleICal(room string, schedules []Schedule, host string) string {
+	var b strings.Builder
+	writeICalLine(&b, "BEGIN:VCALENDAR")
+	writeICalLine(&b, "VERSION:2.0")
+	writeICalLine(&b, "PRODID:-//fluffywatch//schedule//EN")
+	writeICalLine(&b, "CALSCALE:GREGORIAN")
+	calName := "fluffywatch"
+	if room != MainRoom {
+		calName += " " + room
+	}
+	writeICalLine(&b, "X-WR-CALNAME:"+icalEscaper.Replace(calName))
+
+	now := time.Now()
+	stamp := now.UTC().Format(icalTimeFormat) + "Z"
+
+	// Times are written in the schedule time zone so repeats stay at the same time of day over daylight
+	// saving changes, like the schedules themselves do
+	loc := s.scheduleLocation()
+	tzid := icalTZID(loc)
+	first := now
+	for _, sched := range schedules {
+		if sched.At.Before(first) {
+			first = sched.At
+		}
+	}
+	writeVTimezone(&b, tzid, loc, first)
+
+	for _, sched := range schedules {
+		duration := 0
+		for _, item := range sched.Items {
+			duration += item.Duration
+		}
+		length := time.Duration(duration) * time.Millisecond
+		if length <= 0 {
+			length = defaultEventDuration
+		}
+
+		description := ""
+		if len(sched.Items) > 0 {
+			titles := make([]string, 0, len(sched.Items))
+			for _, item := range sched.Items {
+				titles = append(titles, item.Title)
+			}
+			description = strings.Join(titles, "\n")
+		}
+
+		at := sched.At.In(loc)
+		writeICalLine(&b, "BEGIN:VEVENT")
+		writeICalLine(&b, fmt.Sprintf("UID:schedule-%s-%d@%s", room, sched.ID, host))
+		writeICalLine(&b, "DTSTAMP:"+stamp)
+		writeICalLine(&b, icalLocalTime("DTSTART", tzid, at))
+		writeICalLine(&b, icalLocalTime("DTEND", tzid, at.Add(length)))
+		switch sched.Repeat {
+		case ScheduleDaily:
+			writeICalLine(&b, "RRULE:FREQ=DAILY")
+		case ScheduleWeekly:
+			writeICalLine(&b, "RRULE:FREQ=WEEKLY")
+		}
+		writeICalLine(&b, "SUMMARY:"+icalEscaper.Replace(sched.Title))
+		if description != "" {
+			writeICalLine(&b, "DESCRIPTION:"+icalEscaper.Replace(description))
+		}
+		writeICalLine(&b, "END:VEVENT")
+	}
+
+	writeICalLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// Serves the schedules as a calendar people can subscribe to
+func (s *Server) handleScheduleICalHTTP(w http.ResponseWriter, r *http.Request) {
+	room := s.httpRoom(w, r)
+	if room == nil {
+		return
+	}
+
+	host := r.Host
+	if host == "" {
+		host = "fluffywatch"
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="fluffywatch.ics"`)
+	w.Write([]byte(s.ScheduleICal(room.Name, room.Scheduler.List(), host)))
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestVTimezone(t *testing.T) {
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		zone string
+		want []string
+	}{
+		{"Europe/Oslo", []string{
+			"TZID:Europe/Oslo",
+			"BEGIN:DAYLIGHT\r\nDTSTART:20250330T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\nTZNAME:CEST\r\nEND:DAYLIGHT",
+			"BEGIN:STANDARD\r\nDTSTART:20251026T030000\r\nRRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\nTZNAME:CET\r\nEND:STANDARD",
+		}},
+		{"America/New_York", []string{
+			"RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=2SU\r\nTZOFFSETFROM:-0500\r\nTZOFFSETTO:-0400",
+			"RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=1SU\r\nTZOFFSETFROM:-0400\r\nTZOFFSETTO:-0500",
+		}},
+		{"Asia/Tokyo", []string{
+			"BEGIN:STANDARD\r\nDTSTART:20250101T000000\r\nTZOFFSETFROM:+0900\r\nTZOFFSETTO:+0900\r\nTZNAME:JST\r\nEND:STANDARD",
+		}},
+	}
+
+	for _, c := range cases {
+		loc, err := time.LoadLocation(c.zone)
+		if err != nil {
+			t.Skip("no tz database:", err)
+		}
+
+		var b strings.Builder
+		writeVTimezone(&b, c.zone, loc, from)
+		tz := b.String()
+		for _, want := range c.want {
+			if !strings.Contains(tz, want) {
+				t.Errorf("%s: missing\n%s\nin\n%s", c.zone, want, tz)
+			}
+		}
+		if n := strings.Count(tz, "BEGIN:STANDARD") + strings.Count(tz, "BEGIN:DAYLIGHT"); n > 2 {
+			t.Errorf("%s: got %d observances, the yearly changes should be one each", c.zone, n)
+		}
+	}
+}
+
+func TestICalTZID(t *testing.T) {
+	if tzid := icalTZID(time.Local); tzid == "" || tzid == "Local" {
+		t.Errorf("local zone got tzid %q", tzid)
+	}
+	if tzid := icalTZID(time.UTC); tzid != "UTC" {
+		t.Errorf("utc got tzid %q", tzid)
+	}
+}
+
+func TestScheduleICal(t *testing.T) {
+	s := &Server{config: &Config{TimeZone: "Europe/Oslo"}}
+	loc := s.scheduleLocation()
+	if loc.String() != "Europe/Oslo" {
+		t.Skip("no tz database")
+	}
+
+	at := time.Date(2026, 3, 20, 21, 30, 0, 0, loc)
+	schedules := []Schedule{
+		{ID: 1, Title: "Movie night, again", At: at, Repeat: ScheduleWeekly},
+		{ID: 2, Title: "Once", At: at.AddDate(0, 0, 1), Items: []PlaylistItem{{Title: "A", Duration: 90 * 60 * 1000}}},
+	}
+
+	cal := s.ScheduleICal(MainRoom, schedules, "example.com")
+	if strings.Count(cal, "BEGIN:VTIMEZONE") != 1 || !strings.Contains(cal, "TZID:Europe/Oslo\r\n") {
+		t.Error("missing the time zone")
+	}
+	if !strings.Contains(cal, `SUMMARY:Movie night\, again`) {
+		t.Error("summary isn't escaped")
+	}
+	if n := strings.Count(cal, "BEGIN:VEVENT"); n != 2 {
+		t.Errorf("got %d events, want 2", n)
+	}
+
+	// Daylight saving starts in between, the repeat has to stay at 21:30 local rather than in utc
+	weekly := "UID:schedule-" + MainRoom + "-1@example.com\r\nDTSTAMP:"
+	if !strings.Contains(cal, weekly) {
+		t.Error("missing the weekly event")
+	}
+	for _, want := range []string{
+		"DTSTART;TZID=Europe/Oslo:20260320T213000\r\nDTEND;TZID=Europe/Oslo:20260320T233000\r\nRRULE:FREQ=WEEKLY\r\n",
+		"DTSTART;TZID=Europe/Oslo:20260321T213000\r\nDTEND;TZID=Europe/Oslo:20260321T230000\r\nSUMMARY:Once",
+	} {
+		if !strings.Contains(cal, want) {
+			t.Errorf("missing\n%s\nin\n%s", want, cal)
+		}
+	}
+}
+
+func TestWriteICalLineFolding(t *testing.T) {
+	var b strings.Builder
+	writeICalLine(&b, "DESCRIPTION:"+strings.Repeat("a", 200)+strings.Repeat("æ", 100))
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+	if len(lines) < 3 {
+		t.Fatalf("got %d lines, want it folded", len(lines))
+	}
+	unfolded := lines[0]
+	for i, line := range lines {
+		if len(line) > 75 {
+			t.Errorf("line %d is %d octets", i, len(line))
+		}
+		if i == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			t.Errorf("continuation %d doesn't start with a space", i)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("line %d splits a utf8 sequence", i)
+		}
+		unfolded += line[1:]
+	}
+	if len(lines[1]) != 75 {
+		t.Errorf("first continuation is %d octets, want 75 with the space", len(lines[1]))
+	}
+	if unfolded != "DESCRIPTION:"+strings.Repeat("a", 200)+strings.Repeat("æ", 100) {
+		t.Error("unfolding doesn't give back the line")
+	}
+}
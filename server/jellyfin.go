@@ -0,0 +1,380 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Works for emby too, they share the api
+type JellyfinConfig struct {
+	URL                string            `json:"url"` // Empty disables jellyfin
+	APIKey             string            `json:"apiKey"`
+	UserID             string            `json:"userId"`
+	InsecureSkipVerify bool              `json:"insecureSkipVerify"`
+	PathPrefixes       map[string]string `json:"pathPrefixes"` // Maps server path prefixes to local ones
+}
+
+var ErrJellyfinDisabled = errors.New("Jellyfin is not configured")
+
+type jellyfinClient struct {
+	config JellyfinConfig
+	http   *http.Client
+}
+
+func (s *Server) newJellyfinClient() (*jellyfinClient, error) {
+	s.configLock.RLock()
+	jc := s.config.Jellyfin
+	s.configLock.RUnlock()
+
+	if jc.URL == "" {
+		return nil, ErrJellyfinDisabled
+	}
+	if jc.UserID == "" {
+		return nil, errors.New("Jellyfin user id is not configured")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if jc.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	return &jellyfinClient{
+		config: jc,
+		http: &http.Client{
+			Transport: transport,
+			Timeout:   time.Second * 30,
+		},
+	}, nil
+}
+
+type jellyfinItem struct {
+	Id                string `json:"Id"`
+	Name              string `json:"Name"`
+	Type              string `json:"Type"` // Movie, Series, Season, Episode, CollectionFolder, Folder...
+	SeriesId          string `json:"SeriesId"`
+	SeriesName        string `json:"SeriesName"`
+	IndexNumber       int    `json:"IndexNumber"`
+	ParentIndexNumber int    `json:"ParentIndexNumber"`
+	ProductionYear    int    `json:"ProductionYear"`
+	RunTimeTicks      int64  `json:"RunTimeTicks"` // 100ns units
+	Path              string `json:"Path"`
+	IsFolder          bool   `json:"IsFolder"`
+}
+
+type jellyfinItems struct {
+	Items            []jellyfinItem `json:"Items"`
+	TotalRecordCount int            `json:"TotalRecordCount"`
+}
+
+func (c *jellyfinClient) get(path string, query url.Values, out interface{}) error {
+	u := strings.TrimSuffix(c.config.URL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Emby-Token", c.config.APIKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Jellyfin responded with %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *jellyfinClient) userPath(sub string) string {
+	return "/Users/" + url.PathEscape(c.config.UserID) + sub
+}
+
+// Items queries the users items
+func (c *jellyfinClient) Items(query url.Values) ([]jellyfinItem, error) {
+	query.Set("Fields", "Path,ProductionYear")
+	var result jellyfinItems
+	err := c.get(c.userPath("/Items"), query, &result)
+	return result.Items, err
+}
+
+func (c *jellyfinClient) Item(id string) (jellyfinItem, error) {
+	var item jellyfinItem
+	err := c.get(c.userPath("/Items/"+url.PathEscape(id)), nil, &item)
+	return item, err
+}
+
+// Views returns the users top level libraries
+func (c *jellyfinClient) Views() ([]jellyfinItem, error) {
+	var result jellyfinItems
+	err := c.get(c.userPath("/Views"), nil, &result)
+	return result.Items, err
+}
+
+// Episodes returns all episodes of a series sorted by season and episode
+func (c *jellyfinClient) Episodes(seriesId string) ([]jellyfinItem, error) {
+	query := url.Values{}
+	query.Set("UserId", c.config.UserID)
+	query.Set("Fields", "Path")
+
+	var result jellyfinItems
+	err := c.get("/Shows/"+url.PathEscape(seriesId)+"/Episodes", query, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(result.Items, func(i, j int) bool {
+		a, b := result.Items[i], result.Items[j]
+		if a.ParentIndexNumber != b.ParentIndexNumber {
+			return a.ParentIndexNumber < b.ParentIndexNumber
+		}
+		return a.IndexNumber < b.IndexNumber
+	})
+	return result.Items, nil
+}
+
+// localPath maps a path on the jellyfin server to a local one using the configured prefixes
+// The longest matching prefix wins
+func (c *jellyfinClient) localPath(path string) string {
+	best := ""
+	for prefix := range c.config.PathPrefixes {
+		if pathHasPrefix(path, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return path
+	}
+	return c.config.PathPrefixes[best] + strings.TrimPrefix(path, best)
+}
+
+// pathHasPrefix returns true if path is prefix or inside it, so /data/mov doesn't match /data/movies.
+// Either slash works since the jellyfin server can be on windows
+func pathHasPrefix(path, prefix string) bool {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || strings.HasSuffix(prefix, "\\") {
+		return true
+	}
+	next := path[len(prefix)]
+	return next == '/' || next == '\\'
+}
+
+// jellyfinSource searches and resolves through a jellyfin or emby server
+// Ids are "movie:<id>", "series:<id>", "episode:<seriesId>:<id>" and "folder:<id>"
+type jellyfinSource struct {
+	client *jellyfinClient
+}
+
+func (s *jellyfinSource) ID() string { return SourceJellyfin }
+
+func (s *jellyfinSource) Search(query SearchQuery) ([]MediaItem, error) {
+	q := url.Values{}
+	q.Set("Recursive", "true")
+	q.Set("Limit", strconv.Itoa(MaxSearchResults))
+
+	term := query.Title
+	if term == "" {
+		term = query.Show
+	}
+	if term != "" {
+		q.Set("SearchTerm", term)
+	}
+	if query.Year != 0 {
+		q.Set("Years", strconv.Itoa(query.Year))
+	}
+
+	switch query.Kind {
+	case "tv":
+		q.Set("IncludeItemTypes", "Series")
+	case "movie":
+		q.Set("IncludeItemTypes", "Movie")
+	default:
+		q.Set("IncludeItemTypes", "Movie,Series")
+	}
+
+	results, err := s.client.Items(q)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]MediaItem, 0, len(results))
+	for _, r := range results {
+		items = append(items, s.mediaItem(r))
+	}
+	return items, nil
+}
+
+func (s *jellyfinSource) Browse(id string) ([]MediaItem, error) {
+	var results []jellyfinItem
+	var err error
+
+	kind, key := splitSourceID(id)
+	switch {
+	case id == "":
+		results, err = s.client.Views()
+	case kind == "series":
+		results, err = s.client.Episodes(key)
+	case kind == "folder":
+		q := url.Values{}
+		q.Set("ParentId", key)
+		q.Set("SortBy", "SortName")
+		results, err = s.client.Items(q)
+	default:
+		return nil, errors.New("Only series and folders can be browsed")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]MediaItem, 0, len(results))
+	for _, r := range results {
+		items = append(items, s.mediaItem(r))
+	}
+	return items, nil
+}
+
+func (s *jellyfinSource) Resolve(id string, options ResolveOptions) ([]PlaylistItem, error) {
+	kind, key := splitSourceID(id)
+
+	var results []jellyfinItem
+	switch kind {
+	case "movie":
+		item, err := s.client.Item(key)
+		if err != nil {
+			return nil, err
+		}
+		results = []jellyfinItem{item}
+	case "series":
+		var err error
+		results, err = s.client.Episodes(key)
+		if err != nil {
+			return nil, err
+		}
+	case "episode":
+		split := strings.SplitN(key, ":", 2)
+		if len(split) != 2 {
+			return nil, errors.New("Invalid episode id")
+		}
+		episodes, err := s.client.Episodes(split[0])
+		if err != nil {
+			return nil, err
+		}
+		results = selectJellyfinEpisodes(episodes, split[1], options)
+		if len(results) < 1 {
+			return nil, errors.New("Episode not found")
+		}
+	case "folder":
+		q := url.Values{}
+		q.Set("ParentId", key)
+		q.Set("Recursive", "true")
+		q.Set("IncludeItemTypes", "Movie,Episode")
+		q.Set("SortBy", "SeriesSortName,ParentIndexNumber,IndexNumber,SortName")
+		var err error
+		results, err = s.client.Items(q)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Invalid jellyfin id")
+	}
+
+	items := make([]PlaylistItem, 0, len(results))
+	for _, r := range results {
+		if r.Path == "" {
+			log.Println("Skipping jellyfin item without a path:", r.Name)
+			continue
+		}
+		items = append(items, s.playlistItem(r))
+	}
+	return items, nil
+}
+
+func selectJellyfinEpisodes(episodes []jellyfinItem, id string, options ResolveOptions) []jellyfinItem {
+	var selected *jellyfinItem
+	for i := range episodes {
+		if episodes[i].Id == id {
+			selected = &episodes[i]
+			break
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+
+	results := make([]jellyfinItem, 0)
+	for _, ep := range episodes {
+		switch {
+		case ep.Id == selected.Id:
+		case options.WholeSeason && ep.ParentIndexNumber == selected.ParentIndexNumber:
+		case options.AddAllAfter && (ep.ParentIndexNumber > selected.ParentIndexNumber ||
+			(ep.ParentIndexNumber == selected.ParentIndexNumber && ep.IndexNumber > selected.IndexNumber)):
+		default:
+			continue
+		}
+		results = append(results, ep)
+	}
+	return results
+}
+
+func (s *jellyfinSource) mediaItem(r jellyfinItem) MediaItem {
+	item := MediaItem{
+		Source:   SourceJellyfin,
+		Title:    r.Name,
+		Year:     r.ProductionYear,
+		Duration: int(r.RunTimeTicks / 10000),
+	}
+
+	switch r.Type {
+	case "Movie":
+		item.Kind = MediaKindMovie
+		item.ID = "movie:" + r.Id
+	case "Series":
+		item.Kind = MediaKindShow
+		item.ID = "series:" + r.Id
+	case "Episode":
+		item.Kind = MediaKindEpisode
+		item.ID = "episode:" + r.SeriesId + ":" + r.Id
+		item.ShowTitle = r.SeriesName
+		item.Season = r.ParentIndexNumber
+		item.Episode = r.IndexNumber
+	default:
+		item.Kind = MediaKindFolder
+		item.ID = "folder:" + r.Id
+	}
+	return item
+}
+
+func (s *jellyfinSource) playlistItem(r jellyfinItem) PlaylistItem {
+	item := PlaylistItem{
+		Kind:     ITEMTYPEMOVIE,
+		Path:     s.client.localPath(r.Path),
+		Duration: int(r.RunTimeTicks / 10000),
+		Title:    r.Name,
+	}
+	if r.Type == "Episode" {
+		item.Kind = ITEMTYPETV
+		item.ShowTitle = r.SeriesName
+		item.Season = r.ParentIndexNumber
+		item.Episode = r.IndexNumber
+	}
+	return item
+}
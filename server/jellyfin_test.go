@@ -0,0 +1,236 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jogramming/fluffywatch/jellyfinfake"
+)
+
+func newJellyfinTestSource(t *testing.T) (*jellyfinSource, *jellyfinfake.Server) {
+	fake := jellyfinfake.New("key", "user")
+	fake.AddItem(jellyfinfake.Item{Id: "movies", Name: "Movies", Type: "CollectionFolder"})
+	fake.AddItem(jellyfinfake.Item{Id: "shows", Name: "Shows", Type: "CollectionFolder"})
+	fake.AddItem(jellyfinfake.Item{Id: "m1", Name: "Some Movie", Type: "Movie", ParentId: "movies", ProductionYear: 2001,
+		RunTimeTicks: 50000000, Path: "/data/movies/Some Movie.mkv"})
+	fake.AddItem(jellyfinfake.Item{Id: "m2", Name: "Other Movie", Type: "Movie", ParentId: "movies", ProductionYear: 1999,
+		Path: "/data/movies/special/Other Movie.mkv"})
+	fake.AddItem(jellyfinfake.Item{Id: "m3", Name: "No Path Movie", Type: "Movie", ParentId: "movies"})
+	fake.AddItem(jellyfinfake.Item{Id: "s", Name: "Some Show", Type: "Series", ParentId: "shows", ProductionYear: 2010})
+	for _, ep := range []struct {
+		id              string
+		season, episode int
+	}{{"e13", 1, 3}, {"e11", 1, 1}, {"e12", 1, 2}, {"e21", 2, 1}, {"e22", 2, 2}} {
+		fake.AddItem(jellyfinfake.Item{Id: ep.id, Name: strings.ToUpper(ep.id), Type: "Episode", ParentId: "s",
+			SeriesId: "s", SeriesName: "Some Show", ParentIndexNumber: ep.season, IndexNumber: ep.episode,
+			Path: "/data/shows/" + ep.id + ".mkv"})
+	}
+
+	ts := fake.Start()
+	t.Cleanup(ts.Close)
+
+	s := &Server{config: &Config{Jellyfin: JellyfinConfig{
+		URL:    ts.URL,
+		APIKey: "key",
+		UserID: "user",
+		PathPrefixes: map[string]string{
+			"/data/":                "/mnt/nas/",
+			"/data/movies/special/": "/mnt/special/",
+		},
+	}}}
+	src, err := s.GetMediaSource(SourceJellyfin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src.(*jellyfinSource), fake
+}
+
+func mediaItemIDs(items []MediaItem) string {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func playlistPaths(items []PlaylistItem) string {
+	paths := make([]string, len(items))
+	for i, item := range items {
+		paths[i] = item.Path
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestJellyfinSearch(t *testing.T) {
+	src, _ := newJellyfinTestSource(t)
+
+	cases := []struct {
+		query SearchQuery
+		want  string
+	}{
+		{SearchQuery{Title: "some"}, "movie:m1,series:s"},
+		{SearchQuery{Title: "some", Kind: "tv"}, "series:s"},
+		{SearchQuery{Title: "movie", Kind: "movie"}, "movie:m1,movie:m2,movie:m3"},
+		{SearchQuery{Title: "movie", Year: 1999}, "movie:m2"},
+		{SearchQuery{Show: "show"}, "series:s"},
+	}
+	for _, c := range cases {
+		items, err := src.Search(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mediaItemIDs(items); got != c.want {
+			t.Errorf("Search(%+v) = %s, want %s", c.query, got, c.want)
+		}
+	}
+
+	items, _ := src.Search(SearchQuery{Title: "some movie"})
+	if len(items) != 1 || items[0].Kind != MediaKindMovie || items[0].Year != 2001 || items[0].Duration != 5000 {
+		t.Errorf("movie = %+v", items)
+	}
+
+	src.client.config.APIKey = "wrong"
+	if _, err := src.Search(SearchQuery{Title: "some"}); err == nil {
+		t.Error("a wrong api key should fail")
+	}
+}
+
+func TestJellyfinBrowse(t *testing.T) {
+	src, _ := newJellyfinTestSource(t)
+
+	cases := map[string]string{
+		"":             "folder:movies,folder:shows",
+		"folder:shows": "series:s",
+		"series:s":     "episode:s:e11,episode:s:e12,episode:s:e13,episode:s:e21,episode:s:e22",
+	}
+	for id, want := range cases {
+		items, err := src.Browse(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mediaItemIDs(items); got != want {
+			t.Errorf("Browse(%q) = %s, want %s", id, got, want)
+		}
+	}
+
+	// The fake doesn't sort by name, only check what's in there
+	movies, err := src.Browse("folder:movies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 3 {
+		t.Errorf("movies folder has %s", mediaItemIDs(movies))
+	}
+
+	if _, err = src.Browse("movie:m1"); err == nil {
+		t.Error("movies can't be browsed")
+	}
+}
+
+func TestJellyfinResolve(t *testing.T) {
+	src, _ := newJellyfinTestSource(t)
+
+	cases := []struct {
+		id      string
+		options ResolveOptions
+		want    string
+	}{
+		{"movie:m1", ResolveOptions{}, "/mnt/nas/movies/Some Movie.mkv"},
+		// The longer prefix wins
+		{"movie:m2", ResolveOptions{}, "/mnt/special/Other Movie.mkv"},
+		// Can't play anything without a path
+		{"movie:m3", ResolveOptions{}, ""},
+		{"episode:s:e12", ResolveOptions{}, "/mnt/nas/shows/e12.mkv"},
+		{"episode:s:e12", ResolveOptions{AddAllAfter: true}, "/mnt/nas/shows/e12.mkv,/mnt/nas/shows/e13.mkv,/mnt/nas/shows/e21.mkv,/mnt/nas/shows/e22.mkv"},
+		{"episode:s:e21", ResolveOptions{WholeSeason: true}, "/mnt/nas/shows/e21.mkv,/mnt/nas/shows/e22.mkv"},
+		{"series:s", ResolveOptions{}, "/mnt/nas/shows/e11.mkv,/mnt/nas/shows/e12.mkv,/mnt/nas/shows/e13.mkv,/mnt/nas/shows/e21.mkv,/mnt/nas/shows/e22.mkv"},
+	}
+	for _, c := range cases {
+		items, err := src.Resolve(c.id, c.options)
+		if err != nil {
+			t.Fatalf("Resolve(%q): %s", c.id, err)
+		}
+		if got := playlistPaths(items); got != c.want {
+			t.Errorf("Resolve(%q, %+v) = %s, want %s", c.id, c.options, got, c.want)
+		}
+	}
+
+	items, _ := src.Resolve("episode:s:e13", ResolveOptions{})
+	if len(items) != 1 || items[0].Kind != ITEMTYPETV || items[0].ShowTitle != "Some Show" || items[0].Season != 1 || items[0].Episode != 3 {
+		t.Errorf("episode = %+v", items)
+	}
+
+	folder, err := src.Resolve("folder:shows", ResolveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folder) != 5 {
+		t.Errorf("folder resolved to %d items, want the 5 episodes", len(folder))
+	}
+
+	for _, id := range []string{"nope", "episode:s", "episode:s:missing", "movie:missing"} {
+		if _, err = src.Resolve(id, ResolveOptions{}); err == nil {
+			t.Errorf("Resolve(%q) should fail", id)
+		}
+	}
+}
+
+func TestSelectJellyfinEpisodes(t *testing.T) {
+	episodes := []jellyfinItem{
+		{Id: "a", ParentIndexNumber: 1, IndexNumber: 1},
+		{Id: "b", ParentIndexNumber: 1, IndexNumber: 2},
+		{Id: "c", ParentIndexNumber: 2, IndexNumber: 1},
+		{Id: "d", ParentIndexNumber: 2, IndexNumber: 2},
+	}
+	ids := func(items []jellyfinItem) string {
+		out := make([]string, len(items))
+		for i, item := range items {
+			out[i] = item.Id
+		}
+		return strings.Join(out, "")
+	}
+
+	cases := []struct {
+		id      string
+		options ResolveOptions
+		want    string
+	}{
+		{"b", ResolveOptions{}, "b"},
+		{"b", ResolveOptions{AddAllAfter: true}, "bcd"},
+		{"b", ResolveOptions{WholeSeason: true}, "ab"},
+		{"c", ResolveOptions{AddAllAfter: true, WholeSeason: true}, "cd"},
+		{"x", ResolveOptions{AddAllAfter: true}, ""},
+	}
+	for _, c := range cases {
+		if got := ids(selectJellyfinEpisodes(episodes, c.id, c.options)); got != c.want {
+			t.Errorf("selectJellyfinEpisodes(%q, %+v) = %s, want %s", c.id, c.options, got, c.want)
+		}
+	}
+}
+
+func TestJellyfinLocalPath(t *testing.T) {
+	c := &jellyfinClient{config: JellyfinConfig{PathPrefixes: map[string]string{
+		"/data/":        "/mnt/nas/",
+		"/data/movies/": "/srv/movies/",
+		"/data/mov":     "/wrong",
+		"/tv":           "/mnt/tv",
+		`D:\Media`:      "/mnt/d",
+	}}}
+
+	cases := map[string]string{
+		"/data/movies/a.mkv":  "/srv/movies/a.mkv",
+		"/data/shows/b.mkv":   "/mnt/nas/shows/b.mkv",
+		"/data/movie.mkv":     "/mnt/nas/movie.mkv",
+		"/data/mov/c.mkv":     "/wrong/c.mkv",
+		"/other/c.mkv":        "/other/c.mkv",
+		"/tv":                 "/mnt/tv",
+		"/tv/show/e.mkv":      "/mnt/tv/show/e.mkv",
+		"/tvshows/e.mkv":      "/tvshows/e.mkv",
+		`D:\MediaOther\f.mkv`: `D:\MediaOther\f.mkv`,
+	}
+	for in, want := range cases {
+		if got := c.localPath(in); got != want {
+			t.Errorf("localPath(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
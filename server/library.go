@@ -0,0 +1,379 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLibraryScanInterval = 300 // seconds
+	MaxSearchResults           = 200
+)
+
+// LibraryEntry is a single indexed video file
+type LibraryEntry struct {
+	Path      string        `json:"path"`
+	Kind      int           `json:"kind"`
+	Title     string        `json:"title"`
+	ShowTitle string        `json:"showTitle"`
+	Season    int           `json:"season"`
+	Episode   int           `json:"episode"`
+	AirDate   string        `json:"airDate"`
+	Year      int           `json:"year"`
+	Plot      string        `json:"plot"`
+	Duration  int           `json:"duration"` // Duration in milliseconds
+	Size      int64         `json:"size"`
+	ModTime   int64         `json:"modTime"`
+	Streams   []ProbeStream `json:"streams"`
+
+	FFprobe    string `json:"ffprobe"`    // The ffprobe it was probed with
+	ProbeError string `json:"probeError"` // Set if probing failed, it's only tried again if the file or ffprobe changes
+}
+
+// entryPlaylistItem creates a playlist item from the entry, artwork is looked up again since it might have changed
+func (s *Server) entryPlaylistItem(e *LibraryEntry) PlaylistItem {
+	item := PlaylistItem{
+		Kind:      e.Kind,
+		Path:      e.Path,
+		Duration:  e.Duration,
+		Title:     e.Title,
+		ShowTitle: e.ShowTitle,
+		Season:    e.Season,
+		Episode:   e.Episode,
+		AirDate:   e.AirDate,
+		Year:      e.Year,
+		Plot:      e.Plot,
+	}
+	s.applyLocalMetadata(&item)
+	return item
+}
+
+type Library struct {
+	sync.RWMutex
+	IndexPath string
+	Entries   map[string]*LibraryEntry
+	LastScan  time.Time
+
+	server *Server
+	rescan chan struct{}
+}
+
+func NewLibrary(s *Server, indexPath string) *Library {
+	return &Library{
+		server:    s,
+		IndexPath: indexPath,
+		Entries:   make(map[string]*LibraryEntry),
+		rescan:    make(chan struct{}, 1),
+	}
+}
+
+// Rescan makes Run scan right away instead of waiting for the interval, like when the media roots change
+func (l *Library) Rescan() {
+	select {
+	case l.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// Run loads the index from disk, then keeps rescanning the media roots
+func (l *Library) Run() {
+	err := l.Load()
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed loading library index:", err)
+	}
+
+	for {
+		started := time.Now()
+		changed, err := l.Scan()
+		if err != nil {
+			log.Println("Failed scanning library:", err)
+		} else if changed > 0 {
+			log.Printf("Library scan done in %s, %d changes\n", time.Since(started), changed)
+			err = l.Save()
+			if err != nil {
+				log.Println("Failed saving library index:", err)
+			}
+		}
+
+		select {
+		case <-time.After(l.server.libraryScanInterval()):
+		case <-l.rescan:
+		case <-l.server.quit:
+			return
+		}
+	}
+}
+
+func (s *Server) libraryScanInterval() time.Duration {
+	s.configLock.RLock()
+	interval := s.config.LibraryScanInterval
+	s.configLock.RUnlock()
+
+	if interval < 1 {
+		interval = DefaultLibraryScanInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+func (l *Library) Load() error {
+	data, err := ioutil.ReadFile(l.IndexPath)
+	if err != nil {
+		return err
+	}
+
+	var entries []*LibraryEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	for _, e := range entries {
+		l.Entries[e.Path] = e
+	}
+	l.Unlock()
+
+	log.Printf("Loaded %d library entries\n", len(entries))
+	return nil
+}
+
+func (l *Library) Save() error {
+	l.RLock()
+	entries := make([]*LibraryEntry, 0, len(l.Entries))
+	for _, e := range l.Entries {
+		entries = append(entries, e)
+	}
+	l.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	marshalled, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(l.IndexPath), 0775)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a crash doesnt leave a broken index behind
+	tmpPath := l.IndexPath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, marshalled, 0664)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.IndexPath)
+}
+
+// Scan walks the media roots, probing new and changed files and dropping removed ones
+// Returns the number of added, changed and removed entries
+func (l *Library) Scan() (int, error) {
+	roots, failedRoots := l.server.resolveMediaRoots()
+	if len(roots) < 1 && len(failedRoots) < 1 {
+		return 0, ErrNoMediaRoots
+	}
+
+	_, ffprobe := l.server.ffmpegPaths()
+
+	seen := make(map[string]bool)
+	changed := 0
+	// Folders that couldn't be read, whatever was in them is kept instead of removed.
+	// A missing root is most likely an unmounted share that's back later, no point probing it all again
+	unreadable := failedRoots
+
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Unreadable folder, skip it but keep going
+				log.Println("Library scan:", err)
+				if info == nil || info.IsDir() {
+					unreadable = append(unreadable, path)
+				}
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if info.IsDir() || !IsVideoFile(path) {
+				return nil
+			}
+
+			seen[path] = true
+
+			l.RLock()
+			existing, ok := l.Entries[path]
+			l.RUnlock()
+			unchanged := ok && existing.Size == info.Size() && existing.ModTime == info.ModTime().Unix()
+			// A failed probe is tried again once ffprobe is fixed, entries from before ffprobe was
+			// recorded are probed once more to find out
+			if unchanged && existing.FFprobe != "" && (existing.ProbeError == "" || existing.FFprobe == ffprobe) {
+				return nil
+			}
+
+			entry := l.server.newLibraryEntry(path, info, ffprobe)
+			l.Lock()
+			l.Entries[path] = entry
+			l.Unlock()
+			changed++
+			return nil
+		})
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	l.Lock()
+	for path := range l.Entries {
+		if !seen[path] && !pathInRoots(path, unreadable) {
+			delete(l.Entries, path)
+			changed++
+		}
+	}
+	l.LastScan = time.Now()
+	l.Unlock()
+
+	return changed, nil
+}
+
+func (s *Server) newLibraryEntry(path string, info os.FileInfo, ffprobe string) *LibraryEntry {
+	item := s.newMediaItem(path)
+	entry := &LibraryEntry{
+		Path:      path,
+		Kind:      item.Kind,
+		Title:     item.Title,
+		ShowTitle: item.ShowTitle,
+		Season:    item.Season,
+		Episode:   item.Episode,
+		AirDate:   item.AirDate,
+		Year:      item.Year,
+		Plot:      item.Plot,
+		Size:      info.Size(),
+		ModTime:   info.ModTime().Unix(),
+		FFprobe:   ffprobe,
+	}
+
+	result, err := s.ProbeFile(path)
+	if err != nil {
+		log.Println("Library scan: failed probing", path, err)
+		entry.ProbeError = err.Error()
+	} else {
+		entry.Duration = result.Duration
+		entry.Streams = result.Streams
+	}
+
+	return entry
+}
+
+// Get returns a copy of the entry at path
+func (l *Library) Get(path string) (LibraryEntry, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	e, ok := l.Entries[path]
+	if !ok {
+		return LibraryEntry{}, false
+	}
+	return *e, true
+}
+
+// ShowEpisodes returns all episodes of a show sorted by season and episode
+func (l *Library) ShowEpisodes(show string) []LibraryEntry {
+	episodes := make([]LibraryEntry, 0)
+
+	l.RLock()
+	for _, e := range l.Entries {
+		if e.Kind == ITEMTYPETV && strings.EqualFold(e.ShowTitle, show) {
+			episodes = append(episodes, *e)
+		}
+	}
+	l.RUnlock()
+
+	sort.SliceStable(episodes, func(i, j int) bool {
+		a, b := episodes[i], episodes[j]
+		if a.Season != b.Season {
+			return a.Season < b.Season
+		}
+		if a.Episode != b.Episode {
+			return a.Episode < b.Episode
+		}
+		return a.AirDate < b.AirDate
+	})
+	return episodes
+}
+
+func (l *Library) Search(query SearchQuery) []LibraryEntry {
+	title := strings.ToLower(strings.TrimSpace(query.Title))
+	show := strings.ToLower(strings.TrimSpace(query.Show))
+
+	results := make([]LibraryEntry, 0)
+
+	l.RLock()
+	for _, e := range l.Entries {
+		switch query.Kind {
+		case "tv":
+			if e.Kind != ITEMTYPETV {
+				continue
+			}
+		case "movie":
+			if e.Kind != ITEMTYPEMOVIE {
+				continue
+			}
+		}
+
+		if query.Year != 0 && e.Year != query.Year {
+			continue
+		}
+
+		if show != "" && !strings.Contains(strings.ToLower(e.ShowTitle), show) {
+			continue
+		}
+
+		if title != "" && !strings.Contains(strings.ToLower(e.Title), title) && !strings.Contains(strings.ToLower(e.ShowTitle), title) {
+			continue
+		}
+
+		results = append(results, *e)
+	}
+	l.RUnlock()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.ShowTitle != b.ShowTitle {
+			return naturalLess(strings.ToLower(a.ShowTitle), strings.ToLower(b.ShowTitle))
+		}
+		if a.Season != b.Season {
+			return a.Season < b.Season
+		}
+		if a.Episode != b.Episode {
+			return a.Episode < b.Episode
+		}
+		if a.AirDate != b.AirDate {
+			return a.AirDate < b.AirDate
+		}
+		return naturalLess(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	})
+
+	if len(results) > MaxSearchResults {
+		results = results[:MaxSearchResults]
+	}
+	return results
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLibraryScanKeepsMissingRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluffywatch-library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	present := filepath.Join(dir, "present")
+	missing := filepath.Join(dir, "missing")
+	os.MkdirAll(present, 0775)
+	ioutil.WriteFile(filepath.Join(present, "a.mkv"), []byte("not really a video"), 0664)
+
+	s := &Server{config: &Config{
+		MediaRoots: []string{present, missing},
+		FFmpeg:     FFmpegConfig{FFprobePath: filepath.Join(dir, "no-ffprobe")},
+	}}
+	l := NewLibrary(s, filepath.Join(dir, "library.json"))
+	l.Entries[filepath.Join(missing, "b.mkv")] = &LibraryEntry{Path: filepath.Join(missing, "b.mkv"), Duration: 1000}
+	l.Entries[filepath.Join(present, "gone.mkv")] = &LibraryEntry{Path: filepath.Join(present, "gone.mkv"), Duration: 1000}
+
+	changed, err := l.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 2 {
+		t.Errorf("changed = %d, want 2 (a.mkv added, gone.mkv removed)", changed)
+	}
+	if _, ok := l.Entries[filepath.Join(missing, "b.mkv")]; !ok {
+		t.Error("entry under the missing root was removed")
+	}
+	if _, ok := l.Entries[filepath.Join(present, "gone.mkv")]; ok {
+		t.Error("removed file is still in the index")
+	}
+	a, ok := l.Entries[filepath.Join(present, "a.mkv")]
+	if !ok || a.Duration != 0 {
+		t.Fatalf("a.mkv = %+v, want it added without a duration", a)
+	}
+
+	if a.ProbeError == "" {
+		t.Error("failed probe wasn't recorded")
+	}
+
+	// Probing isn't tried again until ffprobe or the file changes
+	changed, err = l.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 0 {
+		t.Errorf("changed = %d on rescan, want 0", changed)
+	}
+}
+
+func TestLibraryScanRetriesFailedProbes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script for ffprobe")
+	}
+	dir, err := ioutil.TempDir("", "fluffywatch-library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	media := filepath.Join(dir, "media")
+	os.MkdirAll(media, 0775)
+	video := filepath.Join(media, "a.mkv")
+	ioutil.WriteFile(video, []byte("not really a video"), 0664)
+
+	// Fake ffprobes that count how often they're run and fail
+	calls := filepath.Join(dir, "calls")
+	ffprobe := func(name string) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte("#!/bin/sh\necho x >> "+calls+"\nexit 1\n"), 0775)
+		return path
+	}
+	probes := func() int {
+		b, _ := ioutil.ReadFile(calls)
+		return strings.Count(string(b), "x")
+	}
+
+	s := &Server{config: &Config{
+		MediaRoots: []string{media},
+		FFmpeg:     FFmpegConfig{FFprobePath: ffprobe("ffprobe1")},
+	}}
+	l := NewLibrary(s, filepath.Join(dir, "library.json"))
+
+	steps := []struct {
+		name       string
+		change     func()
+		wantProbes int
+	}{
+		{"first scan", func() {}, 1},
+		{"nothing changed", func() {}, 1},
+		{"ffprobe changed", func() { s.config.FFmpeg.FFprobePath = ffprobe("ffprobe2") }, 2},
+		{"nothing changed again", func() {}, 2},
+		{"file changed", func() {
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(video, later, later)
+		}, 3},
+		{"old entry without ffprobe", func() { l.Entries[video].FFprobe = "" }, 4},
+	}
+	for _, step := range steps {
+		step.change()
+		if _, err := l.Scan(); err != nil {
+			t.Fatal(err)
+		}
+		if got := probes(); got != step.wantProbes {
+			t.Errorf("%s: probed %d times, want %d", step.name, got, step.wantProbes)
+		}
+	}
+}
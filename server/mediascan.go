@@ -0,0 +1,249 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Max number of files added from a single directory
+const MaxDirItems = 5000
+
+var VideoExtensions = []string{".mkv", ".mp4", ".m4v", ".avi", ".mov", ".wmv", ".flv", ".webm", ".mpg", ".mpeg", ".ts", ".m2ts", ".ogv"}
+
+var (
+	// Not \b around the numbers, _ counts as part of a word there and Show_Name_S01E02 is common
+	// Show.Name.S01E02.Title, Show Name - s1e2e3
+	episodeSERegex = regexp.MustCompile(`(?i)^(.*?)(?:^|[\s._\-\[(]+)s(\d{1,2})[\s._-]*e(\d{1,3})(?:[\s._-]*e\d{1,3})*($|[^a-z0-9].*)$`)
+	// Show Name 1x02 Title
+	episodeXRegex = regexp.MustCompile(`(?i)^(.*?)(?:^|[\s._\-\[(]+)(\d{1,2})x(\d{2,3})($|[^a-z0-9].*)$`)
+	// Show.Name.2016.12.08.Title
+	episodeDateRegex = regexp.MustCompile(`^(.*?)(?:^|[\s._\-\[(]+)((?:19|20)\d{2})[\s._-](\d{2})[\s._-](\d{2})($|[^0-9A-Za-z].*)$`)
+	// Season folders, "Season 1", "S01"
+	seasonDirRegex = regexp.MustCompile(`(?i)^(season[\s._-]*\d+|s\d{1,2}|specials)$`)
+	// Some.Movie.2010.1080p, the last year is used so "Blade Runner 2049 (2017)" works
+	movieYearRegex = regexp.MustCompile(`^(.*)[\s._\-\[(]+((?:19|20)\d{2})(?:[\s._\-\])]|$)`)
+	// Release junk, everything from the first match is cut from episode titles
+	releaseJunkRegex = regexp.MustCompile(`(?i)[\s._\-\[(]+(480p|576p|720p|1080p|2160p|4k|hdtv|web[\s._-]?dl|webrip|bluray|brrip|bdrip|dvdrip|x264|x265|h\.?264|h\.?265|hevc|xvid|proper|repack)\b.*$`)
+)
+
+// EpisodeInfo is what could be parsed out of an episode filename
+type EpisodeInfo struct {
+	Show    string
+	Title   string
+	Season  int
+	Episode int
+	AirDate string // yyyy-mm-dd for date based shows
+}
+
+func IsVideoFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, v := range VideoExtensions {
+		if v == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEpisodeName parses names like "Show.Name.S01E02.Title.mkv", "Show Name 1x02" and "Show.2016.12.08"
+func ParseEpisodeName(name string) (info EpisodeInfo, ok bool) {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	var rest string
+	if m := episodeSERegex.FindStringSubmatch(name); m != nil {
+		info.Show = m[1]
+		info.Season, _ = strconv.Atoi(m[2])
+		info.Episode, _ = strconv.Atoi(m[3])
+		rest = m[4]
+	} else if m := episodeXRegex.FindStringSubmatch(name); m != nil {
+		info.Show = m[1]
+		info.Season, _ = strconv.Atoi(m[2])
+		info.Episode, _ = strconv.Atoi(m[3])
+		rest = m[4]
+	} else if m := episodeDateRegex.FindStringSubmatch(name); m != nil {
+		month, _ := strconv.Atoi(m[3])
+		day, _ := strconv.Atoi(m[4])
+		if month < 1 || month > 12 || day < 1 || day > 31 {
+			return info, false
+		}
+		info.Show = m[1]
+		info.AirDate = fmt.Sprintf("%s-%s-%s", m[2], m[3], m[4])
+		rest = m[5]
+	} else {
+		return info, false
+	}
+
+	info.Show = cleanReleaseName(info.Show)
+	info.Title = cleanReleaseName(releaseJunkRegex.ReplaceAllString(rest, ""))
+	return info, true
+}
+
+// ParseMovieName parses names like "Some.Movie.2010.1080p.mkv" into a title and year
+// year is 0 if there was none in the name
+func ParseMovieName(name string) (title string, year int) {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	if m := movieYearRegex.FindStringSubmatch(name); m != nil && m[1] != "" {
+		year, _ = strconv.Atoi(m[2])
+		return cleanReleaseName(m[1]), year
+	}
+	return cleanReleaseName(releaseJunkRegex.ReplaceAllString(name, "")), 0
+}
+
+// cleanReleaseName turns "Some.Show_Name -" into "Some Show Name"
+func cleanReleaseName(in string) string {
+	in = strings.NewReplacer(".", " ", "_", " ").Replace(in)
+	in = strings.Join(strings.Fields(in), " ")
+	return strings.Trim(in, " -[]()")
+}
+
+// newMediaItem creates a playlist item from a file, typed as a tv episode if the name looks like one
+// Metadata from nfo files and artwork next to the file is included
+func (s *Server) newMediaItem(path string) PlaylistItem {
+	item := newPathItem(path)
+
+	info, ok := ParseEpisodeName(filepath.Base(path))
+	if !ok {
+		title, year := ParseMovieName(filepath.Base(path))
+		if title != "" {
+			item.Title = title
+		}
+		item.Year = year
+		s.applyLocalMetadata(&item)
+		return item
+	}
+
+	if info.Show == "" {
+		info.Show = showNameFromDirs(path)
+	}
+
+	item.Kind = ITEMTYPETV
+	item.ShowTitle = info.Show
+	item.Season = info.Season
+	item.Episode = info.Episode
+	item.AirDate = info.AirDate
+	if info.Title != "" {
+		item.Title = info.Title
+	} else if info.AirDate != "" {
+		item.Title = info.AirDate
+	} else {
+		item.Title = fmt.Sprintf("S%02dE%02d", info.Season, info.Episode)
+	}
+	if len(info.AirDate) >= 4 {
+		item.Year, _ = strconv.Atoi(info.AirDate[:4])
+	}
+
+	s.applyLocalMetadata(&item)
+	return item
+}
+
+// Used for files only named "S01E02.mkv", uses "Show/Season 1/" or "Show/"
+func showNameFromDirs(path string) string {
+	dir := filepath.Dir(path)
+	if seasonDirRegex.MatchString(filepath.Base(dir)) {
+		dir = filepath.Dir(dir)
+	}
+	return cleanReleaseName(filepath.Base(dir))
+}
+
+// ScanMediaDir recursively finds all video files in dir and returns them sorted in natural episode order
+func (s *Server) ScanMediaDir(dir string) ([]PlaylistItem, error) {
+	items := make([]PlaylistItem, 0)
+	errTooMany := fmt.Errorf("Too many files, max %d per directory", MaxDirItems)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden files and folders
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() || !IsVideoFile(path) {
+			return nil
+		}
+
+		if len(items) >= MaxDirItems {
+			return errTooMany
+		}
+		items = append(items, s.newMediaItem(path))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	SortEpisodes(items)
+	return items, nil
+}
+
+// SortEpisodes sorts by show, season, episode and air date, falling back to natural path order
+func SortEpisodes(items []PlaylistItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Kind == ITEMTYPETV {
+			aShow, bShow := strings.ToLower(a.ShowTitle), strings.ToLower(b.ShowTitle)
+			if aShow != bShow {
+				return naturalLess(aShow, bShow)
+			}
+			if a.AirDate != b.AirDate {
+				return a.AirDate < b.AirDate
+			}
+			if a.Season != b.Season {
+				return a.Season < b.Season
+			}
+			if a.Episode != b.Episode {
+				return a.Episode < b.Episode
+			}
+		}
+		return naturalLess(strings.ToLower(a.Path), strings.ToLower(b.Path))
+	})
+}
+
+// naturalLess compares strings with embedded numbers by their numerical value, so "ep2" < "ep10"
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		aDigits := leadingDigits(a)
+		bDigits := leadingDigits(b)
+
+		if aDigits != "" && bDigits != "" {
+			aTrim := strings.TrimLeft(aDigits, "0")
+			bTrim := strings.TrimLeft(bDigits, "0")
+			if len(aTrim) != len(bTrim) {
+				return len(aTrim) < len(bTrim)
+			}
+			if aTrim != bTrim {
+				return aTrim < bTrim
+			}
+			a, b = a[len(aDigits):], b[len(bDigits):]
+			continue
+		}
+
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
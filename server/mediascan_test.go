@@ -0,0 +1,103 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseEpisodeName(t *testing.T) {
+	cases := []struct {
+		name string
+		want EpisodeInfo
+		ok   bool
+	}{
+		{"Show.Name.S01E02.Some.Title.mkv", EpisodeInfo{Show: "Show Name", Title: "Some Title", Season: 1, Episode: 2}, true},
+		{"Show Name - s1e2.mkv", EpisodeInfo{Show: "Show Name", Season: 1, Episode: 2}, true},
+		{"Show_Name_S02E10E11_Double.mp4", EpisodeInfo{Show: "Show Name", Title: "Double", Season: 2, Episode: 10}, true},
+		{"Show.Name.S03E04.720p.HDTV.x264-GRP.mkv", EpisodeInfo{Show: "Show Name", Season: 3, Episode: 4}, true},
+		{"Show Name [S01E100] Long One.mkv", EpisodeInfo{Show: "Show Name", Title: "Long One", Season: 1, Episode: 100}, true},
+		{"S01E02.mkv", EpisodeInfo{Season: 1, Episode: 2}, true},
+		{"S01E02_Pilot.mkv", EpisodeInfo{Title: "Pilot", Season: 1, Episode: 2}, true},
+		{"Show.Name.S01E02Extra.mkv", EpisodeInfo{}, false},
+		{"Show Name 1x02 Title.avi", EpisodeInfo{Show: "Show Name", Title: "Title", Season: 1, Episode: 2}, true},
+		{"Show.Name.10x120.mkv", EpisodeInfo{Show: "Show Name", Season: 10, Episode: 120}, true},
+		{"Show_Name_1x02_Title.avi", EpisodeInfo{Show: "Show Name", Title: "Title", Season: 1, Episode: 2}, true},
+		{"Show.Name.2016.12.08.Some.Guest.mkv", EpisodeInfo{Show: "Show Name", Title: "Some Guest", AirDate: "2016-12-08"}, true},
+		{"Daily Show 2020-01-31.mkv", EpisodeInfo{Show: "Daily Show", AirDate: "2020-01-31"}, true},
+		{"Daily_Show_2020_01_31_Guest.mkv", EpisodeInfo{Show: "Daily Show", Title: "Guest", AirDate: "2020-01-31"}, true},
+		{"Show.2016.13.08.mkv", EpisodeInfo{}, false},
+		{"Some.Movie.2010.1080p.mkv", EpisodeInfo{}, false},
+		{"1920x1080.mkv", EpisodeInfo{}, false},
+		{"Blade Runner 2049 (2017).mkv", EpisodeInfo{}, false},
+	}
+
+	for _, c := range cases {
+		got, ok := ParseEpisodeName(c.name)
+		if ok != c.ok {
+			t.Errorf("%s: ok = %v, want %v (%+v)", c.name, ok, c.ok, got)
+			continue
+		}
+		if ok && got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseMovieName(t *testing.T) {
+	cases := []struct {
+		name  string
+		title string
+		year  int
+	}{
+		{"Some.Movie.2010.1080p.BluRay.x264.mkv", "Some Movie", 2010},
+		{"Some Movie (1999).mkv", "Some Movie", 1999},
+		{"Blade Runner 2049 (2017).mkv", "Blade Runner 2049", 2017},
+		{"2001 A Space Odyssey.mkv", "2001 A Space Odyssey", 0},
+		{"Home_Video.720p.mp4", "Home Video", 0},
+	}
+
+	for _, c := range cases {
+		title, year := ParseMovieName(c.name)
+		if title != c.title || year != c.year {
+			t.Errorf("%s: got %q %d, want %q %d", c.name, title, year, c.title, c.year)
+		}
+	}
+}
+
+func TestShowNameFromDirs(t *testing.T) {
+	cases := []struct {
+		path, want string
+	}{
+		{"/tv/Show Name/Season 1/S01E02.mkv", "Show Name"},
+		{"/tv/Show.Name/S02/S02E01.mkv", "Show Name"},
+		{"/tv/Show Name/Specials/S00E01.mkv", "Show Name"},
+		{"/tv/Show Name/S01E02.mkv", "Show Name"},
+	}
+	for _, c := range cases {
+		if got := showNameFromDirs(filepath.FromSlash(c.path)); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.path, got, c.want)
+		}
+	}
+}
+
+func TestSortEpisodes(t *testing.T) {
+	items := []PlaylistItem{
+		{Kind: ITEMTYPEMOVIE, Path: "/m/movie 10.mkv"},
+		{Kind: ITEMTYPETV, ShowTitle: "B", Season: 1, Episode: 10, Path: "/b/10"},
+		{Kind: ITEMTYPETV, ShowTitle: "a", Season: 2, Episode: 1, Path: "/a/201"},
+		{Kind: ITEMTYPETV, ShowTitle: "B", Season: 1, Episode: 2, Path: "/b/2"},
+		{Kind: ITEMTYPEMOVIE, Path: "/m/movie 9.mkv"},
+		{Kind: ITEMTYPETV, ShowTitle: "A", Season: 1, Episode: 3, Path: "/a/103"},
+	}
+	SortEpisodes(items)
+
+	want := []string{"/a/103", "/a/201", "/b/2", "/b/10", "/m/movie 9.mkv", "/m/movie 10.mkv"}
+	if ITEMTYPEMOVIE < ITEMTYPETV {
+		want = []string{"/m/movie 9.mkv", "/m/movie 10.mkv", "/a/103", "/a/201", "/b/2", "/b/10"}
+	}
+	for i, item := range items {
+		if item.Path != want[i] {
+			t.Fatalf("sorted to %v at %d, want %v", item.Path, i, want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Kinds of MediaItem
+const (
+	MediaKindMovie   = "movie"
+	MediaKindShow    = "show"
+	MediaKindEpisode = "episode"
+	MediaKindFolder  = "folder"
+)
+
+// Media source ids
+const (
+	SourceLocal    = "local"
+	SourcePlex     = "plex"
+	SourceJellyfin = "jellyfin"
+)
+
+// MediaItem is a search or browse result from a media source
+type MediaItem struct {
+	Source    string `json:"source"`
+	ID        string `json:"id"`   // Source specific id, used for browsing and adding
+	Kind      string `json:"kind"` // One of movie, show, episode, folder
+	Title     string `json:"title"`
+	ShowTitle string `json:"showTitle"`
+	Season    int    `json:"season"`
+	Episode   int    `json:"episode"`
+	Year      int    `json:"year"`
+	Duration  int    `json:"duration"` // Duration in milliseconds
+}
+
+type ResolveOptions struct {
+	AddAllAfter bool // For episodes, also include all the following episodes
+	WholeSeason bool // For episodes, include the whole season
+}
+
+// MediaSource is somewhere we can find things to play
+type MediaSource interface {
+	ID() string
+	Search(query SearchQuery) ([]MediaItem, error)
+	// Browse lists the children of a show or folder, id "" lists the top level
+	Browse(id string) ([]MediaItem, error)
+	// Resolve turns an item into playable playlist items with local paths
+	Resolve(id string, options ResolveOptions) ([]PlaylistItem, error)
+}
+
+var ErrUnknownSource = errors.New("Unknown media source")
+
+// GetMediaSource returns the source with the id, "" being the local library
+func (s *Server) GetMediaSource(id string) (MediaSource, error) {
+	switch id {
+	case "", SourceLocal:
+		return localSource{server: s}, nil
+	case SourcePlex:
+		if _, err := s.plexServer(); err != nil {
+			return nil, err
+		}
+		return plexSource{server: s}, nil
+	case SourceJellyfin:
+		client, err := s.newJellyfinClient()
+		if err != nil {
+			return nil, err
+		}
+		return &jellyfinSource{client: client}, nil
+	}
+	return nil, ErrUnknownSource
+}
+
+func (s *Server) handleSearch(session fnet.Session, sq SearchQuery) {
+	log.Println("Handling search")
+	if !s.checkRole(session, s.addRole(), true) {
+		return
+	}
+
+	if sq.Kind != "" && sq.Kind != "tv" && sq.Kind != "movie" {
+		s.sendErrResp(session, errors.New("Kind has to be tv or movie"), EvtSearch)
+		return
+	}
+
+	if sq.Title == "" && sq.Show == "" && sq.Year == 0 {
+		s.sendErrResp(session, errors.New("Title is empty"), EvtSearch)
+		return
+	}
+
+	source, err := s.GetMediaSource(sq.Source)
+	if s.checkError(session, err, EvtSearch) {
+		return
+	}
+
+	items, err := source.Search(sq)
+	if s.checkError(session, err, EvtSearch) {
+		return
+	}
+	if len(items) < 1 {
+		s.sendErrResp(session, errors.New("No search results! :("), EvtSearch)
+		return
+	}
+
+	reply := SearchReply{Items: items, Kind: sq.Kind, Source: source.ID()}
+	err = s.netEngine.CreateAndSend(session, EvtSearch, reply)
+	if s.checkError(session, err, EvtSearch) {
+		return
+	}
+}
+
+type SourceBrowseRequest struct {
+	Source string `json:"source"`
+	ID     string `json:"id"` // Empty lists the top level
+}
+
+type SourceBrowseReply struct {
+	Source string      `json:"source"`
+	ID     string      `json:"id"`
+	Items  []MediaItem `json:"items"`
+}
+
+func (s *Server) handleSourceBrowse(session fnet.Session, req SourceBrowseRequest) {
+	if !s.checkRole(session, s.addRole(), true) {
+		return
+	}
+
+	source, err := s.GetMediaSource(req.Source)
+	if s.checkError(session, err, EvtSourceBrowse) {
+		return
+	}
+
+	items, err := source.Browse(req.ID)
+	if s.checkError(session, err, EvtSourceBrowse) {
+		return
+	}
+
+	reply := SourceBrowseReply{Source: source.ID(), ID: req.ID, Items: items}
+	err = s.netEngine.CreateAndSend(session, EvtSourceBrowse, reply)
+	if err != nil {
+		log.Println("Error sending source browse reply: ", err)
+	}
+}
+
+type PlaylistAddItemReq struct {
+	Source string `json:"source"` // Defaults to the local library
+	ID     string `json:"id"`     // From a search or browse result
+
+	// For tv shows
+	AddAllAfter bool `json:"addAllAfter"`
+	AddSeason   bool `json:"addSeason"` // Add the whole season
+
+	PlayNext bool `json:"playNext"` // Insert after the current item instead of at the end
+}
+
+func (s *Server) handlePlaylistAdd(session fnet.Session, paReq PlaylistAddItemReq) {
+	log.Println("Handling playlistadd")
+	if !s.checkRole(session, s.addRole(), true) {
+		return
+	}
+
+	source, err := s.GetMediaSource(paReq.Source)
+	if s.checkError(session, err, EvtPlaylistAdd) {
+		return
+	}
+
+	items, err := source.Resolve(paReq.ID, ResolveOptions{AddAllAfter: paReq.AddAllAfter, WholeSeason: paReq.AddSeason})
+	if s.checkError(session, err, EvtPlaylistAdd) {
+		return
+	}
+
+	// Remote servers can give us anything
+	items = s.filterAllowedItems(items)
+	if len(items) < 1 {
+		s.sendErrResp(session, errors.New("Nothing was added, the files are not inside the media roots"), EvtPlaylistAdd)
+		return
+	}
+
+	// Local items already have their nfo and artwork
+	if source.ID() != SourceLocal {
+		for i := range items {
+			s.applyLocalMetadata(&items[i])
+		}
+	}
+
+	setItemOwner(session, items)
+
+	room := s.sessionRoom(session)
+	name, _ := session.Data.GetString("name")
+	if paReq.PlayNext {
+		room.Player.InsertNext(name, items)
+	} else {
+		room.Player.AppendItems(name, items)
+	}
+
+	if len(items) == 1 {
+		room.broadcastNotification(fmt.Sprintf("%s Added %s to the playlist", name, items[0].Title), true)
+	} else {
+		room.broadcastNotification(fmt.Sprintf("%s Added %d items to the playlist", name, len(items)), true)
+	}
+	room.broadcastPlaylistStatus()
+}
+
+// localSource is the local library and media roots, ids are paths
+type localSource struct {
+	server *Server
+}
+
+func (localSource) ID() string { return SourceLocal }
+
+func (src localSource) Search(query SearchQuery) ([]MediaItem, error) {
+	entries := src.server.library.Search(query)
+	items := make([]MediaItem, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, src.server.entryMediaItem(&e))
+	}
+	return items, nil
+}
+
+func (src localSource) Browse(id string) ([]MediaItem, error) {
+	var entries []BrowseEntry
+	if id == "" {
+		entries = src.server.rootEntries()
+	} else {
+		dir, err := src.server.ResolveMediaPath(id)
+		if err != nil {
+			return nil, err
+		}
+		entries, err = src.server.listDir(dir)
+		if err != nil {
+			log.Println("Failed browsing", dir, err)
+			return nil, errors.New("Failed reading directory")
+		}
+	}
+
+	items := make([]MediaItem, 0, len(entries))
+	for _, be := range entries {
+		if be.IsDir {
+			items = append(items, MediaItem{Source: SourceLocal, ID: be.Path, Kind: MediaKindFolder, Title: be.Name})
+			continue
+		}
+
+		if entry, ok := src.server.library.Get(be.Path); ok {
+			items = append(items, src.server.entryMediaItem(&entry))
+		} else {
+			items = append(items, playlistMediaItem(SourceLocal, be.Path, src.server.newMediaItem(be.Path)))
+		}
+	}
+	return items, nil
+}
+
+func (src localSource) Resolve(id string, options ResolveOptions) ([]PlaylistItem, error) {
+	path, err := src.server.ResolveMediaPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, ErrMediaNotFound
+	}
+
+	if info.IsDir() {
+		return src.server.ScanMediaDir(path)
+	}
+
+	entry, ok := src.server.library.Get(path)
+	if !ok {
+		return []PlaylistItem{src.server.newMediaItem(path)}, nil
+	}
+
+	if entry.Kind != ITEMTYPETV || (!options.AddAllAfter && !options.WholeSeason) {
+		return []PlaylistItem{src.server.entryPlaylistItem(&entry)}, nil
+	}
+
+	items := make([]PlaylistItem, 0)
+	for _, ep := range src.server.library.ShowEpisodes(entry.ShowTitle) {
+		switch {
+		case ep.Path == entry.Path:
+		case options.WholeSeason && ep.Season == entry.Season:
+		case options.AddAllAfter && (ep.Season > entry.Season || (ep.Season == entry.Season && ep.Episode > entry.Episode)):
+		default:
+			continue
+		}
+		items = append(items, src.server.entryPlaylistItem(&ep))
+	}
+	return items, nil
+}
+
+func playlistMediaItem(source, id string, item PlaylistItem) MediaItem {
+	kind := MediaKindMovie
+	if item.Kind == ITEMTYPETV {
+		kind = MediaKindEpisode
+	}
+	return MediaItem{
+		Source:    source,
+		ID:        id,
+		Kind:      kind,
+		Title:     item.Title,
+		ShowTitle: item.ShowTitle,
+		Season:    item.Season,
+		Episode:   item.Episode,
+		Duration:  item.Duration,
+	}
+}
+
+func (s *Server) entryMediaItem(e *LibraryEntry) MediaItem {
+	item := playlistMediaItem(SourceLocal, e.Path, s.entryPlaylistItem(e))
+	item.Year = e.Year
+	item.Title = e.Title
+	if item.Title == "" {
+		item.Title = filepath.Base(e.Path)
+	}
+	return item
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Artwork kinds
+const (
+	ArtworkPoster = "poster"
+	ArtworkFanart = "fanart"
+	ArtworkThumb  = "thumb"
+)
+
+// nfo is the union of the kodi movie, episodedetails and tvshow nfo fields we use
+type nfo struct {
+	XMLName   xml.Name
+	Title     string `xml:"title"`
+	ShowTitle string `xml:"showtitle"`
+	Year      int    `xml:"year"`
+	Plot      string `xml:"plot"`
+	Runtime   int    `xml:"runtime"` // minutes
+	Season    int    `xml:"season"`
+	Episode   int    `xml:"episode"`
+	Aired     string `xml:"aired"`
+	Premiered string `xml:"premiered"`
+}
+
+// readNFO reads a kodi style nfo file, returns false if there was none or it couldnt be parsed
+// Only sidecars inside the media roots are read
+func (s *Server) readNFO(path string) (*nfo, bool) {
+	resolved, err := s.ResolveMediaFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	// Kodi allows junk like a scraper url after the xml, Decode stops after the root element
+	var parsed nfo
+	decoder := xml.NewDecoder(file)
+	decoder.Strict = false
+	err = decoder.Decode(&parsed)
+	if err != nil {
+		return nil, false
+	}
+	return &parsed, true
+}
+
+// applyLocalMetadata fills in the item from nfo files next to it, and finds its artwork
+func (s *Server) applyLocalMetadata(item *PlaylistItem) {
+	base := strings.TrimSuffix(item.Path, filepath.Ext(item.Path))
+	dir := filepath.Dir(item.Path)
+
+	if item.Kind == ITEMTYPETV {
+		showFromNFO := false
+		if parsed, ok := s.readNFO(base + ".nfo"); ok && parsed.XMLName.Local == "episodedetails" {
+			applyNFO(item, parsed)
+			showFromNFO = parsed.ShowTitle != ""
+		}
+
+		if !showFromNFO {
+			if show, ok := s.readNFO(filepath.Join(showDir(item.Path), "tvshow.nfo")); ok && show.Title != "" {
+				item.ShowTitle = show.Title
+			}
+		}
+	} else {
+		parsed, ok := s.readNFO(base + ".nfo")
+		if !ok {
+			parsed, ok = s.readNFO(filepath.Join(dir, "movie.nfo"))
+		}
+		if ok && parsed.XMLName.Local == "movie" {
+			applyNFO(item, parsed)
+		}
+	}
+
+	for _, kind := range []string{ArtworkPoster, ArtworkFanart, ArtworkThumb} {
+		if s.findArtwork(item.Path, item.Kind, kind) != "" {
+			setArtworkURL(item, kind, s.artworkURL(item.Path, kind))
+		}
+	}
+}
+
+func applyNFO(item *PlaylistItem, parsed *nfo) {
+	if parsed.Title != "" {
+		item.Title = parsed.Title
+	}
+	if parsed.ShowTitle != "" {
+		item.ShowTitle = parsed.ShowTitle
+	}
+	if parsed.Plot != "" {
+		item.Plot = strings.TrimSpace(parsed.Plot)
+	}
+	if parsed.Season > 0 {
+		item.Season = parsed.Season
+	}
+	if parsed.Episode > 0 {
+		item.Episode = parsed.Episode
+	}
+	if item.Duration == 0 && parsed.Runtime > 0 {
+		item.Duration = parsed.Runtime * 60 * 1000
+	}
+
+	year := parsed.Year
+	date := parsed.Aired
+	if date == "" {
+		date = parsed.Premiered
+	}
+	if year == 0 && len(date) >= 4 {
+		year, _ = strconv.Atoi(date[:4])
+	}
+	if year != 0 {
+		item.Year = year
+	}
+}
+
+// The show folder, skipping over "Season 1" style folders
+func showDir(path string) string {
+	dir := filepath.Dir(path)
+	if seasonDirRegex.MatchString(filepath.Base(dir)) {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
+
+func setArtworkURL(item *PlaylistItem, kind, u string) {
+	switch kind {
+	case ArtworkPoster:
+		item.Poster = u
+	case ArtworkFanart:
+		item.Fanart = u
+	case ArtworkThumb:
+		item.Thumb = u
+	}
+}
+
+// artworkCandidates returns the kodi style artwork filenames to look for, in order of preference
+func artworkCandidates(mediaPath string, itemKind int, kind string) []string {
+	base := strings.TrimSuffix(mediaPath, filepath.Ext(mediaPath))
+	dir := filepath.Dir(mediaPath)
+
+	var names []string
+	switch kind {
+	case ArtworkPoster:
+		names = append(names, base+"-poster")
+		if itemKind == ITEMTYPETV {
+			// Season posters in the show folder
+			if season, ok := ParseEpisodeName(filepath.Base(mediaPath)); ok && season.Season > 0 {
+				names = append(names, filepath.Join(showDir(mediaPath), fmt.Sprintf("season%02d-poster", season.Season)))
+			}
+			names = append(names, filepath.Join(showDir(mediaPath), "poster"), filepath.Join(showDir(mediaPath), "folder"))
+		} else {
+			names = append(names, filepath.Join(dir, "poster"), filepath.Join(dir, "folder"), filepath.Join(dir, "cover"))
+		}
+	case ArtworkFanart:
+		names = append(names, base+"-fanart")
+		if itemKind == ITEMTYPETV {
+			names = append(names, filepath.Join(showDir(mediaPath), "fanart"))
+		} else {
+			names = append(names, filepath.Join(dir, "fanart"))
+		}
+	case ArtworkThumb:
+		names = append(names, base+"-thumb", base)
+	}
+
+	candidates := make([]string, 0, len(names)*2)
+	for _, n := range names {
+		candidates = append(candidates, n+".jpg", n+".png")
+	}
+	return candidates
+}
+
+// findArtwork returns the path to the artwork, or "" if there was none inside the media roots
+func (s *Server) findArtwork(mediaPath string, itemKind int, kind string) string {
+	for _, c := range artworkCandidates(mediaPath, itemKind, kind) {
+		resolved, err := s.ResolveMediaFile(c)
+		if err == nil {
+			return resolved
+		}
+	}
+	return ""
+}
+
+func (s *Server) artworkURL(mediaPath, kind string) string {
+	s.configLock.RLock()
+	base := strings.TrimSuffix(s.config.HTTPBaseURL, "/")
+	s.configLock.RUnlock()
+
+	return base + "/artwork?" + url.Values{"path": {mediaPath}, "kind": {kind}}.Encode()
+}
+
+// Serves the artwork of a media file, only files next to media inside the media roots can be served
+func (s *Server) handleArtworkHTTP(w http.ResponseWriter, r *http.Request) {
+	mediaPath, err := s.ResolveMediaFile(r.URL.Query().Get("path"))
+	if err != nil || !IsVideoFile(mediaPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	kind := r.URL.Query().Get("kind")
+	if kind != ArtworkPoster && kind != ArtworkFanart && kind != ArtworkThumb {
+		http.Error(w, "Unknown artwork kind", http.StatusBadRequest)
+		return
+	}
+
+	itemKind := ITEMTYPEMOVIE
+	if _, ok := ParseEpisodeName(filepath.Base(mediaPath)); ok {
+		itemKind = ITEMTYPETV
+	}
+
+	artPath := s.findArtwork(mediaPath, itemKind, kind)
+	if artPath == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=3600")
+	http.ServeFile(w, r, artPath)
+}
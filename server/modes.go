@@ -0,0 +1,317 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Repeat modes
+const (
+	RepeatOff = "off"
+	RepeatAll = "all"
+	RepeatOne = "one"
+)
+
+type PlaybackMode struct {
+	Repeat    string `json:"repeat"` // One of off, all, one
+	Shuffle   bool   `json:"shuffle"`
+	StopAfter bool   `json:"stopAfter"` // Stop when the current item ends, cleared when it triggers
+	SleepAt   int64  `json:"sleepAt"`   // Unix time playback will be paused at, 0 if no sleep timer
+
+	shuffleSeed  uint64
+	shuffleStart uint64 // Offsets the keys so the item playing when shuffle was turned on comes first
+}
+
+// shuffleKey is where the item with path is in the shuffled order, it only depends on the seed and
+// the path so the order survives the playlist being edited
+func (m *PlaybackMode) shuffleKey(path string) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d:%s", m.shuffleSeed, path)
+
+	// fnv barely changes when only the end of the input does (like episode numbers), so mix it
+	k := h.Sum64()
+	k = (k ^ (k >> 30)) * 0xbf58476d1ce4e5b9
+	k = (k ^ (k >> 27)) * 0x94d049bb133111eb
+	k ^= k >> 31
+	return k - m.shuffleStart
+}
+
+// shuffleStep returns the index of the item right after (or before if backwards) the item with path
+// at index in the shuffled order, -1 if there is none
+// runs on the player goroutine
+func (p *Player) shuffleStep(path string, index int, backwards bool) int {
+	key := p.Mode.shuffleKey(path)
+	found := -1
+	var foundKey uint64
+
+	for i, item := range p.CurrentPlaylist.Items {
+		k := p.Mode.shuffleKey(item.Path)
+
+		// Duplicates have the same key, the index decides between them
+		if backwards {
+			if k > key || (k == key && i >= index) {
+				continue
+			}
+			if found == -1 || k > foundKey || (k == foundKey && i > found) {
+				found, foundKey = i, k
+			}
+		} else {
+			if k < key || (k == key && i <= index) {
+				continue
+			}
+			if found == -1 || k < foundKey || (k == foundKey && i < found) {
+				found, foundKey = i, k
+			}
+		}
+	}
+	return found
+}
+
+// shuffleFirst returns the first (or last) item in the shuffled order, -1 if the playlist is empty
+// runs on the player goroutine
+func (p *Player) shuffleFirst(last bool) int {
+	found := -1
+	var foundKey uint64
+	for i, item := range p.CurrentPlaylist.Items {
+		k := p.Mode.shuffleKey(item.Path)
+		switch {
+		case found == -1:
+		case last && (k > foundKey || (k == foundKey && i > found)):
+		case !last && k < foundKey:
+		default:
+			continue
+		}
+		found, foundKey = i, k
+	}
+	return found
+}
+
+// upNext returns the index of the item to play after the item with path at current, seqNext being
+// the index that follows it in playlist order. manual is true when skipping, which ignores repeat one
+// current is -1 if the item is no longer in the playlist. Returns the playlist length at the end
+// runs on the player goroutine
+func (p *Player) upNext(path string, current, seqNext int, manual bool) int {
+	n := len(p.CurrentPlaylist.Items)
+	if p.Mode.Repeat == RepeatOne && !manual && current >= 0 && current < n {
+		return current
+	}
+
+	if p.Mode.Shuffle {
+		if i := p.shuffleStep(path, current, false); i != -1 {
+			return i
+		}
+	} else if seqNext >= 0 && seqNext < n {
+		return seqNext
+	}
+
+	// Reached the end
+	if p.Mode.Repeat == RepeatAll && n > 0 {
+		if p.Mode.Shuffle {
+			return p.shuffleFirst(false)
+		}
+		return 0
+	}
+	return n
+}
+
+// runs on the player goroutine
+func (p *Player) currentPath() string {
+	if p.Playing {
+		return p.nowPlaying.Path
+	}
+	if p.CurrentPlaylist.CurrentIndex >= 0 && p.CurrentPlaylist.CurrentIndex < len(p.CurrentPlaylist.Items) {
+		return p.CurrentPlaylist.Items[p.CurrentPlaylist.CurrentIndex].Path
+	}
+	return ""
+}
+
+// nextIndexFor returns the index to play after the current item
+// runs on the player goroutine
+func (p *Player) nextIndexFor(manual bool) int {
+	current := p.CurrentPlaylist.CurrentIndex
+	return p.upNext(p.currentPath(), current, current+1, manual)
+}
+
+// prevIndex returns the index of the item before the current one
+// runs on the player goroutine
+func (p *Player) prevIndex() int {
+	current := p.CurrentPlaylist.CurrentIndex
+	if p.Mode.Shuffle {
+		if i := p.shuffleStep(p.currentPath(), current, true); i != -1 {
+			return i
+		}
+		if p.Mode.Repeat == RepeatAll {
+			return p.shuffleFirst(true)
+		}
+		return current
+	}
+
+	if current <= 0 && p.Mode.Repeat == RepeatAll {
+		return len(p.CurrentPlaylist.Items) - 1
+	}
+	if current <= 0 {
+		return 0
+	}
+	return current - 1
+}
+
+// jumpTo makes index the next item to play, if something is playing it's played when that ends
+// instead of whatever would be next
+// runs on the player goroutine
+func (p *Player) jumpTo(index int) {
+	p.CurrentPlaylist.CurrentIndex = index
+	p.jumped = p.Playing
+}
+
+// advance moves CurrentIndex to the next item after the current one ended, unless there was a jump
+// runs on the player goroutine
+func (p *Player) advance(manual bool) {
+	if p.jumped {
+		p.jumped = false
+		return
+	}
+	p.CurrentPlaylist.CurrentIndex = p.nextIndexFor(manual)
+}
+
+// setSleepTimer pauses playback after d, 0 cancels the timer
+// runs on the player goroutine
+func (p *Player) setSleepTimer(d time.Duration) {
+	if p.sleepTimer != nil {
+		p.sleepTimer.Stop()
+		p.sleepTimer = nil
+	}
+	p.Mode.SleepAt = 0
+	if d <= 0 {
+		return
+	}
+
+	sleepAt := time.Now().Add(d).Unix()
+	p.Mode.SleepAt = sleepAt
+	p.sleepTimer = time.AfterFunc(d, func() {
+		stale := true
+		paused := false
+		p.do(func() {
+			if p.Mode.SleepAt != sleepAt {
+				// Changed while we were waiting for the player
+				return
+			}
+			stale = false
+			p.Mode.SleepAt = 0
+			p.sleepTimer = nil
+			if p.Playing {
+				p.pause()
+				paused = true
+			}
+		})
+		if stale {
+			return
+		}
+
+		if paused {
+			p.room.broadcastNotification("Sleep timer paused playback", true)
+		}
+		p.room.broadcastStatus()
+	})
+}
+
+// Fields left out are left unchanged
+type PlaybackModeRequest struct {
+	Repeat    *string `json:"repeat"`
+	Shuffle   *bool   `json:"shuffle"`
+	StopAfter *bool   `json:"stopAfter"`
+	Sleep     *int    `json:"sleep"` // Minutes from now, 0 cancels the sleep timer
+	Rotation  *bool   `json:"rotation"`
+}
+
+func ValidateRepeatMode(mode string) error {
+	switch mode {
+	case RepeatOff, RepeatAll, RepeatOne:
+		return nil
+	}
+	return errors.New("Repeat has to be off, all or one")
+}
+
+func (s *Server) handleSetPlaybackMode(session fnet.Session, req PlaybackModeRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	if req.Repeat != nil {
+		err := ValidateRepeatMode(*req.Repeat)
+		if s.checkError(session, err, EvtSetPlaybackMode) {
+			return
+		}
+	}
+	if req.Sleep != nil && (*req.Sleep < 0 || *req.Sleep > 24*60) {
+		s.sendErrResp(session, errors.New("Sleep timer has to be between 0 and 24 hours"), EvtSetPlaybackMode)
+		return
+	}
+
+	changes := make([]string, 0)
+	rotationChanged := false
+
+	room := s.sessionRoom(session)
+	player := room.Player
+	player.do(func() {
+		if req.Repeat != nil && *req.Repeat != player.Mode.Repeat {
+			player.Mode.Repeat = *req.Repeat
+			changes = append(changes, "repeat "+*req.Repeat)
+		}
+		if req.Shuffle != nil && *req.Shuffle != player.Mode.Shuffle {
+			player.Mode.Shuffle = *req.Shuffle
+			if *req.Shuffle {
+				player.Mode.shuffleSeed = uint64(rand.Int63())
+				player.Mode.shuffleStart = 0
+				player.Mode.shuffleStart = player.Mode.shuffleKey(player.currentPath())
+				changes = append(changes, "shuffle on")
+			} else {
+				changes = append(changes, "shuffle off")
+			}
+		}
+		if req.StopAfter != nil && *req.StopAfter != player.Mode.StopAfter {
+			player.Mode.StopAfter = *req.StopAfter
+			if *req.StopAfter {
+				changes = append(changes, "stop after the current item")
+			} else {
+				changes = append(changes, "keep playing after the current item")
+			}
+		}
+		if req.Sleep != nil {
+			player.setSleepTimer(time.Duration(*req.Sleep) * time.Minute)
+			if *req.Sleep > 0 {
+				changes = append(changes, fmt.Sprintf("sleep timer %d minutes", *req.Sleep))
+			} else {
+				changes = append(changes, "sleep timer off")
+			}
+		}
+		rotationChanged = req.Rotation != nil && *req.Rotation != player.CurrentPlaylist.Rotation
+		if rotationChanged {
+			player.CurrentPlaylist.Rotation = *req.Rotation
+			player.rebuildRotation()
+			if *req.Rotation {
+				changes = append(changes, "DJ rotation on")
+			} else {
+				changes = append(changes, "DJ rotation off")
+			}
+		}
+	})
+
+	if len(changes) < 1 {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	log.Printf("%s changed the playback mode: %s\n", name, strings.Join(changes, ", "))
+	room.broadcastNotification(fmt.Sprintf("%s Set %s", name, strings.Join(changes, ", ")), true)
+	if rotationChanged {
+		room.broadcastPlaylistStatus()
+	} else {
+		room.broadcastStatus()
+	}
+}
@@ -0,0 +1,567 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/plex"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ITEMTYPETV    = 0
+	ITEMTYPEMOVIE = 1
+)
+
+var (
+	ErrAlreadyPlaying = errors.New("Already playing")
+	ErrNotPlaying     = errors.New("Not playing anything at the moment")
+	ErrInvalidSeek    = errors.New("Invalid position, it has to be like h:m:s")
+)
+
+type PlaylistItem struct {
+	Kind      int    `json:"kind"`      // What type of item it is (tv/movie)
+	Path      string `json:"path"`      // Full path to file
+	Duration  int    `json:"duration"`  // Duration in milliseconds
+	Title     string `json:"title"`     // If movie, title of movie, if tv show, title of episode
+	ShowTitle string `json:"showTitle"` // If tv show, title of show
+	Episode   int    `json:"episode"`   // for tv
+	Season    int    `json:"season"`    // for tv
+	AirDate   string `json:"airDate"`   // for date based tv shows, yyyy-mm-dd
+	Year      int    `json:"year"`
+	Plot      string `json:"plot"`
+	Poster    string `json:"poster"` // Artwork urls, empty if there is none
+	Fanart    string `json:"fanart"`
+	Thumb     string `json:"thumb"`
+	AddedBy   string `json:"addedBy"` // Name of who added it, empty if it came from a playlist file
+
+	owner string // viewerKey of who added it
+}
+
+type Playlist struct {
+	Items        []PlaylistItem `json:"items"`
+	CurrentIndex int            `json:"currentIndex"`
+	Rotation     bool           `json:"rotation"` // DJ rotation mode, see rotation.go
+
+	djs []string // Owners in the order they take turns
+}
+
+type TranscoderSettings struct {
+	ScaleWidth int    `json:"scale"` // The width
+	MaxRate    int    `json:"maxrate"`
+	Preset     string `json:"preset"`
+	Streams    []int  `json:"streams"`
+	Seek       string `json:"seek"`
+	Subs       bool   `json:"subs"`
+	Profile    string `json:"profile"` // Setting this replaces ScaleWidth, MaxRate and Preset with the profile's
+}
+
+// Player is only ever touched by its own goroutine, see Run. Everything else gets at it through do and call
+type Player struct {
+	CurrentPlaylist Playlist           `json:"playlist"`
+	Settings        TranscoderSettings `json:"settings"`
+	Out             string             `json:"-"`
+	Playing         bool               `json:"playing"`
+	ManualStop      bool               `json:"manualStop"`
+	StartedPlaying  time.Time          `json:"-"`
+	StoppedPlaying  time.Time          `json:"-"`
+	StartSegment    int
+	History         PlaylistHistory `json:"-"`
+	Mode            PlaybackMode    `json:"mode"`
+
+	room        *Room
+	cmds        chan playerCmd
+	ended       chan transcodeEnd
+	transcode   Transcode       // Nil if nothing is being transcoded
+	nowPlaying  PlaylistItem    // The item being transcoded, CurrentIndex can point elsewhere after the playlist is edited
+	jumped      bool            // CurrentIndex was set to what should play next while something was playing
+	seekTo      string          // Where to restart the playing item when the transcode stops, set by Seek
+	subs        bool            // If the running transcode burns in subtitles, so we can fall back to none
+	startSeg    int             // Segment number the running transcode started at
+	skipped     int             // Unplayable items skipped in a row
+	plays       int             // Counts items started, seeking or resuming the same one doesn't count
+	samePlay    bool            // The next start picks up the item that was playing, after a seek or pause
+	resume      bool            // Play was pressed while pausing, so start again once the transcode has stopped
+	idleWaiters []chan struct{} // Closed once nothing is transcoding, see stopAndWait
+	sleepTimer  *time.Timer
+}
+
+type playerCmd struct {
+	fn    func() error
+	reply chan error
+}
+
+type transcodeEnd struct {
+	transcode Transcode
+	result    TranscodeResult
+}
+
+func NewPlayer(room *Room) *Player {
+	ts := TranscoderSettings{
+		ScaleWidth: 1280,
+		MaxRate:    2000,
+		Preset:     "veryfast",
+		Streams:    []int{0, 1},
+		Subs:       true,
+		Profile:    DefaultProfile,
+	}
+
+	pl := Playlist{
+		Items:        make([]PlaylistItem, 0),
+		CurrentIndex: 0,
+	}
+
+	p := &Player{
+		CurrentPlaylist: pl,
+		Settings:        ts,
+		Mode:            PlaybackMode{Repeat: RepeatOff},
+		room:            room,
+		cmds:            make(chan playerCmd),
+		ended:           make(chan transcodeEnd),
+	}
+	return p
+}
+
+func (p *Player) AddPlaylistItemByPlexVideo(vid plex.PlexDirectory, kind int) error {
+	pi, err := PlaylistItemFromPlexVideo(vid, kind)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Appending to playlist")
+	log.Println(pi)
+
+	p.do(func() {
+		p.CurrentPlaylist.Items = append(p.CurrentPlaylist.Items, pi)
+	})
+	return nil
+}
+
+func PlaylistItemFromPlexVideo(vid plex.PlexDirectory, kind int) (PlaylistItem, error) {
+	if len(vid.Media) < 1 {
+		return PlaylistItem{}, errors.New("Plex item has no media")
+	}
+
+	if len(vid.Media[0].Parts) < 1 {
+		return PlaylistItem{}, errors.New("Plex item has no parts")
+	}
+
+	media := vid.Media[0]
+	part := media.Parts[0]
+
+	duration, _ := strconv.Atoi(part.Duration)
+	ep, _ := strconv.Atoi(vid.Index)
+	season, _ := strconv.Atoi(vid.ParentIndex)
+
+	pi := PlaylistItem{
+		Kind:      kind,
+		Path:      part.File,
+		Duration:  duration,
+		Title:     vid.Title,
+		ShowTitle: vid.GrandparentTitle,
+		Episode:   ep,
+		Season:    season,
+	}
+
+	return pi, nil
+}
+
+func (p *Player) AddPlaylistItem(item PlaylistItem) error {
+	log.Println("Appending to playlist")
+	log.Println(item.Path)
+
+	p.do(func() {
+		p.CurrentPlaylist.Items = append(p.CurrentPlaylist.Items, item)
+	})
+	return nil
+}
+
+// Run is the player goroutine, the only one touching the player. Commands are run here one at a time,
+// and transcodes ending are handled here too so nothing can change under the play loop
+func (p *Player) Run() {
+	log.Println("Player started")
+	for {
+		select {
+		case cmd := <-p.cmds:
+			cmd.reply <- cmd.fn()
+		case end := <-p.ended:
+			p.transcodeEnded(end)
+		case <-p.room.quit:
+			p.stopTranscode()
+			log.Println("Player stopped")
+			return
+		}
+	}
+}
+
+// call runs fn on the player goroutine and returns its error once it's done
+// it can't be used from the player goroutine, so not from inside fn or the methods that say they run there
+func (p *Player) call(fn func() error) error {
+	reply := make(chan error, 1)
+	select {
+	case p.cmds <- playerCmd{fn: fn, reply: reply}:
+	case <-p.room.quit:
+		return ErrRoomClosed
+	}
+	return <-reply
+}
+
+// do is call for things that can't fail, fn isn't run if the room was closed
+func (p *Player) do(fn func()) {
+	p.call(func() error {
+		fn()
+		return nil
+	})
+}
+
+// Play starts playing from the current item
+func (p *Player) Play() error {
+	return p.call(func() error {
+		if p.Playing && p.ManualStop {
+			// Still waiting for the transcode to stop
+			p.resume = true
+			return nil
+		}
+		if p.Playing {
+			return ErrAlreadyPlaying
+		}
+		p.start()
+		return nil
+	})
+}
+
+// Pause stops playback, playing again picks up a couple of seconds before where it was
+func (p *Player) Pause() error {
+	return p.call(func() error {
+		if !p.Playing {
+			return ErrNotPlaying
+		}
+		p.pause()
+		return nil
+	})
+}
+
+// Next skips to the next item, if nothing is playing it just moves the current item
+func (p *Player) Next() error {
+	return p.call(func() error {
+		p.Settings.Seek = ""
+		p.seekTo = ""
+		if !p.Playing {
+			p.CurrentPlaylist.CurrentIndex = p.nextIndexFor(true)
+			return nil
+		}
+		p.jumpTo(p.nextIndexFor(true))
+		p.stopTranscode()
+		return nil
+	})
+}
+
+// Prev goes back to the previous item, if nothing is playing it just moves the current item
+func (p *Player) Prev() error {
+	return p.call(func() error {
+		p.Settings.Seek = ""
+		p.seekTo = ""
+		if !p.Playing {
+			p.CurrentPlaylist.CurrentIndex = p.prevIndex()
+			return nil
+		}
+		p.jumpTo(p.prevIndex())
+		p.stopTranscode()
+		return nil
+	})
+}
+
+// Jump plays the item at index, starting playback if nothing is playing
+func (p *Player) Jump(index int) error {
+	return p.call(func() error {
+		if index < 0 || index >= len(p.CurrentPlaylist.Items) {
+			return ErrInvalidPlaylistIndex
+		}
+
+		p.Settings.Seek = ""
+		p.seekTo = ""
+		p.jumpTo(index)
+		if p.Playing {
+			// Play it even if we were pausing
+			p.ManualStop = false
+			p.stopTranscode()
+		} else {
+			p.start()
+		}
+		return nil
+	})
+}
+
+// Seek restarts the playing item at pos, or sets where the current item starts if nothing is playing
+func (p *Player) Seek(pos string) error {
+	if !validLocation(pos) {
+		return ErrInvalidSeek
+	}
+
+	return p.call(func() error {
+		if !p.Playing {
+			p.Settings.Seek = pos
+			return nil
+		}
+		p.seekTo = pos
+		p.jumpTo(p.CurrentPlaylist.CurrentIndex)
+		p.stopTranscode()
+		return nil
+	})
+}
+
+// SetSettings replaces the transcoder settings, they're used from the next item or seek
+func (p *Player) SetSettings(settings TranscoderSettings) error {
+	return p.call(func() error {
+		p.Settings = settings
+		return nil
+	})
+}
+
+// runs on the player goroutine
+func (p *Player) pause() {
+	p.ManualStop = true
+	p.resume = false
+	p.stopTranscode()
+}
+
+// start plays the current item, skipping what can't be played
+// runs on the player goroutine
+func (p *Player) start() {
+	p.Playing = true
+	p.ManualStop = false
+
+	for {
+		if p.CurrentPlaylist.CurrentIndex >= len(p.CurrentPlaylist.Items) {
+			// At the end of the playlist
+			p.CurrentPlaylist.CurrentIndex = 0
+			if p.Mode.Shuffle && len(p.CurrentPlaylist.Items) > 0 {
+				p.CurrentPlaylist.CurrentIndex = p.shuffleFirst(false)
+			}
+			p.stopped()
+			return
+		}
+
+		if p.CurrentPlaylist.CurrentIndex < 0 {
+			p.CurrentPlaylist.CurrentIndex = 0
+		}
+
+		item := p.CurrentPlaylist.Items[p.CurrentPlaylist.CurrentIndex]
+		if !p.samePlay || item.Path != p.nowPlaying.Path {
+			p.plays++
+		}
+		p.samePlay = false
+		p.nowPlaying = item
+		// Validate the path
+		err := p.room.server.ValidatePath(item.Path)
+		if err == nil {
+			err = p.checkDJPresent(item)
+		}
+		if err == nil {
+			// Actually start playing the item
+			p.startSeg = p.StartSegment
+			p.StartSegment += 1000
+			err = p.PlayItem(item, p.Settings.Subs, p.startSeg)
+		}
+		if err != nil {
+			// Can't play it, skip
+			p.skipped++
+			if p.skipped > len(p.CurrentPlaylist.Items) {
+				// With repeat on we would go around forever if nothing is playable
+				log.Println("Nothing in the playlist is playable")
+				p.skipped = 0
+				p.stopped()
+				return
+			}
+			p.advance(true)
+			log.Println("Skipping element:", err)
+			go p.room.broadcastPlaylistStatus()
+			continue
+		}
+		p.skipped = 0
+		return
+	}
+}
+
+// stopped is called when playback stops
+// runs on the player goroutine
+func (p *Player) stopped() {
+	p.Playing = false
+	go p.room.broadcastPlaylistStatus()
+}
+
+// transcodeEnded carries on with whatever is next after a transcode ends
+// runs on the player goroutine
+func (p *Player) transcodeEnded(end transcodeEnd) {
+	if end.transcode != p.transcode {
+		return
+	}
+	p.transcode = nil
+	defer p.notifyIdle()
+
+	switch end.result.Reason {
+	case ExitFailed:
+		log.Println("ERROR:", end.result.Err)
+	case ExitNoSubtitles:
+		log.Println("Falling back to no subs")
+		err := p.PlayItem(p.nowPlaying, false, p.startSeg)
+		if err == nil {
+			return
+		}
+		log.Println("ERROR:", err)
+	}
+
+	// Reset the seek
+	seekTo := p.seekTo
+	p.seekTo = ""
+	p.Settings.Seek = seekTo
+	p.samePlay = seekTo != ""
+	p.StoppedPlaying = time.Now()
+	if p.ManualStop {
+		// Stop playback if there was a manual stop
+		// also set the seek to wherever we were -5 seconds to make sure we dont miss anything
+		duration := p.StoppedPlaying.Sub(p.StartedPlaying)
+		duration -= time.Duration(3) * time.Second
+		seconds := int(duration.Seconds())
+		if seconds > 0 {
+			stringed := StringLocation(int(duration.Seconds()))
+			p.Settings.Seek = stringed
+		}
+		p.samePlay = !p.jumped
+		if p.jumped {
+			// Paused right after skipping, start the new item from the beginning
+			p.jumped = false
+			p.Settings.Seek = seekTo
+		}
+
+		if p.resume {
+			p.resume = false
+			p.start()
+			return
+		}
+		p.stopped()
+		return
+	}
+
+	// Continue on with the next item in the playlist
+	stopAfter := p.Mode.StopAfter && !p.jumped
+	p.advance(false)
+	if stopAfter {
+		p.Mode.StopAfter = false
+		p.Playing = false
+		go func() {
+			p.room.broadcastNotification("Stopped after the item as requested", true)
+			p.room.broadcastPlaylistStatus()
+		}()
+		return
+	}
+	go p.room.broadcastPlaylistStatus()
+	p.start()
+}
+
+// runs on the player goroutine
+func (p *Player) transcodeJob(item PlaylistItem, subsEnabled bool, startSeg int) TranscodeJob {
+	profile, err := p.room.server.transcoderProfile(p.Settings.Profile)
+	if err != nil {
+		// Removed from the config since it was picked
+		log.Println("Transcoder profile", p.Settings.Profile, "is gone, using the default one")
+		profile = defaultProfiles[DefaultProfile]
+	}
+
+	return TranscodeJob{
+		Item:         item,
+		Settings:     p.Settings,
+		Profile:      profile,
+		Subs:         subsEnabled,
+		StartSegment: startSeg,
+		Output:       p.room.settings().HLSPlaylistPath,
+		Realtime:     true,
+	}
+}
+
+// FFmpegCommand returns the ffmpeg command the item at index would be played with right now, -1 for the current item
+func (p *Player) FFmpegCommand(index int) (*FFmpegCommand, error) {
+	var c *FFmpegCommand
+	err := p.call(func() error {
+		if index == -1 {
+			index = p.CurrentPlaylist.CurrentIndex
+		}
+		if index < 0 || index >= len(p.CurrentPlaylist.Items) {
+			return ErrInvalidPlaylistIndex
+		}
+		c = p.room.server.ffmpegCommand(p.transcodeJob(p.CurrentPlaylist.Items[index], p.Settings.Subs, p.StartSegment))
+		return nil
+	})
+	return c, err
+}
+
+// PlayItem starts transcoding the item, transcodeEnded is called when it ends
+// runs on the player goroutine
+func (p *Player) PlayItem(item PlaylistItem, subsEnabled bool, startSeg int) error {
+	t, err := p.room.server.transcoder.Start(p.transcodeJob(item, subsEnabled, startSeg))
+	if err != nil {
+		return err
+	}
+	p.transcode = t
+	p.subs = subsEnabled
+
+	p.StartedPlaying = time.Now()
+	if p.Settings.Seek != "" {
+		p.StartedPlaying = p.StartedPlaying.Add(time.Duration(LocationSeconds(p.Settings.Seek)) * time.Second * -1)
+	}
+	// Broadcast to new status
+	go p.room.broadcastStatus()
+
+	// Waited on in the background so the player can handle commands meanwhile
+	go func() {
+		select {
+		case res := <-t.Done():
+			select {
+			case p.ended <- transcodeEnd{transcode: t, result: res}:
+			case <-p.room.quit:
+			}
+		case <-p.room.quit:
+		}
+	}()
+	return nil
+}
+
+func ParseLocationStr(str string) (h, m, s int) {
+	split := strings.Split(str, ":")
+	if len(split) >= 3 {
+		h, _ = strconv.Atoi(split[0])
+		m, _ = strconv.Atoi(split[1])
+		s, _ = strconv.Atoi(split[2])
+	}
+	return
+}
+
+// LocationSeconds returns a h:m:s position in seconds
+func LocationSeconds(str string) int {
+	h, m, s := ParseLocationStr(str)
+	return h*3600 + m*60 + s
+}
+
+// validLocation returns true if str is a h:m:s position
+func validLocation(str string) bool {
+	split := strings.Split(str, ":")
+	if len(split) != 3 {
+		return false
+	}
+	for _, part := range split {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func StringLocation(s int) string {
+	h := (s / 60) / 60
+	m := (s / 60) % 60
+	ss := s % 60
+	return fmt.Sprintf("%d:%d:%d", h, m, ss)
+}
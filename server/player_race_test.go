@@ -0,0 +1,135 @@
+package server_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jogramming/fluffywatch/server"
+	"github.com/jogramming/fluffywatch/transcoderfake"
+)
+
+// Hammers the player from a lot of goroutines at once, run with -race to check only the player goroutine
+// touches the player
+func TestPlayerConcurrentCommands(t *testing.T) {
+	f := transcoderfake.New()
+	f.Default = transcoderfake.Step{Duration: 2 * time.Millisecond}
+	_, room, _ := newTestServer(t, f, "a.mkv", "b.mkv", "c.mkv", "d.mkv")
+	p := room.Player
+
+	// What each command is allowed to fail with
+	allowed := map[string][]error{
+		"play":     {server.ErrAlreadyPlaying},
+		"pause":    {server.ErrNotPlaying},
+		"next":     nil,
+		"prev":     nil,
+		"seek":     nil,
+		"jump":     nil,
+		"settings": nil,
+		"current":  nil,
+	}
+	commands := []string{"play", "pause", "next", "prev", "seek", "jump", "settings", "current"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				cmd := commands[(g+i)%len(commands)]
+				var err error
+				switch cmd {
+				case "play":
+					err = p.Play()
+				case "pause":
+					err = p.Pause()
+				case "next":
+					err = p.Next()
+				case "prev":
+					err = p.Prev()
+				case "seek":
+					err = p.Seek(fmt.Sprintf("0:0:%d", i))
+				case "jump":
+					err = p.Jump((g + i) % 4)
+				case "settings":
+					err = p.SetSettings(server.TranscoderSettings{ScaleWidth: 1280, MaxRate: 2000 + i, Preset: "veryfast"})
+				case "current":
+					// Can be past the end after a next on the last item, but never in the middle of changing
+					if item, ok := p.CurrentItem(); ok && item.Path == "" {
+						err = fmt.Errorf("empty item")
+					}
+				}
+				if err != nil && !containsErr(allowed[cmd], err) {
+					select {
+					case errs <- fmt.Errorf("%s: %s", cmd, err):
+					default:
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if err := p.Jump(99); err != server.ErrInvalidPlaylistIndex {
+		t.Errorf("Jump past the end = %v, want ErrInvalidPlaylistIndex", err)
+	}
+	if err := p.Seek("nope"); err != server.ErrInvalidSeek {
+		t.Errorf("Seek to nope = %v, want ErrInvalidSeek", err)
+	}
+
+	// Only one transcode runs at a time whatever order things came in
+	running := 0
+	for _, tc := range f.Started() {
+		if _, ended := tc.Ended(); !ended {
+			running++
+		}
+	}
+	if running > 1 {
+		t.Errorf("%d transcodes running at once", running)
+	}
+}
+
+func TestPlayerClosedRoom(t *testing.T) {
+	f := transcoderfake.New()
+	s, room, _ := newTestServer(t, f, "a.mkv")
+
+	if err := room.Player.Play(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WaitStarted(1, waitTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteRoom(room.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := room.Player.Play(); err != server.ErrRoomClosed {
+				t.Errorf("Play in a closed room = %v, want ErrRoomClosed", err)
+			}
+			if err := room.Player.Next(); err != server.ErrRoomClosed {
+				t.Errorf("Next in a closed room = %v, want ErrRoomClosed", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func containsErr(errs []error, err error) bool {
+	for _, e := range errs {
+		if e == err {
+			return true
+		}
+	}
+	return false
+}
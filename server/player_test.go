@@ -0,0 +1,218 @@
+package server_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jogramming/fluffywatch/server"
+	"github.com/jogramming/fluffywatch/transcoderfake"
+)
+
+const waitTimeout = 5 * time.Second
+
+// newTestServer starts a server transcoding with f and returns a room with an item for every name in
+// its playlist. Everything is cleaned up when the test ends
+func newTestServer(t *testing.T, f *transcoderfake.Transcoder, names ...string) (*server.Server, *server.Room, []string) {
+	dir, err := ioutil.TempDir("", "fluffywatch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, "media", name)
+		os.MkdirAll(filepath.Dir(paths[i]), 0775)
+		err = ioutil.WriteFile(paths[i], []byte("not really a video"), 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segDir := filepath.Join(dir, "segments")
+	s := server.New(
+		server.WithConfig(&server.Config{
+			Master:          "*",
+			Listen:          "127.0.0.1:0",
+			MediaRoots:      []string{filepath.Join(dir, "media")},
+			CacheDir:        filepath.Join(dir, "cache"),
+			SegmentDir:      segDir,
+			HLSPlaylistPath: filepath.Join(segDir, "stream.m3u8"),
+		}),
+		server.WithPlaylistPath(""),
+		server.WithTranscoder(f),
+	)
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Shutdown()
+		os.RemoveAll(dir)
+	})
+
+	room, err := s.CreateRoom(server.RoomConfig{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		err = room.Player.AddPlaylistItem(server.PlaylistItem{Path: p, Title: filepath.Base(p)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, room, paths
+}
+
+// waitStart waits for the nth transcode and checks it's of path
+func waitStart(t *testing.T, f *transcoderfake.Transcoder, n int, path string) *transcoderfake.Transcode {
+	t.Helper()
+	started, err := f.WaitStarted(n, waitTimeout)
+	if err != nil {
+		t.Fatalf("transcode %d: %s", n, err)
+	}
+	tc := started[n-1]
+	if got := tc.Job().Item.Path; got != path {
+		t.Fatalf("transcode %d is of %s, want %s", n, filepath.Base(got), filepath.Base(path))
+	}
+	return tc
+}
+
+func waitEnded(t *testing.T, tc *transcoderfake.Transcode) server.ExitReason {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		if reason, ok := tc.Ended(); ok {
+			return reason
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("transcode didn't end")
+	return 0
+}
+
+func TestPlayerPauseResume(t *testing.T) {
+	f := transcoderfake.New()
+	_, room, paths := newTestServer(t, f, "a.mkv", "b.mkv")
+	p := room.Player
+
+	if err := p.Pause(); err != server.ErrNotPlaying {
+		t.Errorf("Pause before playing = %v, want ErrNotPlaying", err)
+	}
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	first := waitStart(t, f, 1, paths[0])
+	if !first.Job().Realtime {
+		t.Error("playing isn't realtime")
+	}
+	if err := p.Play(); err != server.ErrAlreadyPlaying {
+		t.Errorf("Play while playing = %v, want ErrAlreadyPlaying", err)
+	}
+
+	if err := p.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if reason := waitEnded(t, first); reason != server.ExitStopped {
+		t.Errorf("paused transcode ended with %s, want stopped", reason)
+	}
+
+	// Resumes the same item
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	second := waitStart(t, f, 2, paths[0])
+	if second.Job().StartSegment <= first.Job().StartSegment {
+		t.Error("segment numbers should keep going up")
+	}
+}
+
+func TestPlayerNextPrev(t *testing.T) {
+	f := transcoderfake.New()
+	_, room, paths := newTestServer(t, f, "a.mkv", "b.mkv", "c.mkv")
+	p := room.Player
+
+	// Not playing, only moves the current item
+	if err := p.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if item, _ := p.CurrentItem(); item.Path != paths[1] {
+		t.Fatalf("current item is %s after next, want b.mkv", item.Title)
+	}
+	if err := p.Prev(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	a := waitStart(t, f, 1, paths[0])
+
+	if err := p.Next(); err != nil {
+		t.Fatal(err)
+	}
+	waitEnded(t, a)
+	b := waitStart(t, f, 2, paths[1])
+
+	if err := p.Prev(); err != nil {
+		t.Fatal(err)
+	}
+	waitEnded(t, b)
+	a = waitStart(t, f, 3, paths[0])
+
+	// Finishing by itself moves on to the next one
+	a.Finish()
+	waitStart(t, f, 4, paths[1])
+
+	if err := p.Jump(2); err != nil {
+		t.Fatal(err)
+	}
+	waitStart(t, f, 5, paths[2])
+	if err := p.Jump(3); err != server.ErrInvalidPlaylistIndex {
+		t.Errorf("Jump past the end = %v, want ErrInvalidPlaylistIndex", err)
+	}
+}
+
+func TestPlayerSubtitleFallback(t *testing.T) {
+	f := transcoderfake.New(transcoderfake.Step{NoSubtitles: true})
+	_, room, paths := newTestServer(t, f, "a.mkv")
+	p := room.Player
+
+	err := p.SetSettings(server.TranscoderSettings{ScaleWidth: 1280, MaxRate: 2000, Preset: "veryfast", Subs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Play(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := waitStart(t, f, 1, paths[0])
+	if !first.Job().Subs {
+		t.Fatal("first transcode should have subs")
+	}
+	if reason := waitEnded(t, first); reason != server.ExitNoSubtitles {
+		t.Fatalf("first transcode ended with %s, want no subtitles", reason)
+	}
+
+	second := waitStart(t, f, 2, paths[0])
+	if second.Job().Subs {
+		t.Error("second transcode should fall back to no subs")
+	}
+}
+
+func TestPlayerSkipsFailedStart(t *testing.T) {
+	f := transcoderfake.New(transcoderfake.Step{StartErr: errors.New("no ffmpeg")})
+	_, room, paths := newTestServer(t, f, "a.mkv", "b.mkv")
+
+	if err := room.Player.Play(); err != nil {
+		t.Fatal(err)
+	}
+	// The failed start isn't in Started, so b is the first one
+	waitStart(t, f, 1, paths[1])
+	if item, _ := room.Player.CurrentItem(); item.Path != paths[1] {
+		t.Errorf("current item is %s, want b.mkv", item.Title)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	PlayerStateFile = "player.json"
+
+	// How long a transcode gets to stop on its own when closing a room before it's killed
+	TranscodeStopTimeout = 5 * time.Second
+)
+
+// playerState is what's saved when the room closes, so a restart picks up where it left off
+type playerState struct {
+	Playlist     Playlist           `json:"playlist"`
+	Settings     TranscoderSettings `json:"settings"` // Seek is where it was stopped
+	Mode         PlaybackMode       `json:"mode"`
+	StartSegment int                `json:"startSegment"` // So segment numbers keep going up for players still around
+
+	// Not in the playlist and mode json since that's sent to viewers
+	Owners       []string `json:"owners"` // Owner of each playlist item, for the DJ rotation
+	DJs          []string `json:"djs"`
+	ShuffleSeed  uint64   `json:"shuffleSeed"`
+	ShuffleStart uint64   `json:"shuffleStart"`
+}
+
+// saveState writes the playlist, settings and position to path. In channel mode it's the playlist from
+// before the channel that's saved, the lineup is built again when the channel starts back up
+func (p *Player) saveState(path string) error {
+	stashed, stashedMode, stashedSeek, channelOn := p.room.Channel.stash()
+
+	var state playerState
+	p.do(func() {
+		playlist := p.CurrentPlaylist
+		state = playerState{
+			Settings:     p.Settings,
+			Mode:         p.Mode,
+			StartSegment: p.StartSegment,
+		}
+		if channelOn {
+			playlist = stashed
+			state.Mode = stashedMode
+			state.Settings.Seek = stashedSeek
+		}
+
+		state.Playlist = playlist
+		state.Playlist.Items = make([]PlaylistItem, len(playlist.Items))
+		copy(state.Playlist.Items, playlist.Items)
+		state.Owners = make([]string, len(playlist.Items))
+		for i, item := range playlist.Items {
+			state.Owners[i] = item.owner
+		}
+		state.DJs = append([]string(nil), playlist.djs...)
+		state.ShuffleSeed = state.Mode.shuffleSeed
+		state.ShuffleStart = state.Mode.shuffleStart
+	})
+
+	marshalled, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0775)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, marshalled, 0664)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadState restores what saveState saved, if there's nothing saved it does nothing
+func (p *Player) loadState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var state playerState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if state.Playlist.Items == nil {
+		state.Playlist.Items = make([]PlaylistItem, 0)
+	}
+	// Saved before owners were, nobody owns anything then
+	if len(state.Owners) == len(state.Playlist.Items) {
+		for i := range state.Playlist.Items {
+			state.Playlist.Items[i].owner = state.Owners[i]
+		}
+	}
+	state.Playlist.djs = state.DJs
+	state.Mode.shuffleSeed = state.ShuffleSeed
+	state.Mode.shuffleStart = state.ShuffleStart
+
+	p.do(func() {
+		p.CurrentPlaylist = state.Playlist
+		p.Settings = state.Settings
+		p.Mode = state.Mode
+		p.StartSegment = state.StartSegment
+	})
+	log.Printf("Restored %d playlist items from %s\n", len(state.Playlist.Items), path)
+	return nil
+}
+
+// stopAndWait stops playback and waits for the transcode to end, so the seek has where it stopped.
+// It's killed if it doesn't stop within timeout
+func (p *Player) stopAndWait(timeout time.Duration) {
+	idle := make(chan struct{})
+	p.do(func() {
+		p.setSleepTimer(0)
+		if p.Playing {
+			p.pause()
+		}
+		p.idleWaiters = append(p.idleWaiters, idle)
+		p.notifyIdle()
+	})
+
+	select {
+	case <-idle:
+		return
+	case <-time.After(timeout):
+	}
+
+	log.Println("Transcode didn't stop in time, killing it")
+	p.do(func() {
+		if p.transcode != nil {
+			p.transcode.Kill()
+		}
+	})
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		log.Println("Gave up waiting for the transcode to end")
+	}
+}
+
+// notifyIdle lets stopAndWait know once nothing is transcoding
+// runs on the player goroutine
+func (p *Player) notifyIdle() {
+	if p.transcode != nil {
+		return
+	}
+	for _, c := range p.idleWaiters {
+		close(c)
+	}
+	p.idleWaiters = nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveStateKeepsPlaylistUnderChannel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluffywatch-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New(WithConfig(&Config{
+		Listen:   "127.0.0.1:0",
+		CacheDir: filepath.Join(dir, "cache"),
+	}), WithPlaylistPath(""))
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	room := s.rooms[MainRoom]
+	p := room.Player
+
+	mine := Playlist{
+		Items:        []PlaylistItem{{Path: "/a.mkv", owner: "alice"}, {Path: "/b.mkv", owner: "bob"}},
+		CurrentIndex: 1,
+		Rotation:     true,
+		djs:          []string{"bob", "alice"},
+	}
+	mode := PlaybackMode{Repeat: RepeatAll, Shuffle: true, shuffleSeed: 42, shuffleStart: 7}
+
+	// Like Channel.Start does it
+	room.Channel.Lock()
+	room.Channel.Active = true
+	room.Channel.stashed = mine
+	room.Channel.stashedMode = mode
+	room.Channel.stashedSeek = "0:10:0"
+	room.Channel.Unlock()
+	p.do(func() {
+		p.CurrentPlaylist = Playlist{Items: []PlaylistItem{{Path: "/lineup.mkv"}}}
+		p.Mode = PlaybackMode{Repeat: RepeatAll}
+		p.Settings.Seek = "0:0:5"
+	})
+
+	path := filepath.Join(dir, "player.json")
+	if err = p.saveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	room.Channel.Lock()
+	room.Channel.Active = false
+	room.Channel.Unlock()
+	p.do(func() {
+		p.CurrentPlaylist = Playlist{}
+		p.Mode = PlaybackMode{}
+	})
+	if err = p.loadState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	p.do(func() {
+		got := p.CurrentPlaylist
+		if len(got.Items) != 2 || got.Items[1].Path != "/b.mkv" || got.CurrentIndex != 1 || !got.Rotation {
+			t.Fatalf("restored %+v, want the playlist from before the channel", got)
+		}
+		if got.Items[0].owner != "alice" || got.Items[1].owner != "bob" {
+			t.Errorf("owners are %q and %q", got.Items[0].owner, got.Items[1].owner)
+		}
+		if len(got.djs) != 2 || got.djs[0] != "bob" {
+			t.Errorf("djs are %q", got.djs)
+		}
+		if p.Mode != mode {
+			t.Errorf("mode is %+v, want %+v", p.Mode, mode)
+		}
+		if p.Settings.Seek != "0:10:0" {
+			t.Errorf("seek is %q, want where it was before the channel", p.Settings.Seek)
+		}
+	})
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"sort"
+)
+
+var ErrInvalidPlaylistIndex = errors.New("Invalid playlist index")
+
+// validIndexes sorts and dedupes the indexes, and checks that they're inside the playlist
+// runs on the player goroutine
+func (p *Player) validIndexes(indexes []int) ([]int, error) {
+	if len(indexes) < 1 {
+		return nil, errors.New("No items selected")
+	}
+
+	sorted := make([]int, 0, len(indexes))
+	seen := make(map[int]bool)
+	for _, i := range indexes {
+		if i < 0 || i >= len(p.CurrentPlaylist.Items) {
+			return nil, ErrInvalidPlaylistIndex
+		}
+		if !seen[i] {
+			seen[i] = true
+			sorted = append(sorted, i)
+		}
+	}
+	sort.Ints(sorted)
+	return sorted, nil
+}
+
+// reorder rebuilds the playlist from order, a list of indexes into the old playlist
+// CurrentIndex follows the item it pointed at, if that item is not in order it's left pointing at
+// whatever took its place and false is returned
+// runs on the player goroutine
+func (p *Player) reorder(order []int) bool {
+	old := p.CurrentPlaylist.Items
+	current := p.CurrentPlaylist.CurrentIndex
+
+	items := make([]PlaylistItem, 0, len(order))
+	newCurrent := -1
+	for _, i := range order {
+		if i == current {
+			newCurrent = len(items)
+		}
+		items = append(items, old[i])
+	}
+	p.CurrentPlaylist.Items = items
+
+	if newCurrent != -1 {
+		p.CurrentPlaylist.CurrentIndex = newCurrent
+		return true
+	}
+
+	// Count the kept items that were before the current one
+	before := 0
+	for _, i := range order {
+		if i < current {
+			before++
+		}
+	}
+	p.CurrentPlaylist.CurrentIndex = before
+	return false
+}
+
+// RemoveItems removes the items at indexes, if the playing item is removed playback skips to
+// the item after it
+func (p *Player) RemoveItems(by string, indexes []int) ([]PlaylistItem, error) {
+	var removed []PlaylistItem
+	err := p.call(func() error {
+		indexes, err := p.validIndexes(indexes)
+		if err != nil {
+			return err
+		}
+
+		p.recordChange(PlaylistActionRemove, by)
+
+		remove := make(map[int]bool)
+		for _, i := range indexes {
+			remove[i] = true
+		}
+
+		currentPath := p.currentPath()
+		removed = make([]PlaylistItem, 0, len(indexes))
+		order := make([]int, 0, len(p.CurrentPlaylist.Items)-len(indexes))
+		for i, item := range p.CurrentPlaylist.Items {
+			if remove[i] {
+				removed = append(removed, item)
+			} else {
+				order = append(order, i)
+			}
+		}
+
+		if !p.reorder(order) {
+			// The current item is gone, dont resume the next one from where it was paused
+			p.Settings.Seek = ""
+			if p.Playing {
+				p.jumpTo(p.upNext(currentPath, -1, p.CurrentPlaylist.CurrentIndex, true))
+				p.stopTranscode()
+			}
+		}
+		p.rebuildRotation()
+		return nil
+	})
+	return removed, err
+}
+
+// MoveItems moves the items at indexes so they're placed before the item that was at index
+// before, keeping their order. before being the length of the playlist moves them to the end
+func (p *Player) MoveItems(by string, indexes []int, before int) error {
+	return p.call(func() error {
+		indexes, err := p.validIndexes(indexes)
+		if err != nil {
+			return err
+		}
+		if before < 0 || before > len(p.CurrentPlaylist.Items) {
+			return ErrInvalidPlaylistIndex
+		}
+
+		p.recordChange(PlaylistActionMove, by)
+		p.moveItems(indexes, before)
+		return nil
+	})
+}
+
+// MoveItemsNext moves the items at indexes to play after the current item
+func (p *Player) MoveItemsNext(by string, indexes []int) error {
+	return p.call(func() error {
+		indexes, err := p.validIndexes(indexes)
+		if err != nil {
+			return err
+		}
+
+		started := p.currentStarted()
+
+		// Moving the playing item after itself makes no sense, leave it where it is
+		filtered := indexes[:0]
+		for _, i := range indexes {
+			if !started || i != p.CurrentPlaylist.CurrentIndex {
+				filtered = append(filtered, i)
+			}
+		}
+		if len(filtered) < 1 {
+			return nil
+		}
+
+		p.recordChange(PlaylistActionMove, by)
+		before := p.nextIndex()
+		p.moveItems(filtered, before)
+
+		if !started {
+			// The current item hasn't started, so point at the first moved item to play it next
+			pos := before
+			for _, i := range filtered {
+				if i < before {
+					pos--
+				}
+			}
+			p.CurrentPlaylist.CurrentIndex = pos
+		}
+		return nil
+	})
+}
+
+// runs on the player goroutine, the caller must have validated the arguments
+func (p *Player) moveItems(indexes []int, before int) {
+	selected := make(map[int]bool)
+	for _, i := range indexes {
+		selected[i] = true
+	}
+
+	order := make([]int, 0, len(p.CurrentPlaylist.Items))
+	for i := range p.CurrentPlaylist.Items {
+		if i == before {
+			order = append(order, indexes...)
+		}
+		if !selected[i] {
+			order = append(order, i)
+		}
+	}
+	if before == len(p.CurrentPlaylist.Items) {
+		order = append(order, indexes...)
+	}
+
+	p.reorder(order)
+}
+
+// AppendItems adds the items to the end of the playlist
+func (p *Player) AppendItems(by string, items []PlaylistItem) {
+	p.do(func() {
+		p.recordChange(PlaylistActionAdd, by)
+		p.CurrentPlaylist.Items = append(p.CurrentPlaylist.Items, items...)
+		p.rebuildRotation()
+	})
+}
+
+// InsertNext inserts the items to play after the current item
+// in rotation mode it's the rotation that decides, so they're just added to their owners queues
+func (p *Player) InsertNext(by string, items []PlaylistItem) {
+	p.do(func() {
+		p.recordChange(PlaylistActionAdd, by)
+		p.insertItems(p.nextIndex(), items)
+		p.rebuildRotation()
+		// If the current item hasn't started CurrentIndex now points at the first inserted item, which is what we want
+	})
+}
+
+// insertItems inserts the items before pos, CurrentIndex is left alone
+// runs on the player goroutine
+func (p *Player) insertItems(pos int, items []PlaylistItem) {
+	newItems := make([]PlaylistItem, 0, len(p.CurrentPlaylist.Items)+len(items))
+	newItems = append(newItems, p.CurrentPlaylist.Items[:pos]...)
+	newItems = append(newItems, items...)
+	newItems = append(newItems, p.CurrentPlaylist.Items[pos:]...)
+	p.CurrentPlaylist.Items = newItems
+}
+
+// Clear removes everything from the playlist, the playing item keeps playing
+func (p *Player) Clear(by string) {
+	p.do(func() {
+		p.recordChange(PlaylistActionClear, by)
+		p.CurrentPlaylist.Items = make([]PlaylistItem, 0)
+		p.Settings.Seek = ""
+		// So the first item added plays next
+		p.jumpTo(0)
+	})
+}
+
+// nextIndex returns where the next item to play should go, that's after the current item if it's
+// playing or paused midway, otherwise the current item hasn't started and it goes in front of it
+// runs on the player goroutine
+func (p *Player) nextIndex() int {
+	pos := p.CurrentPlaylist.CurrentIndex
+	if pos < 0 {
+		pos = 0
+	}
+	if p.currentStarted() {
+		pos++
+	}
+	if pos > len(p.CurrentPlaylist.Items) {
+		pos = len(p.CurrentPlaylist.Items)
+	}
+	return pos
+}
+
+// currentStarted returns true if the current item is playing or was paused midway
+// runs on the player goroutine
+func (p *Player) currentStarted() bool {
+	return p.Playing || p.Settings.Seek != ""
+}
+
+// runs on the player goroutine
+func (p *Player) stopTranscode() {
+	if p.transcode != nil {
+		p.transcode.Stop()
+	}
+}
+
+type PlaylistRemoveRequest struct {
+	Indexes []int `json:"indexes"`
+}
+
+func (s *Server) handlePlaylistRemove(session fnet.Session, req PlaylistRemoveRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	name, _ := session.Data.GetString("name")
+	removed, err := room.Player.RemoveItems(name, req.Indexes)
+	if s.checkError(session, err, EvtPlaylistRemove) {
+		return
+	}
+
+	if len(removed) == 1 {
+		room.broadcastNotification(fmt.Sprintf("%s Removed %s from the playlist", name, removed[0].Title), true)
+	} else {
+		room.broadcastNotification(fmt.Sprintf("%s Removed %d items from the playlist", name, len(removed)), true)
+	}
+	room.broadcastPlaylistStatus()
+}
+
+type PlaylistMoveRequest struct {
+	Indexes []int `json:"indexes"`
+	Before  int   `json:"before"` // The items are placed before this index, the playlist length moves them to the end
+	Next    bool  `json:"next"`   // Play them after the current item instead, Before is ignored
+}
+
+func (s *Server) handlePlaylistMove(session fnet.Session, req PlaylistMoveRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	name, _ := session.Data.GetString("name")
+
+	var err error
+	if req.Next {
+		err = room.Player.MoveItemsNext(name, req.Indexes)
+	} else {
+		err = room.Player.MoveItems(name, req.Indexes, req.Before)
+	}
+	if s.checkError(session, err, EvtPlaylistMove) {
+		return
+	}
+
+	room.broadcastPlaylistStatus()
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlaylistEditCurrentIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluffywatch-edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New(WithConfig(&Config{
+		Listen:   "127.0.0.1:0",
+		CacheDir: filepath.Join(dir, "cache"),
+	}), WithPlaylistPath(""))
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	p := s.rooms[MainRoom].Player
+
+	// The playlist is a b c d e with c current. Started is paused midway through c, playing is c playing
+	const (
+		notStarted = iota
+		started
+		playing
+	)
+	cases := []struct {
+		name      string
+		state     int
+		edit      func() error
+		want      string
+		wantIndex int
+	}{
+		{"remove before", notStarted, func() error { _, err := p.RemoveItems("", []int{0}); return err }, "bcde", 1},
+		{"remove after", notStarted, func() error { _, err := p.RemoveItems("", []int{3, 4}); return err }, "abc", 2},
+		{"remove current", notStarted, func() error { _, err := p.RemoveItems("", []int{2}); return err }, "abde", 2},
+		{"remove current and after", notStarted, func() error { _, err := p.RemoveItems("", []int{4, 2, 3, 2}); return err }, "ab", 2},
+		{"remove paused current", started, func() error { _, err := p.RemoveItems("", []int{2}); return err }, "abde", 2},
+		{"remove playing current", playing, func() error { _, err := p.RemoveItems("", []int{1, 2}); return err }, "ade", 1},
+		{"remove invalid", notStarted, func() error { _, err := p.RemoveItems("", []int{5}); return err }, "abcde", 2},
+
+		{"move before to end", notStarted, func() error { return p.MoveItems("", []int{0}, 5) }, "bcdea", 1},
+		{"move after to start", notStarted, func() error { return p.MoveItems("", []int{4}, 0) }, "eabcd", 3},
+		{"move current", notStarted, func() error { return p.MoveItems("", []int{2}, 0) }, "cabde", 0},
+		{"move around current", notStarted, func() error { return p.MoveItems("", []int{0, 4}, 3) }, "bcaed", 1},
+
+		{"play next not started", notStarted, func() error { return p.MoveItemsNext("", []int{4}) }, "abecd", 2},
+		{"play next several not started", notStarted, func() error { return p.MoveItemsNext("", []int{0, 4}) }, "baecd", 1},
+		{"play next started", started, func() error { return p.MoveItemsNext("", []int{4}) }, "abced", 2},
+		{"play next with current", playing, func() error { return p.MoveItemsNext("", []int{2, 0}) }, "bcade", 1},
+		{"play next only current", started, func() error { return p.MoveItemsNext("", []int{2}) }, "abcde", 2},
+		{"insert next not started", notStarted, func() error { p.InsertNext("", []PlaylistItem{{Title: "x"}}); return nil }, "abxcde", 2},
+		{"insert next started", started, func() error { p.InsertNext("", []PlaylistItem{{Title: "x"}}); return nil }, "abcxde", 2},
+	}
+
+	for _, c := range cases {
+		p.do(func() {
+			p.CurrentPlaylist = Playlist{CurrentIndex: 2}
+			for _, name := range "abcde" {
+				p.CurrentPlaylist.Items = append(p.CurrentPlaylist.Items, PlaylistItem{Path: "/" + string(name), Title: string(name)})
+			}
+			p.Settings.Seek = ""
+			p.Playing = c.state == playing
+			p.nowPlaying = p.CurrentPlaylist.Items[2]
+			p.jumped = false
+			if c.state == started {
+				p.Settings.Seek = "0:1:0"
+			}
+		})
+
+		c.edit()
+
+		p.do(func() {
+			titles := make([]string, 0, len(p.CurrentPlaylist.Items))
+			for _, item := range p.CurrentPlaylist.Items {
+				titles = append(titles, item.Title)
+			}
+			if got := strings.Join(titles, ""); got != c.want {
+				t.Errorf("%s: playlist is %s, want %s", c.name, got, c.want)
+			}
+			if p.CurrentPlaylist.CurrentIndex != c.wantIndex {
+				t.Errorf("%s: current index is %d, want %d", c.name, p.CurrentPlaylist.CurrentIndex, c.wantIndex)
+			}
+			if strings.HasPrefix(c.name, "remove") && strings.Contains(c.name, "current") && p.Settings.Seek != "" {
+				t.Errorf("%s: seek of the removed item was kept", c.name)
+			}
+			p.Playing = false
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Supported playlist document formats
+const (
+	PlaylistFormatM3U  = "m3u"
+	PlaylistFormatPLS  = "pls"
+	PlaylistFormatXSPF = "xspf"
+	PlaylistFormatJSON = "json"
+)
+
+var PlaylistFormats = []string{PlaylistFormatM3U, PlaylistFormatPLS, PlaylistFormatXSPF, PlaylistFormatJSON}
+
+// Mime types used when exporting
+var playlistMimeTypes = map[string]string{
+	PlaylistFormatM3U:  "audio/x-mpegurl",
+	PlaylistFormatPLS:  "audio/x-scpls",
+	PlaylistFormatXSPF: "application/xspf+xml",
+	PlaylistFormatJSON: "application/json",
+}
+
+func ValidatePlaylistFormat(format string) error {
+	for _, f := range PlaylistFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return errors.New("Unknown playlist format, must be one of: " + strings.Join(PlaylistFormats, ", "))
+}
+
+// DetectPlaylistFormat guesses the format from the file extension, falling back to sniffing the contents
+// A plain list of paths is treated as m3u
+func DetectPlaylistFormat(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8":
+		return PlaylistFormatM3U
+	case ".pls":
+		return PlaylistFormatPLS
+	case ".xspf":
+		return PlaylistFormatXSPF
+	case ".json":
+		return PlaylistFormatJSON
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return PlaylistFormatJSON
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return PlaylistFormatXSPF
+	case len(trimmed) >= 10 && strings.EqualFold(string(trimmed[:10]), "[playlist]"):
+		return PlaylistFormatPLS
+	}
+	return PlaylistFormatM3U
+}
+
+// ParsePlaylist parses a playlist document, relative paths are resolved against baseDir
+func ParsePlaylist(data []byte, format, baseDir string) ([]PlaylistItem, error) {
+	switch format {
+	case PlaylistFormatM3U:
+		return parseM3U(data, baseDir)
+	case PlaylistFormatPLS:
+		return parsePLS(data, baseDir)
+	case PlaylistFormatXSPF:
+		return parseXSPF(data, baseDir)
+	case PlaylistFormatJSON:
+		return parseJSONPlaylist(data, baseDir)
+	}
+	return nil, ValidatePlaylistFormat(format)
+}
+
+// WritePlaylist writes the items out in the specified format
+func WritePlaylist(w io.Writer, format string, items []PlaylistItem) error {
+	switch format {
+	case PlaylistFormatM3U:
+		return writeM3U(w, items)
+	case PlaylistFormatPLS:
+		return writePLS(w, items)
+	case PlaylistFormatXSPF:
+		return writeXSPF(w, items)
+	case PlaylistFormatJSON:
+		return writeJSONPlaylist(w, items)
+	}
+	return ValidatePlaylistFormat(format)
+}
+
+// isPlaylistURL returns true if the entry is a url like http://, those are kept as they are.
+// Single letter schemes are windows drive letters
+func isPlaylistURL(entry string) bool {
+	u, err := url.Parse(entry)
+	return err == nil && len(u.Scheme) > 1 && u.Scheme != "file"
+}
+
+// resolvePlaylistPath turns a playlist entry into an absolute local path, urls other than file:// are
+// left alone
+func resolvePlaylistPath(entry, baseDir string) string {
+	entry = strings.TrimSpace(entry)
+	if isPlaylistURL(entry) {
+		return entry
+	}
+	if strings.HasPrefix(entry, "file://") {
+		u, err := url.Parse(entry)
+		if err == nil {
+			entry = u.Path
+		}
+	}
+
+	entry = filepath.FromSlash(entry)
+	if !filepath.IsAbs(entry) && baseDir != "" {
+		entry = filepath.Join(baseDir, entry)
+	}
+	return filepath.Clean(entry)
+}
+
+func newPathItem(path string) PlaylistItem {
+	return PlaylistItem{
+		Kind:     ITEMTYPEMOVIE,
+		Path:     path,
+		Duration: 0,
+		Title:    filepath.Base(path),
+	}
+}
+
+func parseM3U(data []byte, baseDir string) ([]PlaylistItem, error) {
+	items := make([]PlaylistItem, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Split(bufio.ScanLines)
+
+	// Info from the last #EXTINF line, applied to the next path
+	var extTitle string
+	extDuration := -1
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		line = strings.TrimPrefix(line, "\ufeff")
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(line, "#EXTINF:") {
+				info := strings.TrimPrefix(line, "#EXTINF:")
+				durStr := info
+				extTitle = ""
+				if comma := strings.Index(info, ","); comma != -1 {
+					durStr = info[:comma]
+					extTitle = strings.TrimSpace(info[comma+1:])
+				}
+
+				// Strip any attributes (#EXTINF:123 tvg-id="..",Title)
+				if space := strings.Index(durStr, " "); space != -1 {
+					durStr = durStr[:space]
+				}
+				extDuration, _ = strconv.Atoi(strings.TrimSpace(durStr))
+			}
+			// Everything else is a comment or a directive we dont care about
+			continue
+		}
+
+		item := newPathItem(resolvePlaylistPath(line, baseDir))
+		if extTitle != "" {
+			item.Title = extTitle
+		}
+		if extDuration > 0 {
+			item.Duration = extDuration * 1000
+		}
+		items = append(items, item)
+
+		extTitle = ""
+		extDuration = -1
+	}
+
+	return items, scanner.Err()
+}
+
+func writeM3U(w io.Writer, items []PlaylistItem) error {
+	if err := checkPlaylistPaths(items); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#EXTM3U")
+	for _, item := range items {
+		duration := -1
+		if item.Duration > 0 {
+			duration = item.Duration / 1000
+		}
+		fmt.Fprintf(bw, "#EXTINF:%d,%s\n", duration, playlistSafeLine(item.Title))
+		fmt.Fprintln(bw, item.Path)
+	}
+	return bw.Flush()
+}
+
+func parsePLS(data []byte, baseDir string) ([]PlaylistItem, error) {
+	type plsEntry struct {
+		file   string
+		title  string
+		length int
+	}
+	entries := make(map[int]*plsEntry)
+
+	getEntry := func(n int) *plsEntry {
+		e, ok := entries[n]
+		if !ok {
+			e = &plsEntry{length: -1}
+			entries[n] = e
+		}
+		return e
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq == -1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:eq]))
+		value := strings.TrimSpace(line[eq+1:])
+
+		var field string
+		for _, prefix := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, prefix) {
+				field = prefix
+				break
+			}
+		}
+		if field == "" {
+			// numberofentries, version etc
+			continue
+		}
+
+		n, err := strconv.Atoi(key[len(field):])
+		if err != nil {
+			continue
+		}
+
+		e := getEntry(n)
+		switch field {
+		case "file":
+			e.file = value
+		case "title":
+			e.title = value
+		case "length":
+			e.length, _ = strconv.Atoi(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]int, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	items := make([]PlaylistItem, 0, len(keys))
+	for _, k := range keys {
+		e := entries[k]
+		if e.file == "" {
+			continue
+		}
+		item := newPathItem(resolvePlaylistPath(e.file, baseDir))
+		if e.title != "" {
+			item.Title = e.title
+		}
+		if e.length > 0 {
+			item.Duration = e.length * 1000
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func writePLS(w io.Writer, items []PlaylistItem) error {
+	if err := checkPlaylistPaths(items); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "[playlist]")
+	for i, item := range items {
+		n := i + 1
+		length := -1
+		if item.Duration > 0 {
+			length = item.Duration / 1000
+		}
+		fmt.Fprintf(bw, "File%d=%s\n", n, item.Path)
+		fmt.Fprintf(bw, "Title%d=%s\n", n, playlistSafeLine(item.Title))
+		fmt.Fprintf(bw, "Length%d=%d\n", n, length)
+	}
+	fmt.Fprintf(bw, "NumberOfEntries=%d\n", len(items))
+	fmt.Fprintln(bw, "Version=2")
+	return bw.Flush()
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	TrackNum int    `xml:"trackNum,omitempty"`
+	Duration int    `xml:"duration,omitempty"` // milliseconds
+}
+
+func parseXSPF(data []byte, baseDir string) ([]PlaylistItem, error) {
+	var doc struct {
+		Tracks []xspfTrack `xml:"trackList>track"`
+	}
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, errors.New("Failed parsing xspf playlist: " + err.Error())
+	}
+
+	items := make([]PlaylistItem, 0, len(doc.Tracks))
+	for _, t := range doc.Tracks {
+		if strings.TrimSpace(t.Location) == "" {
+			continue
+		}
+		item := newPathItem(resolvePlaylistPath(t.Location, baseDir))
+		if t.Title != "" {
+			item.Title = t.Title
+		}
+		if t.Duration > 0 {
+			item.Duration = t.Duration
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func writeXSPF(w io.Writer, items []PlaylistItem) error {
+	doc := xspfPlaylist{
+		Version: "1",
+		Title:   "fluffywatch",
+		Tracks:  make([]xspfTrack, 0, len(items)),
+	}
+
+	for _, item := range items {
+		location := item.Path
+		if !isPlaylistURL(location) {
+			location = (&url.URL{Scheme: "file", Path: filepath.ToSlash(item.Path)}).String()
+		}
+		track := xspfTrack{
+			Location: location,
+			Title:    item.Title,
+			Duration: item.Duration,
+		}
+		if item.Kind == ITEMTYPETV {
+			track.Album = item.ShowTitle
+			track.TrackNum = item.Episode
+		}
+		doc.Tracks = append(doc.Tracks, track)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "\t")
+	return encoder.Encode(doc)
+}
+
+// Our own format is just the playlist as sent to clients
+func parseJSONPlaylist(data []byte, baseDir string) ([]PlaylistItem, error) {
+	var pl Playlist
+	err := json.Unmarshal(data, &pl)
+	if err != nil {
+		return nil, errors.New("Failed parsing json playlist: " + err.Error())
+	}
+
+	items := make([]PlaylistItem, 0, len(pl.Items))
+	for _, item := range pl.Items {
+		if item.Path == "" {
+			continue
+		}
+		item.Path = resolvePlaylistPath(item.Path, baseDir)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func writeJSONPlaylist(w io.Writer, items []PlaylistItem) error {
+	pl := Playlist{
+		Items: items,
+	}
+	marshalled, err := json.MarshalIndent(pl, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(marshalled)
+	return err
+}
+
+// Titles end up on a single line in m3u and pls
+func playlistSafeLine(in string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(in)
+}
+
+// checkPlaylistPaths returns an error if a path can't be written on a single line, unlike with titles
+// changing it would point somewhere else
+func checkPlaylistPaths(items []PlaylistItem) error {
+	for _, item := range items {
+		if strings.ContainsAny(item.Path, "\r\n") {
+			return fmt.Errorf("%q has a line break in its path, it can't be exported as m3u or pls", item.Title)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPlaylistRoundTrip(t *testing.T) {
+	items := []PlaylistItem{
+		{Kind: ITEMTYPEMOVIE, Path: "/media/movies/Some Movie (2001).mkv", Title: "Some Movie", Duration: 5400000},
+		{Kind: ITEMTYPEMOVIE, Path: "/media/odd, name; here.mkv", Title: "Two\r\nlines", Duration: 61000},
+		{Kind: ITEMTYPEMOVIE, Path: "http://example.com/stream.m3u8", Title: "A stream"},
+	}
+
+	for _, format := range PlaylistFormats {
+		var buf bytes.Buffer
+		if err := WritePlaylist(&buf, format, items); err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if got := DetectPlaylistFormat("", buf.Bytes()); got != format {
+			t.Errorf("%s: detected as %s", format, got)
+		}
+
+		parsed, err := ParsePlaylist(buf.Bytes(), format, "/elsewhere")
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if len(parsed) != len(items) {
+			t.Fatalf("%s: got %d items back, want %d", format, len(parsed), len(items))
+		}
+
+		for i, item := range parsed {
+			if item.Path != items[i].Path {
+				t.Errorf("%s: item %d path is %q, want %q", format, i, item.Path, items[i].Path)
+			}
+			if item.Duration != items[i].Duration {
+				t.Errorf("%s: item %d duration is %d, want %d", format, i, item.Duration, items[i].Duration)
+			}
+		}
+
+		// Line breaks in titles only survive where the format can hold them
+		wantTitle := "Two  lines"
+		if format == PlaylistFormatXSPF || format == PlaylistFormatJSON {
+			wantTitle = items[1].Title
+		}
+		if parsed[1].Title != wantTitle {
+			t.Errorf("%s: title is %q, want %q", format, parsed[1].Title, wantTitle)
+		}
+	}
+}
+
+func TestPlaylistLineBreakInPath(t *testing.T) {
+	items := []PlaylistItem{{Path: "/media/a.mkv\n#EXTINF:-1,Injected\n/etc/passwd", Title: "a"}}
+	for _, format := range []string{PlaylistFormatM3U, PlaylistFormatPLS} {
+		var buf bytes.Buffer
+		if err := WritePlaylist(&buf, format, items); err == nil {
+			t.Errorf("%s: wrote a path with line breaks in it:\n%s", format, buf.String())
+		}
+	}
+}
+
+func TestResolvePlaylistPath(t *testing.T) {
+	cases := []struct {
+		entry, want string
+	}{
+		{"a.mkv", "/base/a.mkv"},
+		{"sub/../b.mkv", "/base/b.mkv"},
+		{"/abs/c.mkv", "/abs/c.mkv"},
+		{"file:///abs/with%20space.mkv", "/abs/with space.mkv"},
+		{"http://example.com/a.mkv", "http://example.com/a.mkv"},
+		{"  https://example.com/b.m3u8 ", "https://example.com/b.m3u8"},
+		{"rtmp://example.com/live", "rtmp://example.com/live"},
+	}
+	for _, c := range cases {
+		if got := resolvePlaylistPath(c.entry, "/base"); got != c.want {
+			t.Errorf("resolvePlaylistPath(%q) = %q, want %q", c.entry, got, c.want)
+		}
+	}
+}
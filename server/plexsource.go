@@ -0,0 +1,324 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/jonas747/plex"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PlexConfig struct {
+	URL                string `json:"url"` // Empty disables plex
+	Token              string `json:"token"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+var (
+	ErrPlexDisabled   = errors.New("Plex is not configured")
+	ErrInvalidPlexKey = errors.New("Invalid plex rating key")
+
+	// Rating keys come from clients, they're only ever put into a path as is
+	plexKeyRegex = regexp.MustCompile(`^[0-9A-Za-z]+$`)
+)
+
+// plexServer returns a plex client for the current config, recreated whenever the plex config changes
+func (s *Server) plexServer() (*plex.PlexServer, error) {
+	s.configLock.RLock()
+	pc := s.config.Plex
+	s.configLock.RUnlock()
+
+	if pc.URL == "" {
+		return nil, ErrPlexDisabled
+	}
+
+	s.pmsLock.Lock()
+	defer s.pmsLock.Unlock()
+
+	if s.pms == nil || s.pmsConfig != pc {
+		s.pms = newPlexServer(pc)
+		s.pmsConfig = pc
+	}
+	return s.pms, nil
+}
+
+func newPlexServer(pc PlexConfig) *plex.PlexServer {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if pc.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	host := ""
+	if u, err := url.Parse(pc.URL); err == nil {
+		host = u.Host
+	}
+
+	httpClient := &http.Client{
+		Transport: &plexTokenTransport{Token: pc.Token, Host: host, Transport: transport},
+		Timeout:   time.Second * 30,
+	}
+
+	return &plex.PlexServer{
+		Path:   strings.TrimSuffix(pc.URL, "/"),
+		Client: httpClient,
+	}
+}
+
+// plexTokenTransport adds the plex token to requests to the plex server, and only those so it can't
+// leak through a redirect or a key pointing elsewhere
+type plexTokenTransport struct {
+	Token     string
+	Host      string
+	Transport http.RoundTripper
+}
+
+func (t *plexTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Token != "" && req.URL.Host == t.Host {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Plex-Token", t.Token)
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// PlexSearch searches for shows (kind "tv") or movies
+func (s *Server) PlexSearch(title, kind string) ([]plex.PlexDirectory, error) {
+	server, err := s.plexServer()
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == "tv" {
+		mediaContainer, err := server.FetchContainer("/library/all?type=2&title=" + url.QueryEscape(title))
+		if err != nil {
+			return nil, err
+		}
+		return mediaContainer.Directories, nil
+	}
+
+	mediaContainer, err := server.FetchContainer("/library/all?type=1&title=" + url.QueryEscape(title))
+	if err != nil {
+		return nil, err
+	}
+	return mediaContainer.Videos, nil
+}
+
+// PlexEpisodes returns the episodes of a show to add
+// If addAllAfter is set all the episodes after the specified one are included
+// If wholeSeason is set all episodes in the season are returned
+func (s *Server) PlexEpisodes(show plex.PlexDirectory, season, episode int, addAllAfter, wholeSeason bool) ([]plex.PlexDirectory, error) {
+	// Get all episodes and find the right ones!
+	allEpisodes, err := s.plexShowEpisodes(show.RatingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	episodes := make([]plex.PlexDirectory, 0)
+	for _, ep := range allEpisodes {
+		index, _ := strconv.Atoi(ep.Index)
+		parentIndex, _ := strconv.Atoi(ep.ParentIndex)
+
+		switch {
+		case wholeSeason && parentIndex == season:
+		case index == episode && parentIndex == season:
+			// found it
+		case addAllAfter && (parentIndex > season || (parentIndex == season && index > episode)):
+			// If were adding all after selected
+		default:
+			continue
+		}
+		episodes = append(episodes, ep)
+	}
+
+	if len(episodes) < 1 {
+		return nil, errors.New("Episode not found")
+	}
+	return episodes, nil
+}
+
+// PlexMovie fetches the full metadata of a movie from a search result, only the rating key is used
+func (s *Server) PlexMovie(item plex.PlexDirectory) (plex.PlexDirectory, error) {
+	if !plexKeyRegex.MatchString(item.RatingKey) {
+		return plex.PlexDirectory{}, ErrInvalidPlexKey
+	}
+
+	server, err := s.plexServer()
+	if err != nil {
+		return plex.PlexDirectory{}, err
+	}
+
+	fullVideoContainer, err := server.FetchContainer("/library/metadata/" + url.PathEscape(item.RatingKey))
+	if err != nil {
+		return plex.PlexDirectory{}, err
+	}
+	if len(fullVideoContainer.Videos) < 1 {
+		return plex.PlexDirectory{}, errors.New("Movie not found")
+	}
+	return fullVideoContainer.Videos[0], nil
+}
+
+// plexSource searches and resolves through the configured plex server
+// Ids are "show:<ratingKey>", "episode:<showRatingKey>:<season>:<episode>" and "movie:<ratingKey>"
+type plexSource struct {
+	server *Server
+}
+
+func (plexSource) ID() string { return SourcePlex }
+
+func (src plexSource) Search(query SearchQuery) ([]MediaItem, error) {
+	title := query.Title
+	if title == "" {
+		title = query.Show
+	}
+
+	items := make([]MediaItem, 0)
+	if query.Kind == "" || query.Kind == "tv" {
+		shows, err := src.server.PlexSearch(title, "tv")
+		if err != nil {
+			return nil, err
+		}
+		for _, show := range shows {
+			year, _ := strconv.Atoi(show.Year)
+			if query.Year != 0 && year != query.Year {
+				continue
+			}
+			items = append(items, MediaItem{
+				Source: SourcePlex,
+				ID:     "show:" + show.RatingKey,
+				Kind:   MediaKindShow,
+				Title:  show.Title,
+				Year:   year,
+			})
+		}
+	}
+
+	if query.Kind == "" || query.Kind == "movie" {
+		movies, err := src.server.PlexSearch(title, "movie")
+		if err != nil {
+			return nil, err
+		}
+		for _, movie := range movies {
+			year, _ := strconv.Atoi(movie.Year)
+			if query.Year != 0 && year != query.Year {
+				continue
+			}
+			duration, _ := strconv.Atoi(movie.Duration)
+			items = append(items, MediaItem{
+				Source:   SourcePlex,
+				ID:       "movie:" + movie.RatingKey,
+				Kind:     MediaKindMovie,
+				Title:    movie.Title,
+				Year:     year,
+				Duration: duration,
+			})
+		}
+	}
+	return items, nil
+}
+
+// Browse lists the episodes of a show, plex has no sensible top level to browse
+func (src plexSource) Browse(id string) ([]MediaItem, error) {
+	kind, key := splitSourceID(id)
+	if kind != "show" {
+		return nil, errors.New("Only shows can be browsed")
+	}
+
+	episodes, err := src.server.plexShowEpisodes(key)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]MediaItem, 0, len(episodes))
+	for _, ep := range episodes {
+		pi, err := PlaylistItemFromPlexVideo(ep, ITEMTYPETV)
+		if err != nil {
+			continue
+		}
+		items = append(items, playlistMediaItem(SourcePlex, fmt.Sprintf("episode:%s:%d:%d", key, pi.Season, pi.Episode), pi))
+	}
+	return items, nil
+}
+
+func (src plexSource) Resolve(id string, options ResolveOptions) ([]PlaylistItem, error) {
+	kind, key := splitSourceID(id)
+
+	var videos []plex.PlexDirectory
+	itemKind := ITEMTYPETV
+	switch kind {
+	case "show":
+		var err error
+		videos, err = src.server.plexShowEpisodes(key)
+		if err != nil {
+			return nil, err
+		}
+	case "episode":
+		var show string
+		var season, episode int
+		split := strings.Split(key, ":")
+		if len(split) != 3 {
+			return nil, errors.New("Invalid episode id")
+		}
+		show = split[0]
+		season, _ = strconv.Atoi(split[1])
+		episode, _ = strconv.Atoi(split[2])
+
+		var err error
+		videos, err = src.server.PlexEpisodes(plex.PlexDirectory{RatingKey: show}, season, episode, options.AddAllAfter, options.WholeSeason)
+		if err != nil {
+			return nil, err
+		}
+	case "movie":
+		movie, err := src.server.PlexMovie(plex.PlexDirectory{RatingKey: key})
+		if err != nil {
+			return nil, err
+		}
+		videos = []plex.PlexDirectory{movie}
+		itemKind = ITEMTYPEMOVIE
+	default:
+		return nil, errors.New("Invalid plex id")
+	}
+
+	items := make([]PlaylistItem, 0, len(videos))
+	for _, vid := range videos {
+		pi, err := PlaylistItemFromPlexVideo(vid, itemKind)
+		if err != nil {
+			log.Printf("Skipping plex item %s: %s\n", vid.Title, err)
+			continue
+		}
+		items = append(items, pi)
+	}
+	return items, nil
+}
+
+func (s *Server) plexShowEpisodes(ratingKey string) ([]plex.PlexDirectory, error) {
+	if !plexKeyRegex.MatchString(ratingKey) {
+		return nil, ErrInvalidPlexKey
+	}
+
+	server, err := s.plexServer()
+	if err != nil {
+		return nil, err
+	}
+
+	allEpisodes, err := server.FetchContainer("/library/metadata/" + url.PathEscape(ratingKey) + "/allLeaves")
+	if err != nil {
+		return nil, err
+	}
+	return allEpisodes.Videos, nil
+}
+
+// splitSourceID splits "kind:rest" ids used by the remote sources
+func splitSourceID(id string) (kind, key string) {
+	i := strings.Index(id, ":")
+	if i == -1 {
+		return "", id
+	}
+	return id[:i], id[i+1:]
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jogramming/fluffywatch/plexfake"
+	"github.com/jonas747/plex"
+)
+
+func newPlexTestServer(t *testing.T) (*Server, *plexfake.Server) {
+	fake := plexfake.New("secret")
+	fake.AddShow(plexfake.Show{
+		RatingKey: "10",
+		Title:     "Some Show",
+		Year:      2010,
+		Episodes: []plexfake.Episode{
+			// Out of order on purpose, allLeaves is sorted
+			{RatingKey: "103", Title: "S1E3", Season: 1, Index: 3, File: "/plex/show/s1e3.mkv", Duration: 1000},
+			{RatingKey: "101", Title: "S1E1", Season: 1, Index: 1, File: "/plex/show/s1e1.mkv", Duration: 1000},
+			{RatingKey: "102", Title: "S1E2", Season: 1, Index: 2, File: "/plex/show/s1e2.mkv", Duration: 1000},
+			{RatingKey: "201", Title: "S2E1", Season: 2, Index: 1, File: "/plex/show/s2e1.mkv", Duration: 1000},
+			{RatingKey: "202", Title: "S2E2", Season: 2, Index: 2, File: "/plex/show/s2e2.mkv", Duration: 1000},
+		},
+	})
+	fake.AddMovie(plexfake.Movie{RatingKey: "20", Title: "Some Movie", Year: 2001, File: "/plex/movies/some.mkv", Duration: 5000})
+	fake.AddMovie(plexfake.Movie{RatingKey: "21", Title: "Other Movie", Year: 1999, File: "/plex/movies/other.mkv", Duration: 6000})
+
+	ts := fake.Start()
+	t.Cleanup(ts.Close)
+
+	s := &Server{config: &Config{Plex: PlexConfig{URL: ts.URL + "/", Token: "secret"}}}
+	return s, fake
+}
+
+func plexTitles(dirs []plex.PlexDirectory) string {
+	titles := make([]string, len(dirs))
+	for i, d := range dirs {
+		titles[i] = d.Title
+	}
+	return strings.Join(titles, ",")
+}
+
+func TestPlexSearch(t *testing.T) {
+	s, fake := newPlexTestServer(t)
+
+	shows, err := s.PlexSearch("some", "tv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plexTitles(shows); got != "Some Show" {
+		t.Errorf("tv search = %s, want Some Show", got)
+	}
+
+	movies, err := s.PlexSearch("movie", "movie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plexTitles(movies); got != "Some Movie,Other Movie" {
+		t.Errorf("movie search = %s", got)
+	}
+
+	if reqs := fake.Requests(); len(reqs) != 2 || !strings.Contains(reqs[0], "type=2") {
+		t.Errorf("requests = %q", reqs)
+	}
+
+	s.config.Plex.Token = "wrong"
+	if _, err = s.PlexSearch("some", "tv"); err == nil {
+		t.Error("a wrong token should fail")
+	}
+	s.config.Plex.URL = ""
+	if _, err = s.PlexSearch("some", "tv"); err != ErrPlexDisabled {
+		t.Errorf("search without plex = %v, want ErrPlexDisabled", err)
+	}
+}
+
+func TestPlexEpisodes(t *testing.T) {
+	s, _ := newPlexTestServer(t)
+	show := plex.PlexDirectory{RatingKey: "10"}
+
+	cases := []struct {
+		season, episode          int
+		addAllAfter, wholeSeason bool
+		want                     string
+	}{
+		{1, 2, false, false, "S1E2"},
+		{1, 2, true, false, "S1E2,S1E3,S2E1,S2E2"},
+		{1, 2, false, true, "S1E1,S1E2,S1E3"},
+		{2, 1, true, true, "S2E1,S2E2"},
+		{2, 2, true, false, "S2E2"},
+	}
+	for _, c := range cases {
+		episodes, err := s.PlexEpisodes(show, c.season, c.episode, c.addAllAfter, c.wholeSeason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := plexTitles(episodes); got != c.want {
+			t.Errorf("PlexEpisodes(%d, %d, %v, %v) = %s, want %s", c.season, c.episode, c.addAllAfter, c.wholeSeason, got, c.want)
+		}
+	}
+
+	if _, err := s.PlexEpisodes(show, 3, 1, false, false); err == nil {
+		t.Error("a missing episode should fail")
+	}
+}
+
+func TestPlexSourceResolve(t *testing.T) {
+	s, _ := newPlexTestServer(t)
+	src := plexSource{server: s}
+
+	items, err := src.Resolve("episode:10:1:3", ResolveOptions{AddAllAfter: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+	first := items[0]
+	if first.Path != "/plex/show/s1e3.mkv" || first.Kind != ITEMTYPETV || first.Season != 1 || first.Episode != 3 ||
+		first.ShowTitle != "Some Show" || first.Duration != 1000 {
+		t.Errorf("first episode = %+v", first)
+	}
+
+	items, err = src.Resolve("show:10", ResolveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 5 || items[0].Title != "S1E1" || items[4].Title != "S2E2" {
+		t.Errorf("show resolved to %+v", items)
+	}
+
+	items, err = src.Resolve("movie:20", ResolveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != "/plex/movies/some.mkv" || items[0].Kind != ITEMTYPEMOVIE {
+		t.Errorf("movie resolved to %+v", items)
+	}
+
+	// Search ids resolve back to the same thing
+	found, err := src.Search(SearchQuery{Title: "other", Kind: "movie"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Year != 1999 {
+		t.Fatalf("search = %+v", found)
+	}
+	items, err = src.Resolve(found[0].ID, ResolveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != "/plex/movies/other.mkv" {
+		t.Errorf("%s resolved to %+v", found[0].ID, items)
+	}
+
+	for _, id := range []string{"nope", "episode:10:1", "show:99", "movie:/library/metadata/20", "movie:@evil.example/x", "show:../x"} {
+		if _, err = src.Resolve(id, ResolveOptions{}); err == nil {
+			t.Errorf("Resolve(%q) should fail", id)
+		}
+	}
+}
+
+func TestPlexTokenOnlyToPlex(t *testing.T) {
+	tokens := make(chan string, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("X-Plex-Token")
+	})
+	plexServer := httptest.NewServer(handler)
+	defer plexServer.Close()
+	other := httptest.NewServer(handler)
+	defer other.Close()
+
+	pms := newPlexServer(PlexConfig{URL: plexServer.URL, Token: "secret"})
+	for _, u := range []string{plexServer.URL, other.URL} {
+		resp, err := pms.Client.Get(u + "/library/all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := <-tokens; got != "secret" {
+		t.Errorf("plex got token %q", got)
+	}
+	if got := <-tokens; got != "" {
+		u, _ := url.Parse(other.URL)
+		t.Errorf("%s got token %q", u.Host, got)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+type ProbeStream struct {
+	Index     int    `json:"index"`
+	CodecType string `json:"codecType"` // video, audio, subtitle...
+	CodecName string `json:"codecName"`
+	Language  string `json:"language"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+}
+
+type ProbeResult struct {
+	Duration int           `json:"duration"` // Duration in milliseconds
+	Streams  []ProbeStream `json:"streams"`
+}
+
+// HasStream returns true if the file has a stream with that index
+func (p *ProbeResult) HasStream(index int) bool {
+	for _, s := range p.Streams {
+		if s.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+type probeCacheEntry struct {
+	modTime time.Time
+	size    int64
+	result  *ProbeResult
+}
+
+// ProbeFile runs ffprobe on the file, results are cached until the file changes
+func (s *Server) ProbeFile(path string) (*ProbeResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.probeCacheLock.Lock()
+	cached, ok := s.probeCache[path]
+	s.probeCacheLock.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.result, nil
+	}
+
+	_, ffprobe := s.ffmpegPaths()
+	result, err := runProbe(ffprobe, path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.probeCacheLock.Lock()
+	if s.probeCache == nil {
+		s.probeCache = make(map[string]probeCacheEntry)
+	}
+	s.probeCache[path] = probeCacheEntry{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		result:  result,
+	}
+	s.probeCacheLock.Unlock()
+	return result, nil
+}
+
+func runProbe(ffprobe, path string) (*ProbeResult, error) {
+	cmd := exec.Command(ffprobe, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", path)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("ffprobe failed: " + err.Error())
+	}
+
+	var parsed struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			Index     int    `json:"index"`
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+			Tags      struct {
+				Language string `json:"language"`
+			} `json:"tags"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal(output, &parsed)
+	if err != nil {
+		return nil, errors.New("Failed parsing ffprobe output: " + err.Error())
+	}
+
+	result := &ProbeResult{
+		Streams: make([]ProbeStream, 0, len(parsed.Streams)),
+	}
+
+	seconds, _ := strconv.ParseFloat(parsed.Format.Duration, 64)
+	result.Duration = int(seconds * 1000)
+
+	for _, s := range parsed.Streams {
+		result.Streams = append(result.Streams, ProbeStream{
+			Index:     s.Index,
+			CodecType: s.CodecType,
+			CodecName: s.CodecName,
+			Language:  s.Tags.Language,
+			Width:     s.Width,
+			Height:    s.Height,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,14 @@
+package server
+
+import (
+	"syscall"
+)
+
+// Own process group so a ctrl+c in the terminal only reaches us and we stop it properly,
+// and it's killed along with us if we die without getting to
+func transcoderProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package server
+
+import (
+	"syscall"
+)
+
+// Own process group so a ctrl+c in the terminal only reaches us and we stop it properly
+func transcoderProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+}
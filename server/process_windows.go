@@ -0,0 +1,19 @@
+package server
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func transcoderProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// There's no interrupting on windows
+func interruptProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func killProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
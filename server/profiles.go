@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const DefaultProfile = "default"
+
+type FFmpegConfig struct {
+	FFmpegPath  string                       `json:"ffmpegPath"`  // Defaults to ffmpeg from PATH
+	FFprobePath string                       `json:"ffprobePath"` // Defaults to ffprobe from PATH
+	Profiles    map[string]TranscoderProfile `json:"profiles"`    // Added to the built in ones, same name replaces it
+}
+
+// TranscoderProfile bundles encoder parameters under a name, so masters don't have to send raw numbers
+type TranscoderProfile struct {
+	ScaleWidth   int      `json:"scale"`
+	MaxRate      int      `json:"maxrate"` // kbit/s
+	Preset       string   `json:"preset"`
+	AudioRate    int      `json:"audioRate"`    // Hz, defaults to 44100
+	AudioVBR     int      `json:"audioVbr"`     // 1-5, 5 is highest, defaults to 5
+	VideoProfile string   `json:"videoProfile"` // h264 profile, defaults to baseline
+	Keyint       int      `json:"keyint"`       // Frames between keyframes, defaults to 100
+	AudioOnly    bool     `json:"audioOnly"`    // Drop the video, everything video related is ignored
+	InputArgs    []string `json:"inputArgs"`    // Extra ffmpeg args put before the input
+	OutputArgs   []string `json:"outputArgs"`   // Extra ffmpeg args put before the output
+}
+
+// Built in profiles, a profile in the config with the same name replaces one of these
+var defaultProfiles = map[string]TranscoderProfile{
+	DefaultProfile: {ScaleWidth: 1280, MaxRate: 2000, Preset: "veryfast"},
+	"low":          {ScaleWidth: 854, MaxRate: 800, Preset: "veryfast", AudioVBR: 3},
+	"hd":           {ScaleWidth: 1920, MaxRate: 5000, Preset: "veryfast", AudioRate: 48000, VideoProfile: "main"},
+	"audio-only":   {AudioOnly: true},
+}
+
+var (
+	ValidVideoProfiles = []string{"baseline", "main", "high"}
+
+	// Extra args can't touch what the player controls or read and write other files
+	forbiddenFFmpegArgs = []string{
+		"-i", "-f", "-y", "-n", "-map", "-ss", "-t", "-to", "-re", "-start_number",
+		"-report", "-progress", "-vstats", "-vstats_file", "-passlogfile", "-attach", "-dump_attachment",
+		"-filter", "-filter_script", "-filter_complex_script", "-filter_complex", "-lavfi", "-vf", "-af",
+		"-hls_segment_filename", "-hls_base_url", "-hls_fmp4_init_filename", "-hls_key_info_file",
+		"-master_pl_name", "-var_stream_map", "-segment_list",
+	}
+
+	// Options that take a value, anything else is a flag on its own. A word after a flag would be
+	// taken as another output file, so options that aren't in here can't have values
+	valueFFmpegArgs = []string{
+		"-c", "-codec", "-acodec", "-vcodec", "-b", "-ab", "-minrate", "-maxrate", "-bufsize",
+		"-crf", "-qp", "-q", "-qscale", "-preset", "-tune", "-profile", "-level", "-pix_fmt",
+		"-g", "-keyint_min", "-bf", "-refs", "-sc_threshold", "-rc-lookahead", "-r", "-s", "-aspect",
+		"-ar", "-ac", "-vbr", "-channel_layout", "-sample_fmt", "-threads", "-filter_threads",
+		"-x264-params", "-x264opts", "-strict", "-movflags", "-hls_time", "-hls_list_size",
+		"-fflags", "-analyzeduration", "-probesize", "-thread_queue_size", "-max_muxing_queue_size",
+		"-hwaccel", "-hwaccel_device", "-hwaccel_output_format", "-vsync", "-fps_mode", "-async",
+		"-loglevel", "-v",
+	}
+
+	ErrUnknownProfile = errors.New("Unknown transcoder profile")
+)
+
+func (p TranscoderProfile) Validate() error {
+	if !p.AudioOnly {
+		if p.ScaleWidth < 16 || p.ScaleWidth > 7680 || p.ScaleWidth%2 != 0 {
+			return errors.New("Scale has to be an even number between 16 and 7680")
+		}
+		if p.MaxRate < 100 || p.MaxRate > 100000 {
+			return errors.New("Max rate has to be between 100 and 100000 kbit/s")
+		}
+		if err := ValidatePreset(p.Preset); err != nil {
+			return err
+		}
+		if p.VideoProfile != "" && !containsString(ValidVideoProfiles, p.VideoProfile) {
+			return errors.New("Video profile has to be one of " + strings.Join(ValidVideoProfiles, ", "))
+		}
+		if p.Keyint < 0 || p.Keyint > 1000 {
+			return errors.New("Keyint has to be 0 for the default or between 1 and 1000")
+		}
+	}
+	if p.AudioRate != 0 && (p.AudioRate < 8000 || p.AudioRate > 96000) {
+		return errors.New("Audio rate has to be 0 for the default or between 8000 and 96000")
+	}
+	if p.AudioVBR < 0 || p.AudioVBR > 5 {
+		return errors.New("Audio vbr has to be 0 for the default or between 1 and 5")
+	}
+	if err := validateExtraArgs(p.InputArgs); err != nil {
+		return fmt.Errorf("Input args: %s", err)
+	}
+	if err := validateExtraArgs(p.OutputArgs); err != nil {
+		return fmt.Errorf("Output args: %s", err)
+	}
+	return nil
+}
+
+// validateExtraArgs makes sure args can only be options, ffmpeg takes any loose word as another output file
+func validateExtraArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "" || strings.ContainsAny(a, "\x00\r\n") {
+			return errors.New("Empty argument or one with line breaks")
+		}
+		if !strings.HasPrefix(a, "-") || len(a) < 2 {
+			return fmt.Errorf("%q isn't the value of an option", a)
+		}
+
+		// Stream specifiers like -c:a or -b:v:0 are the same option
+		name := strings.SplitN(a, ":", 2)[0]
+		if containsString(forbiddenFFmpegArgs, name) {
+			return fmt.Errorf("%s can't be used", name)
+		}
+		if !containsString(valueFFmpegArgs, name) {
+			continue
+		}
+
+		// The value can start with - too, like -strict -2
+		i++
+		if i >= len(args) {
+			return fmt.Errorf("%s needs a value", a)
+		}
+		if args[i] == "" || strings.ContainsAny(args[i], "\x00\r\n") {
+			return errors.New("Empty argument or one with line breaks")
+		}
+	}
+	return nil
+}
+
+func (c *FFmpegConfig) Validate() error {
+	for name, p := range c.Profiles {
+		if name == "" {
+			return errors.New("Transcoder profile with no name")
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("Transcoder profile %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// transcoderProfile returns the profile with that name, from the config or the built in ones
+// empty is the default one, for settings from before there were profiles
+func (s *Server) transcoderProfile(name string) (TranscoderProfile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+
+	s.configLock.RLock()
+	p, ok := s.config.FFmpeg.Profiles[name]
+	s.configLock.RUnlock()
+	if ok {
+		return p, nil
+	}
+
+	p, ok = defaultProfiles[name]
+	if !ok {
+		return p, ErrUnknownProfile
+	}
+	return p, nil
+}
+
+// transcoderProfileNames returns the names of all the profiles, sorted
+func (s *Server) transcoderProfileNames() []string {
+	names := make([]string, 0, len(defaultProfiles))
+	for name := range defaultProfiles {
+		names = append(names, name)
+	}
+
+	s.configLock.RLock()
+	for name := range s.config.FFmpeg.Profiles {
+		if _, ok := defaultProfiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	s.configLock.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// ffmpegCommand returns the command a job is transcoded with, using the configured ffmpeg
+func (s *Server) ffmpegCommand(job TranscodeJob) *FFmpegCommand {
+	c := NewFFmpegCommand(job)
+	c.Binary, _ = s.ffmpegPaths()
+	return c
+}
+
+func (s *Server) ffmpegPaths() (ffmpeg, ffprobe string) {
+	s.configLock.RLock()
+	ffmpeg = s.config.FFmpeg.FFmpegPath
+	ffprobe = s.config.FFmpeg.FFprobePath
+	s.configLock.RUnlock()
+
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	if ffprobe == "" {
+		ffprobe = "ffprobe"
+	}
+	return
+}
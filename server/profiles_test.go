@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestValidateExtraArgs(t *testing.T) {
+	cases := []struct {
+		args []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"-tune", "film", "-an"}, true},
+		{[]string{"-strict", "-2"}, true},
+		{[]string{"-c:a", "aac", "-b:v:0", "1000k"}, true},
+		{[]string{"-nostdin", "-hide_banner"}, true},
+
+		{[]string{"out.ts"}, false},
+		{[]string{"-an", "/srv/www/x.ts"}, false},
+		{[]string{"-tune", "film", "extra.ts"}, false},
+		{[]string{"-tune"}, false},
+		{[]string{"-tune", ""}, false},
+		{[]string{"-"}, false},
+		{[]string{"-vf", "scale=2"}, false},
+		{[]string{"-filter:v", "scale=2"}, false},
+		{[]string{"-filter:a", "volume=2"}, false},
+		{[]string{"-hls_segment_filename", "/tmp/%d.ts"}, false},
+		{[]string{"-hls_base_url", "http://x/"}, false},
+		{[]string{"-segment_list", "/tmp/list"}, false},
+		{[]string{"-y"}, false},
+	}
+
+	for _, c := range cases {
+		err := validateExtraArgs(c.args)
+		if (err == nil) != c.ok {
+			t.Errorf("validateExtraArgs(%q) = %v, want ok %v", c.args, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Every room has its own player, playlist, chat, mods and bans. The main room uses the top level
+// config fields so configs from before rooms keep working, the others are in the rooms list of the config
+
+const MainRoom = "main"
+
+var (
+	ErrRoomNotFound    = errors.New("Room not found")
+	ErrRoomExists      = errors.New("There's already a room with that name")
+	ErrInvalidRoomName = errors.New("Room names can only have letters, numbers, - and _ and be at most 32 long")
+	ErrMainRoom        = errors.New("The main room can't be deleted")
+	ErrRoomClosed      = errors.New("The room was closed")
+)
+
+var roomNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+type RoomConfig struct {
+	Name            string        `json:"name"`
+	Master          string        `json:"master"`
+	Mods            []string      `json:"mods"`
+	Bans            []string      `json:"bans"`
+	IPBans          []string      `json:"ipBans"`
+	PlaylistPath    string        `json:"playlistPath"`
+	HLSPlaylistPath string        `json:"hls_playlist_path"` // Defaults to a folder named after the room in the main room's segment dir
+	SegmentDir      string        `json:"segment_dir"`
+	Channel         ChannelConfig `json:"channel"`
+	VoteMode        bool          `json:"voteMode"`
+	VoteThreshold   float64       `json:"voteThreshold"`
+}
+
+type Room struct {
+	server *Server
+
+	Name        string
+	Player      *Player
+	Suggestions *SuggestionQueue
+	Scheduler   *Scheduler
+	Channel     *Channel
+
+	viewers      map[string]fnet.Session
+	viewersMutex sync.RWMutex
+
+	votes     map[string]*vote
+	votesLock sync.Mutex
+
+	quit chan struct{} // Closed when the room is deleted
+}
+
+func NewRoom(s *Server, name string) *Room {
+	r := &Room{
+		Name:        name,
+		server:      s,
+		Suggestions: NewSuggestionQueue(),
+		viewers:     make(map[string]fnet.Session),
+		votes:       make(map[string]*vote),
+		quit:        make(chan struct{}),
+	}
+	r.Player = NewPlayer(r)
+	r.Scheduler = NewScheduler(r, r.schedulePath())
+	r.Channel = NewChannel(r, r.statePath("channel.json"))
+	return r
+}
+
+// Start loads the playlist and starts everything the room runs in the background
+func (r *Room) Start() {
+	go r.Player.Run()
+
+	settings := r.settings()
+	var err error
+	if settings.SegmentDir != "" {
+		// ffmpeg wont create it
+		err = os.MkdirAll(settings.SegmentDir, 0775)
+		if err != nil {
+			log.Println("Failed creating segment dir:", err)
+		}
+	}
+	// Before the playlists, they only add what's not already in there
+	err = r.Player.loadState(r.statePath(PlayerStateFile))
+	if err != nil {
+		log.Println("Failed restoring the player:", err)
+	}
+	if settings.PlaylistPath != "" {
+		err = r.server.loadPlaylist(r.Player, settings.PlaylistPath, "")
+		if err != nil {
+			log.Println("Failed loading playlist from config:", err)
+		}
+	}
+	if r.Name == MainRoom {
+		if _, err := os.Stat(r.server.playlistPath); err == nil {
+			err = r.server.loadPlaylist(r.Player, r.server.playlistPath, "")
+			if err != nil {
+				log.Println("Failed loading playlist:", err)
+			}
+		}
+	}
+
+	go r.Scheduler.Run()
+	// Started last as it might start playing right away
+	go r.Channel.Run()
+}
+
+// Close stops playback and everything running in the background, the player is saved so it picks up
+// from there next time
+func (r *Room) Close() {
+	r.Player.stopAndWait(TranscodeStopTimeout)
+	err := r.Player.saveState(r.statePath(PlayerStateFile))
+	if err != nil {
+		log.Println("Failed saving the player:", err)
+	}
+	close(r.quit)
+
+	// The stream is over, dont leave segments around for anyone to pick up later
+	settings := r.settings()
+	if settings.SegmentDir != "" {
+		removeSegments(settings.SegmentDir)
+	}
+	if settings.HLSPlaylistPath != "" {
+		os.Remove(settings.HLSPlaylistPath)
+	}
+}
+
+// settings returns the room's part of the config
+func (r *Room) settings() RoomConfig {
+	r.server.configLock.RLock()
+	defer r.server.configLock.RUnlock()
+
+	if r.Name == MainRoom {
+		return RoomConfig{
+			Name:            MainRoom,
+			Master:          r.server.config.Master,
+			Mods:            r.server.config.Mods,
+			Bans:            r.server.config.Bans,
+			IPBans:          r.server.config.IPBans,
+			PlaylistPath:    r.server.config.PlaylistPath,
+			HLSPlaylistPath: r.server.config.HLSPlaylistPath,
+			SegmentDir:      r.server.config.SegmentDir,
+			Channel:         r.server.config.Channel,
+			VoteMode:        r.server.config.VoteMode,
+			VoteThreshold:   r.server.config.VoteThreshold,
+		}
+	}
+
+	rc := RoomConfig{Name: r.Name}
+	for _, c := range r.server.config.Rooms {
+		if c.Name == r.Name {
+			rc = c
+			break
+		}
+	}
+	if rc.SegmentDir == "" {
+		rc.SegmentDir = filepath.Join(r.server.config.SegmentDir, r.Name)
+	}
+	if rc.HLSPlaylistPath == "" {
+		name := filepath.Base(r.server.config.HLSPlaylistPath)
+		if r.server.config.HLSPlaylistPath == "" {
+			name = "playlist.m3u8"
+		}
+		rc.HLSPlaylistPath = filepath.Join(rc.SegmentDir, name)
+	}
+	return rc
+}
+
+// statePath is where the room keeps state files, in the cache dir
+func (r *Room) statePath(file string) string {
+	if r.Name == MainRoom {
+		return r.server.cacheDir(file)
+	}
+	return r.server.cacheDir(filepath.Join("rooms", r.Name, file))
+}
+
+func (r *Room) schedulePath() string {
+	if r.Name == MainRoom {
+		return r.server.schedulePath()
+	}
+	return r.statePath("schedules.json")
+}
+
+// reloadPath is the playlist file reloading the playlist reads from
+func (r *Room) reloadPath() string {
+	if r.Name == MainRoom {
+		return r.server.playlistPath
+	}
+	return r.settings().PlaylistPath
+}
+
+func (s *Server) getRoom(name string) *Room {
+	s.roomsLock.RLock()
+	defer s.roomsLock.RUnlock()
+	return s.rooms[name]
+}
+
+// sessionRoom returns the room the session is in
+func (s *Server) sessionRoom(session fnet.Session) *Room {
+	name, _ := session.Data.GetString("room")
+	if room := s.getRoom(name); room != nil {
+		return room
+	}
+	return s.getRoom(MainRoom)
+}
+
+// startRooms creates and starts the main room and the rooms in the config
+func (s *Server) startRooms() {
+	s.configLock.RLock()
+	names := []string{MainRoom}
+	for _, rc := range s.config.Rooms {
+		if rc.Name == MainRoom || !roomNameRegex.MatchString(rc.Name) {
+			log.Printf("Skipping room with invalid name %q\n", rc.Name)
+			continue
+		}
+		names = append(names, rc.Name)
+	}
+	s.configLock.RUnlock()
+
+	for _, name := range names {
+		room := NewRoom(s, name)
+		s.roomsLock.Lock()
+		s.rooms[name] = room
+		s.roomsLock.Unlock()
+		room.Start()
+	}
+}
+
+// CreateRoom adds the room to the config and starts it
+func (s *Server) CreateRoom(rc RoomConfig) (*Room, error) {
+	if !roomNameRegex.MatchString(rc.Name) {
+		return nil, ErrInvalidRoomName
+	}
+
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+
+	if _, ok := s.rooms[rc.Name]; ok {
+		return nil, ErrRoomExists
+	}
+
+	s.configLock.Lock()
+	s.config.Rooms = append(s.config.Rooms, rc)
+	err := s.saveConfig(s.configPath)
+	s.configLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	room := NewRoom(s, rc.Name)
+	s.rooms[rc.Name] = room
+	room.Start()
+	return room, nil
+}
+
+// DeleteRoom stops the room and removes it from the config, the viewers in it are returned so they
+// can be moved elsewhere
+func (s *Server) DeleteRoom(name string) ([]fnet.Session, error) {
+	if name == MainRoom {
+		return nil, ErrMainRoom
+	}
+
+	s.roomsLock.Lock()
+	room, ok := s.rooms[name]
+	if !ok {
+		s.roomsLock.Unlock()
+		return nil, ErrRoomNotFound
+	}
+	delete(s.rooms, name)
+	s.roomsLock.Unlock()
+
+	s.configLock.Lock()
+	kept := make([]RoomConfig, 0, len(s.config.Rooms))
+	for _, rc := range s.config.Rooms {
+		if rc.Name != name {
+			kept = append(kept, rc)
+		}
+	}
+	s.config.Rooms = kept
+	err := s.saveConfig(s.configPath)
+	s.configLock.Unlock()
+	if err != nil {
+		log.Println("Failed saving config:", err)
+	}
+
+	room.Close()
+	os.Remove(room.statePath(PlayerStateFile))
+
+	room.viewersMutex.Lock()
+	sessions := make([]fnet.Session, 0, len(room.viewers))
+	for _, session := range room.viewers {
+		sessions = append(sessions, session)
+	}
+	room.viewers = make(map[string]fnet.Session)
+	room.viewersMutex.Unlock()
+	return sessions, nil
+}
+
+// join adds the session to the room's viewers, keeping its name if it's not taken in the room
+func (r *Room) join(session fnet.Session) string {
+	name, _ := session.Data.GetString("name")
+
+	r.viewersMutex.Lock()
+	if _, taken := r.viewers[name]; name == "" || taken {
+		for {
+			id := <-r.server.idGenChan
+			name = fmt.Sprintf("dude#%d", id)
+			if _, exists := r.viewers[name]; !exists {
+				break
+			}
+		}
+	}
+	session.Data.Set("name", name)
+	session.Data.Set("room", r.Name)
+	r.viewers[name] = session
+	r.viewersMutex.Unlock()
+
+	r.broadcastNotification(fmt.Sprintf("%s Joined", name), false)
+	if r.Player.RebuildRotation() {
+		r.broadcastPlaylistStatus()
+	} else {
+		r.broadcastStatus()
+	}
+	return name
+}
+
+// leave removes the session from the room's viewers
+func (r *Room) leave(session fnet.Session) {
+	name, _ := session.Data.GetString("name")
+
+	r.viewersMutex.Lock()
+	_, found := r.viewers[name]
+	if found {
+		delete(r.viewers, name)
+	}
+	r.viewersMutex.Unlock()
+
+	if found {
+		r.broadcastNotification(fmt.Sprintf("%s Left :'(", name), false)
+	}
+	// Their turns in the rotation are skipped now
+	if r.Player.RebuildRotation() {
+		r.broadcastPlaylistStatus()
+	} else {
+		r.broadcastStatus()
+	}
+}
+
+// Broadcast sends the message to everyone in the room
+func (r *Room) Broadcast(wm []byte) {
+	r.viewersMutex.RLock()
+	sessions := make([]fnet.Session, 0, len(r.viewers))
+	for _, session := range r.viewers {
+		sessions = append(sessions, session)
+	}
+	r.viewersMutex.RUnlock()
+
+	for _, session := range sessions {
+		session.Conn.Send(wm)
+	}
+}
+
+func (r *Room) CreateAndBroadcast(evt int32, data interface{}) error {
+	wm, err := r.server.netEngine.CreateWireMessage(evt, data)
+	if err != nil {
+		return err
+	}
+	r.Broadcast(wm)
+	return nil
+}
+
+type RoomInfo struct {
+	Name    string `json:"name"`
+	Viewers int    `json:"viewers"`
+	Playing bool   `json:"playing"`
+}
+
+type RoomsReply struct {
+	Current string     `json:"current"` // The room you're in
+	Rooms   []RoomInfo `json:"rooms"`
+}
+
+type JoinRoomRequest struct {
+	Name string `json:"name"` // Clients use the room in their url path, the main room if there's none
+}
+
+type RoomCreateRequest struct {
+	Name   string `json:"name"`
+	Master string `json:"master"` // Id of the room's master, defaults to whoever created it
+}
+
+type RoomDeleteRequest struct {
+	Name string `json:"name"`
+}
+
+func (s *Server) listRooms() []RoomInfo {
+	s.roomsLock.RLock()
+	list := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		list = append(list, room)
+	}
+	s.roomsLock.RUnlock()
+
+	infos := make([]RoomInfo, 0, len(list))
+	for _, room := range list {
+		room.viewersMutex.RLock()
+		viewers := len(room.viewers)
+		room.viewersMutex.RUnlock()
+
+		playing := false
+		room.Player.do(func() {
+			playing = room.Player.Playing
+		})
+
+		infos = append(infos, RoomInfo{Name: room.Name, Viewers: viewers, Playing: playing})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// moveToRoom moves the session from the room it's in to room and sends it the state of the new room
+func (s *Server) moveToRoom(session fnet.Session, from, to *Room) {
+	if from != nil {
+		from.leave(session)
+	}
+	to.join(session)
+
+	name, _ := session.Data.GetString("name")
+	err := s.netEngine.CreateAndSend(session, EvtJoinRoom, JoinRoomRequest{Name: to.Name})
+	if err != nil {
+		log.Println("Error sending join room reply: ", err)
+	}
+	err = s.netEngine.CreateAndSend(session, EvtSetName, SetNameData{Name: name})
+	if err != nil {
+		log.Println("Error sending name: ", err)
+	}
+
+	for _, build := range []func() ([]byte, error){to.buildPlaylistMessage, to.buildStatusMessage, to.buildSettingsMessage} {
+		wm, err := build()
+		if err != nil {
+			log.Println("Error building room state: ", err)
+			continue
+		}
+		session.Conn.Send(wm)
+	}
+}
+
+func (s *Server) handleJoinRoom(session fnet.Session, req JoinRoomRequest) {
+	if req.Name == "" {
+		req.Name = MainRoom
+	}
+
+	to := s.getRoom(req.Name)
+	if to == nil {
+		s.sendErrResp(session, ErrRoomNotFound, EvtJoinRoom)
+		return
+	}
+
+	from := s.sessionRoom(session)
+	if from == to {
+		return
+	}
+	s.moveToRoom(session, from, to)
+}
+
+// Responds with the list of rooms
+func (s *Server) handleRooms(session fnet.Session) {
+	reply := RoomsReply{Current: s.sessionRoom(session).Name, Rooms: s.listRooms()}
+	err := s.netEngine.CreateAndSend(session, EvtRooms, reply)
+	if err != nil {
+		log.Println("Error sending rooms: ", err)
+	}
+}
+
+func (s *Server) handleRoomCreate(session fnet.Session, req RoomCreateRequest) {
+	if !s.checkAdmin(session, true) {
+		return
+	}
+
+	master := req.Master
+	if master == "" {
+		master, _ = session.Data.GetString("id")
+		if master == "" {
+			s.sendErrResp(session, errors.New("Log in first or give the id of the room's master"), EvtRoomCreate)
+			return
+		}
+	}
+
+	room, err := s.CreateRoom(RoomConfig{Name: req.Name, Master: master, Mods: make([]string, 0), Bans: make([]string, 0), IPBans: make([]string, 0)})
+	if s.checkError(session, err, EvtRoomCreate) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	log.Printf("{%s} '%s' created room %s\n", session.Conn.IP(), name, room.Name)
+	s.sendNotification(session, "Created room "+room.Name, true)
+	err = s.netEngine.CreateAndSend(session, EvtRooms, RoomsReply{Current: s.sessionRoom(session).Name, Rooms: s.listRooms()})
+	if err != nil {
+		log.Println("Error sending rooms: ", err)
+	}
+}
+
+func (s *Server) handleRoomDelete(session fnet.Session, req RoomDeleteRequest) {
+	if !s.checkAdmin(session, true) {
+		return
+	}
+
+	sessions, err := s.DeleteRoom(req.Name)
+	if s.checkError(session, err, EvtRoomDelete) {
+		return
+	}
+
+	lobby := s.getRoom(MainRoom)
+	for _, moved := range sessions {
+		s.sendNotification(moved, "The room was deleted, moving you to the main room", true)
+		s.moveToRoom(moved, nil, lobby)
+	}
+
+	name, _ := session.Data.GetString("name")
+	log.Printf("{%s} '%s' deleted room %s\n", session.Conn.IP(), name, req.Name)
+	s.sendNotification(session, "Deleted room "+req.Name, true)
+}
+
+// checkAdmin returns true if the session is the master of the whole server, who can manage rooms
+func (s *Server) checkAdmin(session fnet.Session, respond bool) bool {
+	s.configLock.RLock()
+	master := s.config.Master
+	s.configLock.RUnlock()
+
+	id, _ := session.Data.GetString("id")
+	if master == "*" || (id != "" && id == master) {
+		return true
+	}
+
+	if respond {
+		s.sendNotification(session, "You're not the server admin", true)
+	}
+	return false
+}
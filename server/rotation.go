@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+)
+
+// In DJ rotation mode everyone adding things gets their own queue, and the upcoming part of the playlist
+// is kept interleaved so everyone gets a turn. Items loaded from playlist files belong to no one
+// and take turns like a DJ that never leaves
+
+var (
+	ErrRotationDisabled = errors.New("DJ rotation is not enabled")
+	ErrNotYourItem      = errors.New("You can only move your own items")
+)
+
+// setItemOwner marks the items as added by the session
+func setItemOwner(session fnet.Session, items []PlaylistItem) {
+	name, _ := session.Data.GetString("name")
+	key := viewerKey(session)
+	for i := range items {
+		items[i].AddedBy = name
+		items[i].owner = key
+	}
+}
+
+func (r *Room) connectedViewerKeys() map[string]bool {
+	connected := make(map[string]bool)
+	r.viewersMutex.RLock()
+	for _, session := range r.viewers {
+		connected[viewerKey(session)] = true
+		// Things added before logging in are keyed by ip
+		connected["ip:"+session.Conn.IP()] = true
+	}
+	r.viewersMutex.RUnlock()
+	return connected
+}
+
+// checkDJPresent returns an error if rotation is on and whoever added the item has left
+// runs on the player goroutine
+func (p *Player) checkDJPresent(item PlaylistItem) error {
+	if !p.CurrentPlaylist.Rotation || item.owner == "" || p.room.connectedViewerKeys()[item.owner] {
+		return nil
+	}
+	return fmt.Errorf("%s left", item.AddedBy)
+}
+
+// RebuildRotation re-interleaves the upcoming items, called when people join or leave
+// returns false if rotation is off
+func (p *Player) RebuildRotation() bool {
+	rotation := false
+	p.do(func() {
+		p.rebuildRotation()
+		rotation = p.CurrentPlaylist.Rotation
+	})
+	return rotation
+}
+
+// rebuildRotation interleaves the items after the current one so every DJ that's still here gets a turn,
+// starting with the one after whoever added the current item. Items from DJs that left go last
+// runs on the player goroutine
+func (p *Player) rebuildRotation() {
+	if !p.CurrentPlaylist.Rotation {
+		return
+	}
+
+	start := p.nextIndex()
+	items := p.CurrentPlaylist.Items
+
+	queues := make(map[string][]PlaylistItem)
+	for _, item := range items[start:] {
+		if _, ok := queues[item.owner]; !ok && !containsString(p.CurrentPlaylist.djs, item.owner) {
+			p.CurrentPlaylist.djs = append(p.CurrentPlaylist.djs, item.owner)
+		}
+		queues[item.owner] = append(queues[item.owner], item)
+	}
+
+	// DJs with nothing queued leave the rotation, and go to the back when they add something again
+	djs := make([]string, 0, len(p.CurrentPlaylist.djs))
+	for _, dj := range p.CurrentPlaylist.djs {
+		if len(queues[dj]) > 0 {
+			djs = append(djs, dj)
+		}
+	}
+	p.CurrentPlaylist.djs = djs
+
+	// Start with the DJ after the one who added the current item
+	order := djs
+	if start > 0 {
+		last := items[start-1].owner
+		for i, dj := range djs {
+			if dj == last {
+				order = append(append([]string{}, djs[i+1:]...), djs[:i+1]...)
+				break
+			}
+		}
+	}
+
+	connected := p.room.connectedViewerKeys()
+	newItems := make([]PlaylistItem, 0, len(items))
+	newItems = append(newItems, items[:start]...)
+	for added := true; added; {
+		added = false
+		for _, dj := range order {
+			if dj != "" && !connected[dj] {
+				continue
+			}
+			if q := queues[dj]; len(q) > 0 {
+				newItems = append(newItems, q[0])
+				queues[dj] = q[1:]
+				added = true
+			}
+		}
+	}
+	for _, dj := range order {
+		newItems = append(newItems, queues[dj]...)
+	}
+	p.CurrentPlaylist.Items = newItems
+}
+
+// MoveOwnItem moves the upcoming item at index to before the item at before in the owner's queue,
+// before being the playlist length moves it to the end of their queue
+func (p *Player) MoveOwnItem(by, owner string, index, before int) error {
+	return p.call(func() error {
+		return p.moveOwnItem(by, owner, index, before)
+	})
+}
+
+// runs on the player goroutine
+func (p *Player) moveOwnItem(by, owner string, index, before int) error {
+	if !p.CurrentPlaylist.Rotation {
+		return ErrRotationDisabled
+	}
+
+	start := p.nextIndex()
+	items := p.CurrentPlaylist.Items
+	isOwn := func(i int) bool {
+		return i >= start && i < len(items) && items[i].owner == owner
+	}
+	if !isOwn(index) || (before != len(items) && !isOwn(before)) {
+		return ErrNotYourItem
+	}
+	if index == before {
+		return nil
+	}
+
+	// Reorder the owners items among the positions they already have, then let the rotation sort it out
+	positions := make([]int, 0)
+	queue := make([]PlaylistItem, 0)
+	for i := start; i < len(items); i++ {
+		if items[i].owner != owner {
+			continue
+		}
+		positions = append(positions, i)
+		if i == before {
+			queue = append(queue, items[index])
+		}
+		if i != index {
+			queue = append(queue, items[i])
+		}
+	}
+	if before == len(items) {
+		queue = append(queue, items[index])
+	}
+
+	p.recordChange(PlaylistActionMove, by)
+	newItems := make([]PlaylistItem, len(items))
+	copy(newItems, items)
+	for i, pos := range positions {
+		newItems[pos] = queue[i]
+	}
+	p.CurrentPlaylist.Items = newItems
+	p.rebuildRotation()
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type QueueMoveRequest struct {
+	Index  int `json:"index"`  // Playlist index of one of your upcoming items
+	Before int `json:"before"` // Playlist index of another one of your items, or the playlist length for the end of your queue
+}
+
+// Lets people reorder their own queue in rotation mode
+func (s *Server) handleQueueMove(session fnet.Session, req QueueMoveRequest) {
+	if !s.checkRole(session, s.addRole(), true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	name, _ := session.Data.GetString("name")
+	err := room.Player.MoveOwnItem(name, viewerKey(session), req.Index, req.Before)
+	if s.checkError(session, err, EvtQueueMove) {
+		return
+	}
+	room.broadcastPlaylistStatus()
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"github.com/jonas747/fnet"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Roles used for permission settings in the config
+const (
+	RoleMaster = "master"
+	RoleMod    = "mod"
+	RoleUser   = "user"
+)
+
+var (
+	ErrNoMediaRoots     = errors.New("No media roots configured")
+	ErrPathNotAllowed   = errors.New("Path is not inside any of the media roots")
+	ErrMediaNotFound    = errors.New("File not found")
+	ErrMediaIsDirectory = errors.New("Path is a directory")
+)
+
+func ValidateRole(role string) error {
+	switch role {
+	case RoleMaster, RoleMod, RoleUser:
+		return nil
+	}
+	return errors.New("Invalid role, must be one of master, mod or user")
+}
+
+// checkRole checks if the session has atleast the specified role
+func (s *Server) checkRole(session fnet.Session, role string, respond bool) bool {
+	switch role {
+	case RoleUser:
+		return !s.checkBanned(session, respond)
+	case RoleMod:
+		return s.checkMod(session, respond)
+	}
+	return s.checkMaster(session, respond)
+}
+
+// The role needed to add things to the playlist
+func (s *Server) addRole() string {
+	s.configLock.RLock()
+	role := s.config.AddRole
+	s.configLock.RUnlock()
+
+	if ValidateRole(role) != nil {
+		return RoleMod
+	}
+	return role
+}
+
+// Returns the media roots with symlinks resolved
+func (s *Server) mediaRoots() []string {
+	roots, _ := s.resolveMediaRoots()
+	return roots
+}
+
+// resolveMediaRoots is mediaRoots that also returns the roots that couldn't be resolved, like a share that isn't mounted
+func (s *Server) resolveMediaRoots() (roots, failed []string) {
+	s.configLock.RLock()
+	configured := make([]string, len(s.config.MediaRoots))
+	copy(configured, s.config.MediaRoots)
+	s.configLock.RUnlock()
+
+	roots = make([]string, 0, len(configured))
+	for _, r := range configured {
+		abs, err := filepath.Abs(r)
+		if err != nil {
+			log.Println("Invalid media root", r, err)
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			log.Println("Invalid media root", r, err)
+			failed = append(failed, abs)
+			continue
+		}
+		roots = append(roots, resolved)
+	}
+	return roots, failed
+}
+
+func pathInRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveMediaPath resolves symlinks in path and makes sure it stays inside the media roots
+// The errors returned are the same whether or not a file exists outside the media roots
+func (s *Server) ResolveMediaPath(path string) (string, error) {
+	roots := s.mediaRoots()
+	if len(roots) < 1 {
+		return "", ErrNoMediaRoots
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", ErrPathNotAllowed
+	}
+
+	// Check before touching the filesystem so nothing can be learned about paths outside the roots
+	if !pathInRoots(abs, roots) && !pathInRoots(abs, s.configuredRootsAbs()) {
+		return "", ErrPathNotAllowed
+	}
+
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", ErrMediaNotFound
+	}
+
+	// Symlinks may point out of the roots
+	if !pathInRoots(resolved, roots) {
+		return "", ErrPathNotAllowed
+	}
+
+	return resolved, nil
+}
+
+// Same as ResolveMediaPath but the path also has to be a regular file
+func (s *Server) ResolveMediaFile(path string) (string, error) {
+	resolved, err := s.ResolveMediaPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", ErrMediaNotFound
+	}
+	if info.IsDir() {
+		return "", ErrMediaIsDirectory
+	}
+	return resolved, nil
+}
+
+// The configured roots without symlinks resolved, paths given through a symlinked root are checked against these first
+func (s *Server) configuredRootsAbs() []string {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	roots := make([]string, 0, len(s.config.MediaRoots))
+	for _, r := range s.config.MediaRoots {
+		abs, err := filepath.Abs(r)
+		if err == nil {
+			roots = append(roots, abs)
+		}
+	}
+	return roots
+}
+
+// filterAllowedItems drops all items outside the media roots, the ones kept get their resolved path so
+// a symlink changed later can't point them elsewhere
+func (s *Server) filterAllowedItems(items []PlaylistItem) []PlaylistItem {
+	allowed := make([]PlaylistItem, 0, len(items))
+	for _, item := range items {
+		resolved, err := s.ResolveMediaFile(item.Path)
+		if err != nil {
+			log.Printf("Skipping %s: %s\n", item.Path, err)
+			continue
+		}
+		item.Path = resolved
+		allowed = append(allowed, item)
+	}
+	return allowed
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestResolveMediaPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs symlinks")
+	}
+	tmp, err := ioutil.TempDir("", "fluffywatch-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// The temp dir can be behind a symlink itself
+	dir, err := filepath.EvalSymlinks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	media := filepath.Join(dir, "media")
+	for _, p := range []string{"media/a.mkv", "media/sub/b.mkv", "mediafoo/c.mkv", "outside/secret.mkv"} {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		os.MkdirAll(filepath.Dir(p), 0775)
+		ioutil.WriteFile(p, []byte("not really a video"), 0664)
+	}
+	os.Symlink(filepath.Join(dir, "outside", "secret.mkv"), filepath.Join(media, "link.mkv"))
+	os.Symlink(filepath.Join(dir, "outside"), filepath.Join(media, "dirlink"))
+	os.Symlink(filepath.Join(media, "sub", "b.mkv"), filepath.Join(media, "inside.mkv"))
+	os.Symlink(media, filepath.Join(dir, "rootlink"))
+
+	s := &Server{config: &Config{MediaRoots: []string{filepath.Join(dir, "rootlink")}}}
+
+	cases := []struct {
+		path    string
+		want    string
+		wantErr error
+	}{
+		{"media/a.mkv", "media/a.mkv", nil},
+		{"rootlink/a.mkv", "media/a.mkv", nil},
+		{"rootlink/sub/../a.mkv", "media/a.mkv", nil},
+		{"rootlink/inside.mkv", "media/sub/b.mkv", nil},
+		{"rootlink/missing.mkv", "", ErrMediaNotFound},
+		{"rootlink/../outside/secret.mkv", "", ErrPathNotAllowed},
+		{"rootlink/sub/../../outside/secret.mkv", "", ErrPathNotAllowed},
+		{"rootlink/link.mkv", "", ErrPathNotAllowed},
+		{"rootlink/dirlink/secret.mkv", "", ErrPathNotAllowed},
+		{"mediafoo/c.mkv", "", ErrPathNotAllowed},
+		{"rootlinkfoo/c.mkv", "", ErrPathNotAllowed},
+		{"outside/missing.mkv", "", ErrPathNotAllowed},
+	}
+	for _, c := range cases {
+		got, err := s.ResolveMediaPath(filepath.Join(dir, filepath.FromSlash(c.path)))
+		if err != c.wantErr {
+			t.Errorf("%s: err = %v, want %v", c.path, err, c.wantErr)
+			continue
+		}
+		if c.want != "" && got != filepath.Join(dir, filepath.FromSlash(c.want)) {
+			t.Errorf("%s: resolved to %s, want %s", c.path, got, c.want)
+		}
+	}
+
+	if _, err = s.ResolveMediaFile(filepath.Join(dir, "rootlink", "sub")); err != ErrMediaIsDirectory {
+		t.Errorf("directory: err = %v, want ErrMediaIsDirectory", err)
+	}
+
+	items := s.filterAllowedItems([]PlaylistItem{
+		{Path: filepath.Join(dir, "rootlink", "inside.mkv")},
+		{Path: filepath.Join(dir, "rootlink", "link.mkv")},
+	})
+	if len(items) != 1 || items[0].Path != filepath.Join(media, "sub", "b.mkv") {
+		t.Errorf("filtered to %+v, want only the resolved inside.mkv", items)
+	}
+}
@@ -0,0 +1,522 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule repeat modes
+const (
+	ScheduleOnce   = ""
+	ScheduleDaily  = "daily"
+	ScheduleWeekly = "weekly"
+)
+
+// If we were down when something was supposed to start it's still started if it's less than this late
+const ScheduleGrace = 5 * time.Minute
+
+// When to announce upcoming schedules
+var scheduleCountdowns = []time.Duration{
+	time.Hour,
+	30 * time.Minute,
+	10 * time.Minute,
+	5 * time.Minute,
+	time.Minute,
+	10 * time.Second,
+}
+
+// Marks a schedule as not announced yet
+const notAnnounced = time.Duration(math.MaxInt64)
+
+var ErrScheduleNotFound = errors.New("Schedule not found")
+
+type Schedule struct {
+	ID     int64          `json:"id"`
+	Title  string         `json:"title"`
+	At     time.Time      `json:"at"`     // The next time it starts
+	Repeat string         `json:"repeat"` // One of "", daily, weekly
+	Items  []PlaylistItem `json:"items"`  // Played next when it starts, if empty it just presses play
+	By     string         `json:"by"`
+
+	announced time.Duration // Smallest countdown announced for this occurrence
+}
+
+type Scheduler struct {
+	sync.Mutex
+	Path      string
+	Schedules []*Schedule
+	LastID    int64
+
+	room *Room
+}
+
+type schedulerState struct {
+	Schedules []*Schedule `json:"schedules"`
+	LastID    int64       `json:"lastId"`
+}
+
+func NewScheduler(room *Room, path string) *Scheduler {
+	return &Scheduler{
+		Path:      path,
+		Schedules: make([]*Schedule, 0),
+		room:      room,
+	}
+}
+
+func (s *Server) schedulePath() string {
+	s.configLock.RLock()
+	path := s.config.SchedulePath
+	s.configLock.RUnlock()
+
+	if path == "" {
+		path = "schedules.json"
+	}
+	return path
+}
+
+// scheduleLocation is the time zone schedules are in, recurring schedules keep their wall clock time
+// in it across daylight saving changes
+func (s *Server) scheduleLocation() *time.Location {
+	s.configLock.RLock()
+	zone := s.config.TimeZone
+	s.configLock.RUnlock()
+
+	if zone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		log.Println("Invalid time zone", zone, err)
+		return time.Local
+	}
+	return loc
+}
+
+func (s *Scheduler) Load() error {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+
+	var state schedulerState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.Schedules = state.Schedules
+	s.LastID = state.LastID
+	for _, sched := range s.Schedules {
+		sched.announced = notAnnounced
+	}
+	s.Unlock()
+
+	log.Printf("Loaded %d schedules\n", len(state.Schedules))
+	return nil
+}
+
+// save writes the schedules to disk
+// the caller must hold the lock
+func (s *Scheduler) save() error {
+	marshalled, err := json.MarshalIndent(schedulerState{Schedules: s.Schedules, LastID: s.LastID}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(s.Path); dir != "" {
+		err = os.MkdirAll(dir, 0775)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write to a temp file first so a crash doesnt leave broken state behind
+	tmpPath := s.Path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, marshalled, 0664)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.Path)
+}
+
+func (s *Scheduler) Add(sched *Schedule) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.LastID++
+	sched.ID = s.LastID
+	sched.announced = notAnnounced
+	s.Schedules = append(s.Schedules, sched)
+	s.sort()
+	return s.save()
+}
+
+func (s *Scheduler) Remove(id int64) (*Schedule, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, sched := range s.Schedules {
+		if sched.ID == id {
+			s.Schedules = append(s.Schedules[:i], s.Schedules[i+1:]...)
+			return sched, s.save()
+		}
+	}
+	return nil, ErrScheduleNotFound
+}
+
+func (s *Scheduler) List() []Schedule {
+	s.Lock()
+	defer s.Unlock()
+
+	out := make([]Schedule, 0, len(s.Schedules))
+	for _, sched := range s.Schedules {
+		out = append(out, *sched)
+	}
+	return out
+}
+
+// the caller must hold the lock
+func (s *Scheduler) sort() {
+	sort.SliceStable(s.Schedules, func(i, j int) bool { return s.Schedules[i].At.Before(s.Schedules[j].At) })
+}
+
+// Run checks the schedules every second, announcing and starting them
+func (s *Scheduler) Run() {
+	err := s.Load()
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed loading schedules:", err)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.tick(now)
+		case <-s.room.quit:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) tick(now time.Time) {
+	announcements := make([]string, 0)
+	starting := make([]Schedule, 0)
+	loc := s.room.server.scheduleLocation()
+
+	s.Lock()
+	changed := false
+	kept := s.Schedules[:0]
+	for _, sched := range s.Schedules {
+		remaining := sched.At.Sub(now)
+
+		if remaining <= 0 {
+			if -remaining <= ScheduleGrace {
+				starting = append(starting, *sched)
+			} else {
+				log.Printf("Missed schedule %q at %s\n", sched.Title, sched.At)
+			}
+
+			changed = true
+			if !sched.advance(now, loc) {
+				// Not recurring, it's done
+				continue
+			}
+		} else if mark := countdownMark(remaining); mark < sched.announced {
+			sched.announced = mark
+			announcements = append(announcements, fmt.Sprintf("%s starts in %s", sched.Title, formatCountdown(remaining)))
+		}
+		kept = append(kept, sched)
+	}
+	s.Schedules = kept
+
+	if changed {
+		s.sort()
+		err := s.save()
+		if err != nil {
+			log.Println("Failed saving schedules:", err)
+		}
+	}
+	s.Unlock()
+
+	for _, a := range announcements {
+		s.room.broadcastNotification(a, true)
+	}
+	for _, sched := range starting {
+		s.room.startSchedule(sched)
+	}
+	if changed {
+		s.room.broadcastSchedules()
+	}
+}
+
+// advance moves a recurring schedule to its next occurrence after now, returns false if it doesnt repeat
+func (sched *Schedule) advance(now time.Time, loc *time.Location) bool {
+	if sched.Repeat == ScheduleOnce {
+		return false
+	}
+
+	// AddDate in the schedule's zone keeps the wall clock time over daylight saving changes
+	at := sched.At.In(loc)
+	for !at.After(now) {
+		if sched.Repeat == ScheduleDaily {
+			at = at.AddDate(0, 0, 1)
+		} else {
+			at = at.AddDate(0, 0, 7)
+		}
+	}
+	sched.At = at
+	sched.announced = notAnnounced
+	return true
+}
+
+// countdownMark returns the smallest countdown remaining is within, or notAnnounced if none
+func countdownMark(remaining time.Duration) time.Duration {
+	mark := notAnnounced
+	for _, c := range scheduleCountdowns {
+		if remaining <= c && c < mark {
+			mark = c
+		}
+	}
+	return mark
+}
+
+func formatCountdown(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d seconds", int((d+time.Second-1)/time.Second))
+	}
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes == 1 {
+		return "1 minute"
+	}
+	if minutes >= 60 && minutes%60 == 0 {
+		if minutes == 60 {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", minutes/60)
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+func (r *Room) startSchedule(sched Schedule) {
+	log.Printf("Starting schedule %q in %s\n", sched.Title, r.Name)
+	r.broadcastNotification(fmt.Sprintf("%s is starting!", sched.Title), true)
+
+	// The channel is only for between the scheduled things
+	if r.Channel.IsActive() {
+		err := r.Channel.Stop(false)
+		if err != nil {
+			log.Println("Failed stopping channel:", err)
+		}
+		r.broadcastGuide()
+	}
+
+	items := r.server.filterAllowedItems(sched.Items)
+	if len(sched.Items) > 0 && len(items) < 1 {
+		log.Println("Nothing in the schedule is inside the media roots anymore, just pressing play")
+	}
+	r.Player.PlayScheduled(sched.Title, items)
+	r.broadcastPlaylistStatus()
+}
+
+// PlayScheduled plays the items right away, or just starts playing if there are none
+func (p *Player) PlayScheduled(by string, items []PlaylistItem) {
+	p.do(func() {
+		if len(items) > 0 {
+			pos := p.nextIndex()
+			p.recordChange(PlaylistActionAdd, by)
+			p.insertItems(pos, items)
+
+			p.Settings.Seek = ""
+			p.jumpTo(pos)
+			if p.Playing {
+				p.stopTranscode()
+				return
+			}
+		}
+
+		if !p.Playing {
+			p.start()
+		}
+	})
+}
+
+type ScheduleRequest struct {
+	Title  string `json:"title"`
+	At     string `json:"at"`     // RFC3339, or "2006-01-02 15:04" in the configured time zone
+	Repeat string `json:"repeat"` // One of "", daily, weekly
+
+	// What to play, a search or browse result, a path inside the media roots, or nothing to just press play
+	Source string `json:"source"`
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+}
+
+type SchedulesReply struct {
+	Schedules []Schedule `json:"schedules"`
+}
+
+type ScheduleRemoveRequest struct {
+	ID int64 `json:"id"`
+}
+
+func (s *Server) parseScheduleTime(in string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, in); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, in, s.scheduleLocation()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid time, use yyyy-mm-dd hh:mm")
+}
+
+// resolveScheduleItems finds what the schedule should play
+func (s *Server) resolveScheduleItems(req ScheduleRequest) ([]PlaylistItem, error) {
+	var items []PlaylistItem
+	var err error
+
+	switch {
+	case req.Path != "":
+		var path string
+		path, err = s.ResolveMediaPath(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		info, statErr := os.Stat(path)
+		if statErr != nil {
+			return nil, ErrMediaNotFound
+		}
+		if info.IsDir() {
+			items, err = s.ScanMediaDir(path)
+		} else {
+			items = []PlaylistItem{s.newMediaItem(path)}
+		}
+	case req.ID != "":
+		var source MediaSource
+		source, err = s.GetMediaSource(req.Source)
+		if err != nil {
+			return nil, err
+		}
+		items, err = source.Resolve(req.ID, ResolveOptions{})
+		if err == nil && source.ID() != SourceLocal {
+			for i := range items {
+				s.applyLocalMetadata(&items[i])
+			}
+		}
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items = s.filterAllowedItems(items)
+	if len(items) < 1 {
+		return nil, errors.New("Nothing to play, the files are not inside the media roots")
+	}
+	return items, nil
+}
+
+func (s *Server) handleSchedule(session fnet.Session, req ScheduleRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	if req.Repeat != ScheduleOnce && req.Repeat != ScheduleDaily && req.Repeat != ScheduleWeekly {
+		s.sendErrResp(session, errors.New("Repeat has to be empty, daily or weekly"), EvtSchedule)
+		return
+	}
+
+	at, err := s.parseScheduleTime(req.At)
+	if s.checkError(session, err, EvtSchedule) {
+		return
+	}
+	if !at.After(time.Now()) {
+		s.sendErrResp(session, errors.New("That's in the past"), EvtSchedule)
+		return
+	}
+
+	items, err := s.resolveScheduleItems(req)
+	if s.checkError(session, err, EvtSchedule) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	name, _ := session.Data.GetString("name")
+	sched := &Schedule{
+		Title:  strings.TrimSpace(req.Title),
+		At:     at,
+		Repeat: req.Repeat,
+		Items:  items,
+		By:     name,
+	}
+	if sched.Title == "" {
+		if len(items) == 1 {
+			sched.Title = items[0].Title
+		} else {
+			sched.Title = "The show"
+		}
+	}
+
+	err = room.Scheduler.Add(sched)
+	if err != nil {
+		log.Println("Failed saving schedules:", err)
+		s.sendErrResp(session, errors.New("Failed saving the schedule"), EvtSchedule)
+		return
+	}
+
+	when := at.In(s.scheduleLocation()).Format("Mon Jan 2 15:04 MST")
+	switch req.Repeat {
+	case ScheduleDaily:
+		when = "daily from " + when
+	case ScheduleWeekly:
+		when = "weekly from " + when
+	}
+	room.broadcastNotification(fmt.Sprintf("%s Scheduled %s %s", name, sched.Title, when), true)
+	room.broadcastSchedules()
+}
+
+// Responds with the schedules
+func (s *Server) handleSchedules(session fnet.Session) {
+	err := s.netEngine.CreateAndSend(session, EvtSchedules, SchedulesReply{Schedules: s.sessionRoom(session).Scheduler.List()})
+	if err != nil {
+		log.Println("Error sending schedules: ", err)
+	}
+}
+
+func (s *Server) handleScheduleRemove(session fnet.Session, req ScheduleRemoveRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	sched, err := room.Scheduler.Remove(req.ID)
+	if s.checkError(session, err, EvtScheduleRemove) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Unscheduled %s", name, sched.Title), true)
+	room.broadcastSchedules()
+}
+
+func (r *Room) broadcastSchedules() {
+	err := r.CreateAndBroadcast(EvtSchedules, SchedulesReply{Schedules: r.Scheduler.List()})
+	if err != nil {
+		log.Println("Error broadcasting schedules: ", err)
+	}
+}
@@ -0,0 +1,809 @@
+package server
+
+/*
+
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"github.com/jonas747/fnet/ws"
+	"github.com/jonas747/plex"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EvtSetName             int32 = 1
+	EvtPlaylist                  = 2
+	EvtStatus                    = 3
+	EvtSearch                    = 4
+	EvtPlaylistAdd               = 5
+	EvtPlaylistRemove            = 6
+	EvtPlaylistMove              = 7
+	EvtSettings                  = 8
+	EvtSetSettings               = 9
+	EvtPlay                      = 10
+	EvtPause                     = 11
+	EvtNext                      = 12
+	EvtPrev                      = 13
+	EvtSeek                      = 14
+	EvtPlaylistClear             = 15
+	EvtUserJoin                  = 16
+	EvtUserLeave                 = 17
+	EvtWatchingStateChange       = 18
+	EvtChatMessage               = 19
+	EvtNotification              = 20
+	EvtError                     = 21
+	EvtAuth                      = 22
+	EvtChatCmd                   = 23
+	EvtReloadPlaylist            = 24
+	EvtAddByPath                 = 25
+	EvtPlaylistExport            = 26
+	EvtBrowse                    = 27
+	EvtThumbnail                 = 28
+	EvtSourceBrowse              = 29
+	EvtPlaylistUndo              = 30
+	EvtPlaylistRedo              = 31
+	EvtSetPlaybackMode           = 32
+	EvtSuggest                   = 33
+	EvtSuggestions               = 34
+	EvtSuggestionApprove         = 35
+	EvtSuggestionReject          = 36
+	EvtVote                      = 37
+	EvtVoteVeto                  = 38
+	EvtQueueMove                 = 39
+	EvtSchedule                  = 40
+	EvtSchedules                 = 41
+	EvtScheduleRemove            = 42
+	EvtChannel                   = 43
+	EvtChannelGuide              = 44
+	EvtJoinRoom                  = 45
+	EvtRooms                     = 46
+	EvtRoomCreate                = 47
+	EvtRoomDelete                = 48
+	EvtFFmpegCommand             = 49
+	EvtPreviewSettings           = 50
+)
+
+const VERSION = "3.0.0 (2016/12/08)"
+
+var (
+	// Valid presets for x264
+	ValidPresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+	//viewers      *int32
+)
+
+type Config struct {
+	Master          string   `json:"master"`
+	Mods            []string `json:"mods"`
+	Listen          string   `json:"listen"`
+	HTTPListen      string   `json:"httpListen"`  // Address the http server for artwork and such listens on, empty disables it
+	HTTPBaseURL     string   `json:"httpBaseUrl"` // Public url of the http server, used in links sent to clients
+	PlaylistPath    string   `json:"playlistPath"`
+	HLSPlaylistPath string   `json:"hls_playlist_path"`
+	SegmentDir      string   `json:"segment_dir"`
+	Playlist        []string `json:"-"`
+	Bans            []string `json:"bans"`
+	IPBans          []string `json:"ipBans"`
+	MediaRoots      []string `json:"mediaRoots"` // Only files inside these can be played
+	AddRole         string   `json:"addRole"`    // Who can add to the playlist, one of master, mod or user
+	CacheDir        string   `json:"cacheDir"`   // Where thumbnails and such are stored
+	SchedulePath    string   `json:"schedulePath"`
+	TimeZone        string   `json:"timeZone"` // IANA name like Europe/Oslo that schedules are in, defaults to the system's
+
+	LibraryScanInterval int `json:"libraryScanInterval"` // Seconds between media root rescans
+	SuggestionLimit     int `json:"suggestionLimit"`     // Pending suggestions per viewer
+	SuggestionCooldown  int `json:"suggestionCooldown"`  // Seconds between suggestions from a viewer, -1 disables it
+
+	VoteMode      bool    `json:"voteMode"`      // Let viewers vote to skip, pause and play
+	VoteThreshold float64 `json:"voteThreshold"` // Share of the watching viewers needed for a vote to pass
+
+	Channel  ChannelConfig  `json:"channel"`
+	Plex     PlexConfig     `json:"plex"`
+	Rooms    []RoomConfig   `json:"rooms"` // Rooms besides the main one, which uses the fields above. Edits by hand need a restart
+	Jellyfin JellyfinConfig `json:"jellyfin"`
+	FFmpeg   FFmpegConfig   `json:"ffmpeg"`
+}
+
+// Server is a fluffywatch instance, all its state is in here so several can run in one process
+type Server struct {
+	configLock     sync.RWMutex
+	config         *Config
+	lastConfigLoad time.Time
+	configPath     string  // Empty if the config was passed with WithConfig, then changes arent saved
+	pendingConfig  *Config // The file's version when it has changes that need a restart, see reloadConfig
+	playlistPath   string  // Playlist the main room loads at startup and reloads from
+
+	netEngine *fnet.Engine
+	idGenChan chan int64
+
+	rooms     map[string]*Room
+	roomsLock sync.RWMutex
+
+	library    *Library
+	transcoder Transcoder
+
+	previewRunning bool // Only one test encode at a time, see previewSettings
+	previewLock    sync.Mutex
+
+	probeCache     map[string]probeCacheEntry // By path, see ProbeFile
+	probeCacheLock sync.Mutex
+	thumbnailLock  sync.Mutex // Only one thumbnail ffmpeg at a time
+
+	// Plex client, recreated when the plex config changes
+	pms       *plex.PlexServer
+	pmsConfig PlexConfig
+	pmsLock   sync.Mutex
+
+	wsListener *ws.WebsocketListener
+	httpServer *http.Server
+	quit       chan struct{} // Closed on shutdown to stop the background loops
+	stopOnce   sync.Once
+}
+
+type Option func(s *Server)
+
+// WithConfigPath sets the config file to load, it's reloaded when it changes. Defaults to config.json
+func WithConfigPath(path string) Option {
+	return func(s *Server) {
+		s.configPath = path
+	}
+}
+
+// WithConfig uses c instead of loading a config file, changes to it like added mods aren't saved
+func WithConfig(c *Config) Option {
+	return func(s *Server) {
+		s.config = c
+		s.configPath = ""
+	}
+}
+
+// WithPlaylistPath sets the playlist file the main room loads at startup. Defaults to playlist
+func WithPlaylistPath(path string) Option {
+	return func(s *Server) {
+		s.playlistPath = path
+	}
+}
+
+// WithTranscoder sets what the players transcode with. Defaults to running ffmpeg
+func WithTranscoder(t Transcoder) Option {
+	return func(s *Server) {
+		s.transcoder = t
+	}
+}
+
+func New(options ...Option) *Server {
+	s := &Server{
+		configPath:   "config.json",
+		playlistPath: "playlist",
+		idGenChan:    make(chan int64),
+		rooms:        make(map[string]*Room),
+		quit:         make(chan struct{}),
+	}
+	s.transcoder = &ffmpegTranscoder{server: s}
+	for _, o := range options {
+		o(s)
+	}
+	return s
+}
+
+// Start loads the config, starts the rooms and starts listening
+func (s *Server) Start() error {
+	go incIdGen(s.idGenChan, s.quit)
+
+	watchConfig := false
+	if s.config == nil {
+		c, err := loadConfig(s.configPath)
+		if os.IsNotExist(err) {
+			log.Println("No config at", s.configPath, "using the default one")
+			s.config = &Config{
+				Master:     "*",
+				Mods:       make([]string, 0),
+				Listen:     ":7449",
+				MediaRoots: make([]string, 0),
+				AddRole:    RoleMod,
+				//Publish: "rtmp://jonas747.com/cinema/live",
+			}
+		} else if err != nil {
+			return fmt.Errorf("Failed loading config %s: %s", s.configPath, err)
+		} else {
+			s.config = c
+			if finfo, err := os.Stat(s.configPath); err == nil {
+				s.lastConfigLoad = finfo.ModTime()
+			}
+			watchConfig = true
+		}
+	}
+
+	var httpListener net.Listener
+	if s.config.HTTPListen != "" {
+		// Listen here so a taken port is returned instead of just logged
+		var err error
+		httpListener, err = net.Listen("tcp", s.config.HTTPListen)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.library = NewLibrary(s, s.cacheDir("library.json"))
+	go s.library.Run()
+
+	if watchConfig {
+		go s.configLoader(s.configPath)
+	}
+
+	// Rooms broadcast as soon as they start playing, so the engine has to be there first
+	s.netEngine = fnet.DefaultEngine()
+	s.netEngine.Encoder = fnet.JsonEncoder{} // Use json instead of protocol buffers
+	s.netEngine.OnConnOpen = s.onOpenConn
+	s.netEngine.OnConnClose = s.onClosedConn
+
+	s.startRooms()
+
+	s.AddHandlers(s.netEngine)
+	listen := s.config.Listen
+	if listen == "" {
+		listen = ":7447"
+	}
+	log.Println("Listening on", listen)
+	s.wsListener = &ws.WebsocketListener{
+		Engine: s.netEngine,
+		Addr:   listen,
+	}
+
+	if httpListener != nil {
+		mux := http.NewServeMux()
+		s.AddHTTPHandlers(mux)
+		s.httpServer = &http.Server{Handler: mux}
+		go s.serveHTTP(s.httpServer, httpListener)
+	}
+
+	go s.CleanupLoop()
+	go s.netEngine.AddListener(s.wsListener)
+	go s.netEngine.ListenChannels()
+	go s.listenErrors()
+	return nil
+}
+
+// Shutdown stops playback in all rooms and saves where they were, stops the background loops, closes the
+// http server and disconnects everyone. It can take up to TranscodeStopTimeout and a bit
+func (s *Server) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+	})
+
+	if s.wsListener != nil {
+		s.wsListener.Stop()
+	}
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+
+	s.roomsLock.Lock()
+	rooms := s.rooms
+	s.rooms = make(map[string]*Room)
+	s.roomsLock.Unlock()
+
+	// All at once so it doesn't add up to a stop timeout per room
+	var wg sync.WaitGroup
+	for _, room := range rooms {
+		room.broadcastNotification("The server is shutting down", true)
+
+		wg.Add(1)
+		go func(r *Room) {
+			r.Close()
+			wg.Done()
+		}(room)
+	}
+	wg.Wait()
+
+	sessions := make([]fnet.Session, 0)
+	for _, room := range rooms {
+		room.viewersMutex.RLock()
+		for _, session := range room.viewers {
+			sessions = append(sessions, session)
+		}
+		room.viewersMutex.RUnlock()
+	}
+	for _, session := range sessions {
+		session.Conn.Close()
+	}
+	log.Println("Shut down")
+}
+
+// KillTranscodes kills every ffmpeg that is still running right away, for when Shutdown takes too long
+// and the process is about to exit without waiting for it
+func (s *Server) KillTranscodes() {
+	if ft, ok := s.transcoder.(*ffmpegTranscoder); ok {
+		ft.killAll()
+	}
+}
+
+func (s *Server) AddHandlers(engine *fnet.Engine) {
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlerUserSetName, EvtSetName))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleStatus, EvtStatus))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlaylist, EvtPlaylist))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSearch, EvtSearch))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlaylistAdd, EvtPlaylistAdd))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlaylistRemove, EvtPlaylistRemove))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlaylistMove, EvtPlaylistMove))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlaylistUndo, EvtPlaylistUndo))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlaylistRedo, EvtPlaylistRedo))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSetPlaybackMode, EvtSetPlaybackMode))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSuggest, EvtSuggest))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSuggestions, EvtSuggestions))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSuggestionApprove, EvtSuggestionApprove))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSuggestionReject, EvtSuggestionReject))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleVote, EvtVote))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleVoteVeto, EvtVoteVeto))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleQueueMove, EvtQueueMove))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSchedule, EvtSchedule))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSchedules, EvtSchedules))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleScheduleRemove, EvtScheduleRemove))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleChannel, EvtChannel))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleChannelGuide, EvtChannelGuide))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleJoinRoom, EvtJoinRoom))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleRooms, EvtRooms))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleRoomCreate, EvtRoomCreate))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleRoomDelete, EvtRoomDelete))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSettings, EvtSettings))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSetSettings, EvtSetSettings))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlaylistClear, EvtPlaylistClear))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlay, EvtPlay))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePause, EvtPause))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleNext, EvtNext))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePrevious, EvtPrev))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSeek, EvtSeek))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleFFmpegCommand, EvtFFmpegCommand))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePreviewSettings, EvtPreviewSettings))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleWatchingStatusUpdate, EvtWatchingStateChange))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleChatMessage, EvtChatMessage))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleAuth, EvtAuth))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleChatCmd, EvtChatCmd))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleReloadPlaylist, EvtReloadPlaylist))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleAddByPath, EvtAddByPath))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handlePlaylistExport, EvtPlaylistExport))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleBrowse, EvtBrowse))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleThumbnail, EvtThumbnail))
+	engine.AddHandler(fnet.NewHandlerSafe(s.handleSourceBrowse, EvtSourceBrowse))
+}
+
+// Loads a playlist in any of the supported formats and appends the items not already in the playlist
+// by is who reloaded it for the undo history, empty when loading at startup
+func (s *Server) loadPlaylist(player *Player, path, by string) error {
+	log.Println("Started playlist loading")
+	items, err := s.readPlaylistFile(path)
+	if err != nil {
+		return err
+	}
+
+	player.do(func() {
+		if by != "" {
+			player.recordChange(PlaylistActionReload, by)
+		}
+	OUTER:
+		for _, item := range items {
+			for _, v := range player.CurrentPlaylist.Items {
+				if v.Path == item.Path {
+					// Only add new items
+					log.Println("Skipping", v.Path)
+					continue OUTER
+				}
+			}
+
+			log.Printf("Adding %s to the playlist...\n", item.Path)
+			player.CurrentPlaylist.Items = append(player.CurrentPlaylist.Items, item)
+		}
+	})
+	return nil
+}
+
+// readPlaylistFile reads a playlist in any of the supported formats, leaving out what's not inside the media roots
+func (s *Server) readPlaylistFile(path string) ([]PlaylistItem, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := DetectPlaylistFormat(path, data)
+	items, err := ParsePlaylist(data, format, filepath.Dir(absPath))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d items from %s playlist %s\n", len(items), format, path)
+	return s.filterAllowedItems(items), nil
+}
+
+func LogSendError(r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("Error sending response to [%s] Error: %s", r.RemoteAddr, err.Error())
+}
+
+// ValidatePath makes sure path is a file inside the media roots
+func (s *Server) ValidatePath(path string) error {
+	_, err := s.ResolveMediaFile(path)
+	if err == ErrMediaIsDirectory {
+		// We cant stream a directory, silly you
+		return errors.New("WHY THE FUCK ARE YOU TRYING TO STREAM A DIRECTORY YOU PIECE OF SHIT GO DIE")
+	}
+	return err
+}
+
+func ValidatePreset(preset string) error {
+	found := false
+	for _, p := range ValidPresets {
+		if p == preset {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("Invalid preset, check for typos and spaces at the beginning or end")
+	}
+	return nil
+}
+
+type ViewerChange struct {
+	Name     string
+	Watching bool
+}
+
+func (s *Server) onClosedConn(session fnet.Session) {
+	name, _ := session.Data.GetString("name")
+	if room := s.sessionRoom(session); room != nil {
+		// Nil after shutting down
+		room.leave(session)
+	}
+	log.Println(name, " disconnected!")
+}
+
+func (s *Server) onOpenConn(session fnet.Session) {
+	log.Println("Someone connected!")
+	// Everyone starts out in the main room, clients for other rooms join theirs right after
+	room := s.getRoom(MainRoom)
+	if room == nil {
+		// Shutting down
+		session.Conn.Close()
+		return
+	}
+	pl, err := room.buildPlaylistMessage()
+	if err != nil {
+		log.Println("Error building playlist message!: ", err)
+		return
+	}
+	session.Conn.Send(pl)
+
+	s.sendNotification(session, fmt.Sprintf("Connected to fluffywatch %s!", VERSION), true)
+	room.join(session)
+}
+
+func (s *Server) listenErrors() {
+	for {
+		select {
+		case err := <-s.netEngine.ErrChan:
+			log.Println("fnet Error:", err)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func incIdGen(out chan int64, quit chan struct{}) {
+	curId := int64(0)
+	for {
+		select {
+		case out <- curId:
+			curId++
+		case <-quit:
+			return
+		}
+	}
+}
+
+type Notification struct {
+	Msg    string `json:"msg"`
+	Bypass bool   `json:"bypass"` // Bypass ignore sys
+}
+
+func (r *Room) broadcastNotification(notification string, bypass bool) {
+	n := Notification{notification, bypass}
+
+	err := r.CreateAndBroadcast(EvtNotification, n)
+	if err != nil {
+		log.Println("Error broadcasting notification message: ", err)
+		return
+	}
+}
+
+func (s *Server) sendNotification(session fnet.Session, text string, bypass bool) {
+	n := Notification{text, bypass}
+
+	err := s.netEngine.CreateAndSend(session, EvtNotification, n)
+	if err != nil {
+		log.Println("Error sending notification message: ", err)
+		return
+	}
+}
+
+func (s *Server) configLoader(path string) {
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			finfo, err := os.Stat(path)
+			if err != nil {
+				log.Println("Failed stat config", err)
+				continue
+			}
+			if !finfo.ModTime().Equal(s.lastConfigLoad) {
+				// Set first so a broken config is only complained about once
+				s.lastConfigLoad = finfo.ModTime()
+				s.reloadConfig(path)
+			}
+		case <-s.quit:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func loadConfig(path string) (*Config, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+	err = json.Unmarshal(file, &c)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *Server) saveConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+	marshalled, err := s.configForSave()
+	if err != nil {
+		return err
+	}
+
+	// Through a temp file like the library index, a half written config would fail the next reload
+	// or the next start
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, marshalled, 0664)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// roomLists returns the mods, bans and ip bans of the room in the config so they can be changed
+// the caller must hold configLock
+func (s *Server) roomLists(room string) (mods, bans, ipBans *[]string, err error) {
+	if room == MainRoom {
+		return &s.config.Mods, &s.config.Bans, &s.config.IPBans, nil
+	}
+	for i := range s.config.Rooms {
+		if s.config.Rooms[i].Name == room {
+			rc := &s.config.Rooms[i]
+			return &rc.Mods, &rc.Bans, &rc.IPBans, nil
+		}
+	}
+	return nil, nil, nil, ErrRoomNotFound
+}
+
+func (s *Server) addMod(room, id string) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	mods, _, _, err := s.roomLists(room)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range *mods {
+		if id == m {
+			return errors.New("Allready mod")
+		}
+	}
+
+	*mods = append(*mods, id)
+	return s.saveConfig(s.configPath)
+}
+
+func (s *Server) removeMod(room, id string) error {
+	newMods := make([]string, 0)
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	mods, _, _, err := s.roomLists(room)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, m := range *mods {
+		if m != id {
+			newMods = append(newMods, m)
+		} else {
+			found = true
+		}
+	}
+
+	if !found {
+		return errors.New("User not mod?")
+	}
+	*mods = newMods
+	return s.saveConfig(s.configPath)
+}
+
+func (s *Server) banUser(room, id string) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	_, bans, _, err := s.roomLists(room)
+	if err != nil {
+		return err
+	}
+	for _, m := range *bans {
+		if id == m {
+			return errors.New("Allready banned")
+		}
+	}
+
+	*bans = append(*bans, id)
+	return s.saveConfig(s.configPath)
+}
+
+func (s *Server) unBanUser(room, id string) error {
+	newBans := make([]string, 0)
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	_, bans, _, err := s.roomLists(room)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, m := range *bans {
+		if m != id {
+			newBans = append(newBans, m)
+		} else {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("User not banned?")
+	}
+	*bans = newBans
+	return s.saveConfig(s.configPath)
+}
+
+func (s *Server) banIP(room, ip string) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	_, _, ipBans, err := s.roomLists(room)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range *ipBans {
+		if ip == m {
+			return errors.New("Allready banned")
+		}
+	}
+
+	*ipBans = append(*ipBans, ip)
+	return s.saveConfig(s.configPath)
+}
+
+func (s *Server) unBanIP(room, ip string) error {
+	newBans := make([]string, 0)
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	_, _, ipBans, err := s.roomLists(room)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, m := range *ipBans {
+		if m != ip {
+			newBans = append(newBans, m)
+		} else {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("User not banned?")
+	}
+	*ipBans = newBans
+	return s.saveConfig(s.configPath)
+}
+
+func (s *Server) CleanupLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+
+		s.roomsLock.RLock()
+		segDirs := make([]string, 0, len(s.rooms))
+		for _, room := range s.rooms {
+			segDirs = append(segDirs, room.settings().SegmentDir)
+		}
+		s.roomsLock.RUnlock()
+
+		for _, segDir := range segDirs {
+			cleanupSegments(segDir)
+		}
+	}
+}
+
+// removeSegments removes all the segments in segDir, including half written ones
+func removeSegments(segDir string) {
+	files, err := ioutil.ReadDir(segDir)
+	if err != nil {
+		log.Println("Failed removing segments:", err)
+		return
+	}
+
+	for _, v := range files {
+		ext := filepath.Ext(v.Name())
+		if ext == ".ts" || strings.HasSuffix(v.Name(), ".ts.tmp") {
+			os.Remove(filepath.Join(segDir, v.Name()))
+		}
+	}
+}
+
+func cleanupSegments(segDir string) {
+	dir, err := ioutil.ReadDir(segDir)
+	if err != nil {
+		log.Println("ERr cleanup:", err)
+		return
+	}
+
+	for _, v := range dir {
+		split := strings.Split(v.Name(), ".")
+		if len(split) < 2 {
+			continue
+		}
+
+		if split[1] != "ts" {
+			continue
+		}
+
+		if time.Since(v.ModTime()) > time.Second*60 {
+			os.Remove(filepath.Join(segDir, v.Name()))
+			//log.Println("removing", v.Name())
+		}
+	}
+}
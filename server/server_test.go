@@ -0,0 +1,135 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jogramming/fluffywatch/server"
+	"github.com/jogramming/fluffywatch/transcoderfake"
+)
+
+type isolatedServer struct {
+	server     *server.Server
+	transcoder *transcoderfake.Transcoder
+	dir        string
+	media      []string
+}
+
+// startIsolated starts a server with its own config file, playlist file and transcoder, all under a temp dir
+func startIsolated(t *testing.T, name string) *isolatedServer {
+	dir, err := ioutil.TempDir("", "fluffywatch-"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	is := &isolatedServer{dir: dir, transcoder: transcoderfake.New()}
+	playlist := "#EXTM3U\n"
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(dir, "media", fmt.Sprintf("%s-%d.mkv", name, i))
+		os.MkdirAll(filepath.Dir(path), 0775)
+		ioutil.WriteFile(path, []byte("not really a video"), 0664)
+		is.media = append(is.media, path)
+		playlist += path + "\n"
+	}
+	playlistPath := filepath.Join(dir, "playlist.m3u")
+	ioutil.WriteFile(playlistPath, []byte(playlist), 0664)
+
+	config, _ := json.Marshal(&server.Config{
+		Master:          "*",
+		Listen:          "127.0.0.1:0",
+		MediaRoots:      []string{filepath.Join(dir, "media")},
+		CacheDir:        filepath.Join(dir, "cache"),
+		SegmentDir:      filepath.Join(dir, "segments"),
+		HLSPlaylistPath: filepath.Join(dir, "segments", "stream.m3u8"),
+	})
+	configPath := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(configPath, config, 0664)
+
+	is.server = server.New(
+		server.WithConfigPath(configPath),
+		server.WithPlaylistPath(playlistPath),
+		server.WithTranscoder(is.transcoder),
+	)
+	err = is.server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return is
+}
+
+// Two servers in one process shouldn't share anything
+func TestServersInParallel(t *testing.T) {
+	t.Parallel()
+
+	servers := []*isolatedServer{startIsolated(t, "one"), startIsolated(t, "two")}
+	for _, is := range servers {
+		room, err := is.server.CreateRoom(server.RoomConfig{Name: "extra"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		room.Player.AddPlaylistItem(server.PlaylistItem{Path: is.media[2]})
+		if err = room.Player.Play(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, is := range servers {
+		started, err := is.transcoder.WaitStarted(1, waitTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if started[0].Job().Item.Path != is.media[2] {
+			t.Errorf("%s transcoded %s", is.dir, started[0].Job().Item.Path)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, is := range servers {
+		wg.Add(1)
+		go func(is *isolatedServer) {
+			is.server.Shutdown()
+			wg.Done()
+		}(is)
+	}
+	wg.Wait()
+
+	for _, is := range servers {
+		// The main room saved its own playlist file's items
+		data, err := ioutil.ReadFile(filepath.Join(is.dir, "cache", server.PlayerStateFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state struct {
+			Playlist server.Playlist `json:"playlist"`
+		}
+		if err = json.Unmarshal(data, &state); err != nil {
+			t.Fatal(err)
+		}
+		if len(state.Playlist.Items) != len(is.media) {
+			t.Fatalf("%s main room has %d items, want %d", is.dir, len(state.Playlist.Items), len(is.media))
+		}
+		for i, item := range state.Playlist.Items {
+			if item.Path != is.media[i] {
+				t.Errorf("%s main room item %d is %s, want %s", is.dir, i, item.Path, is.media[i])
+			}
+		}
+
+		// And the created room ended up in its own config file only
+		data, err = ioutil.ReadFile(filepath.Join(is.dir, "config.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config server.Config
+		if err = json.Unmarshal(data, &config); err != nil {
+			t.Fatal(err)
+		}
+		if len(config.Rooms) != 1 || config.Rooms[0].Name != "extra" {
+			t.Errorf("%s config has rooms %+v", is.dir, config.Rooms)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPreviewSeconds = 5
+	MaxPreviewSeconds     = 30
+)
+
+var ErrPreviewRunning = errors.New("A preview is already running, wait for it to finish")
+
+// Validate checks that the settings are in sane ranges, the video ones are skipped for audio only
+func (t TranscoderSettings) Validate(audioOnly bool) error {
+	if !audioOnly {
+		if t.ScaleWidth < 16 || t.ScaleWidth > 7680 || t.ScaleWidth%2 != 0 {
+			return errors.New("Scale has to be an even number between 16 and 7680")
+		}
+		if t.MaxRate < 100 || t.MaxRate > 100000 {
+			return errors.New("Max rate has to be between 100 and 100000 kbit/s")
+		}
+		if err := ValidatePreset(t.Preset); err != nil {
+			return err
+		}
+	}
+
+	if len(t.Streams) > 16 {
+		return errors.New("Too many streams")
+	}
+	seen := make(map[int]bool)
+	for _, s := range t.Streams {
+		if s < 0 {
+			return errors.New("Stream indexes can't be negative")
+		}
+		if seen[s] {
+			return fmt.Errorf("Stream %d is in there twice", s)
+		}
+		seen[s] = true
+	}
+
+	if t.Seek != "" && !validLocation(t.Seek) {
+		return ErrInvalidSeek
+	}
+	return nil
+}
+
+// resolveSettings fills in the profile's numbers and validates the settings against it and the room's current item
+func (s *Server) resolveSettings(room *Room, settings TranscoderSettings) (TranscoderSettings, TranscoderProfile, error) {
+	profile, err := s.transcoderProfile(settings.Profile)
+	if err != nil {
+		return settings, profile, err
+	}
+	if settings.Profile != "" {
+		settings.ScaleWidth = profile.ScaleWidth
+		settings.MaxRate = profile.MaxRate
+		settings.Preset = profile.Preset
+	}
+
+	err = settings.Validate(profile.AudioOnly)
+	if err != nil {
+		return settings, profile, err
+	}
+
+	item, ok := room.Player.CurrentItem()
+	if !ok {
+		// Nothing to check the streams against
+		return settings, profile, nil
+	}
+	err = s.checkItemSettings(item, settings)
+	return settings, profile, err
+}
+
+// checkItemSettings checks that the item has the streams and is long enough for the seek
+func (s *Server) checkItemSettings(item PlaylistItem, settings TranscoderSettings) error {
+	probed, err := s.ProbeFile(item.Path)
+	if err != nil {
+		// Could be a file that isn't there anymore, that gets skipped anyways
+		log.Println("Failed probing", item.Path, "to check the settings:", err)
+		return nil
+	}
+
+	name := item.Title
+	if name == "" {
+		name = filepath.Base(item.Path)
+	}
+
+	for _, stream := range settings.Streams {
+		if !probed.HasStream(stream) {
+			return fmt.Errorf("%s has no stream %d, it has %d", name, stream, len(probed.Streams))
+		}
+	}
+
+	if settings.Seek != "" && probed.Duration > 0 && LocationSeconds(settings.Seek)*1000 >= probed.Duration {
+		return fmt.Errorf("Can't seek to %s, %s is only %s long", settings.Seek, name, StringLocation(probed.Duration/1000))
+	}
+	return nil
+}
+
+// CurrentItem returns the current item, ok is false if the playlist is empty
+func (p *Player) CurrentItem() (item PlaylistItem, ok bool) {
+	p.do(func() {
+		index := p.CurrentPlaylist.CurrentIndex
+		if index >= 0 && index < len(p.CurrentPlaylist.Items) {
+			item = p.CurrentPlaylist.Items[index]
+			ok = true
+		}
+	})
+	return
+}
+
+type PreviewSettingsRequest struct {
+	Settings TranscoderSettings `json:"settings"`
+	Seconds  int                `json:"seconds"` // How much to encode, defaults to DefaultPreviewSeconds
+}
+
+type PreviewSettingsReply struct {
+	Settings TranscoderSettings `json:"settings"` // With the profile filled in
+	Seconds  float64            `json:"seconds"`  // How much got encoded
+	Took     float64            `json:"took"`     // Seconds it took
+	Speed    float64            `json:"speed"`    // Times realtime, it has to stay above 1 to keep up
+	Size     int64              `json:"size"`     // Bytes of output
+	Bitrate  int                `json:"bitrate"`  // kbit/s the output came out at
+	Error    string             `json:"error,omitempty"`
+}
+
+// previewSettings encodes the start of the current item (or where the settings seek to) without touching the stream
+func (s *Server) previewSettings(room *Room, req PreviewSettingsRequest) (*PreviewSettingsReply, error) {
+	if req.Seconds <= 0 {
+		req.Seconds = DefaultPreviewSeconds
+	}
+	if req.Seconds > MaxPreviewSeconds {
+		req.Seconds = MaxPreviewSeconds
+	}
+
+	settings, profile, err := s.resolveSettings(room, req.Settings)
+	if err != nil {
+		return nil, err
+	}
+	item, ok := room.Player.CurrentItem()
+	if !ok {
+		return nil, errors.New("The playlist is empty, there's nothing to preview with")
+	}
+	err = s.ValidatePath(item.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.previewLock.Lock()
+	if s.previewRunning {
+		s.previewLock.Unlock()
+		return nil, ErrPreviewRunning
+	}
+	s.previewRunning = true
+	s.previewLock.Unlock()
+	defer func() {
+		s.previewLock.Lock()
+		s.previewRunning = false
+		s.previewLock.Unlock()
+	}()
+
+	dir, err := ioutil.TempDir("", "fluffywatch-preview")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	job := TranscodeJob{
+		Item:     item,
+		Settings: settings,
+		Profile:  profile,
+		Subs:     settings.Subs,
+		Output:   filepath.Join(dir, "preview.m3u8"),
+		Duration: time.Duration(req.Seconds) * time.Second,
+	}
+
+	started := time.Now()
+	t, err := s.transcoder.Start(job)
+	if err != nil {
+		return nil, err
+	}
+
+	var res TranscodeResult
+	// Way more than it should ever take, so a stuck encoder doesn't hang around forever
+	timeout := time.NewTimer(job.Duration*10 + 30*time.Second)
+	defer timeout.Stop()
+	select {
+	case res = <-t.Done():
+	case <-timeout.C:
+		res = waitStopped(t)
+		res.Reason = ExitFailed
+		res.Err = errors.New("Timed out, it's way too slow")
+	case <-s.quit:
+		waitStopped(t)
+		return nil, errors.New("The server is shutting down")
+	}
+	took := time.Since(started)
+
+	progress := t.Progress()
+	reply := &PreviewSettingsReply{
+		Settings: settings,
+		Seconds:  progress.Position.Seconds(),
+		Took:     took.Seconds(),
+		Speed:    progress.Speed,
+		Size:     dirSize(dir),
+	}
+	if reply.Seconds == 0 && res.Reason == ExitFinished {
+		reply.Seconds = job.Duration.Seconds()
+	}
+	if reply.Size == 0 {
+		reply.Size = progress.Size
+	}
+	if reply.Speed == 0 && took > 0 {
+		reply.Speed = reply.Seconds / took.Seconds()
+	}
+	if reply.Seconds > 0 {
+		reply.Bitrate = int(float64(reply.Size*8) / reply.Seconds / 1000)
+	}
+
+	switch res.Reason {
+	case ExitNoSubtitles:
+		reply.Error = "The item has no subtitles, turn subs off"
+	case ExitFailed, ExitStopped:
+		reply.Error = "Failed"
+		if res.Err != nil {
+			reply.Error = res.Err.Error()
+		}
+		if tail := lastLines(res.Output, 5); tail != "" {
+			reply.Error += ": " + tail
+		}
+	}
+	return reply, nil
+}
+
+// waitStopped stops t and waits for it to end, it's killed if it doesn't stop within TranscodeStopTimeout
+func waitStopped(t Transcode) TranscodeResult {
+	t.Stop()
+	select {
+	case res := <-t.Done():
+		return res
+	case <-time.After(TranscodeStopTimeout):
+	}
+
+	log.Println("Preview transcode didn't stop in time, killing it")
+	t.Kill()
+	return <-t.Done()
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// lastLines returns the last n lines of s, for showing the end of ffmpeg's output where the error is
+func lastLines(s string, n int) string {
+	// ffmpeg redraws its stats line with \r
+	s = strings.Replace(s, "\r", "\n", -1)
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// Runs a short test encode with the settings without applying them
+func (s *Server) handlePreviewSettings(session fnet.Session, req PreviewSettingsRequest) {
+	if !s.checkMaster(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	// Takes a couple of seconds, dont hold up the session meanwhile
+	go func() {
+		reply, err := s.previewSettings(room, req)
+		if s.checkError(session, err, EvtPreviewSettings) {
+			return
+		}
+		err = s.netEngine.CreateAndSend(session, EvtPreviewSettings, reply)
+		if err != nil {
+			log.Println("Error sending settings preview: ", err)
+		}
+	}()
+}
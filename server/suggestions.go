@@ -0,0 +1,292 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSuggestionLimit    = 3  // Pending suggestions per user
+	DefaultSuggestionCooldown = 30 // Seconds between suggestions from the same user
+)
+
+var ErrSuggestionNotFound = errors.New("Suggestion not found, it may already have been handled")
+
+type Suggestion struct {
+	ID        int64        `json:"id"`
+	By        string       `json:"by"` // Name of the user at the time
+	Item      PlaylistItem `json:"item"`
+	Submitted int64        `json:"submitted"` // Unix time
+
+	userKey string
+}
+
+type SuggestionQueue struct {
+	sync.Mutex
+	Pending []Suggestion
+
+	lastID     int64
+	lastSubmit map[string]time.Time // By user key and by ip, so logging in or out doesn't skip the cooldown
+}
+
+func NewSuggestionQueue() *SuggestionQueue {
+	return &SuggestionQueue{lastSubmit: make(map[string]time.Time)}
+}
+
+// Add queues a suggestion if the user is below the limits
+func (q *SuggestionQueue) Add(userKey, ip, by string, item PlaylistItem, limit int, cooldown time.Duration) (Suggestion, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Forget the ones that are past their cooldown so this doesn't grow with every viewer ever
+	for key, last := range q.lastSubmit {
+		if time.Since(last) >= cooldown {
+			delete(q.lastSubmit, key)
+		}
+	}
+
+	pending := 0
+	for _, s := range q.Pending {
+		if s.userKey == userKey {
+			pending++
+		}
+		if s.Item.Path == item.Path {
+			return Suggestion{}, errors.New("That has already been suggested")
+		}
+	}
+	if pending >= limit {
+		return Suggestion{}, fmt.Errorf("You can only have %d suggestions waiting at a time", limit)
+	}
+
+	ipKey := "ip:" + ip
+	for _, key := range []string{userKey, ipKey} {
+		if last, ok := q.lastSubmit[key]; ok {
+			wait := cooldown - time.Since(last)
+			return Suggestion{}, fmt.Errorf("Wait %d seconds before suggesting something else", int(wait.Seconds())+1)
+		}
+	}
+
+	q.lastID++
+	s := Suggestion{
+		ID:        q.lastID,
+		By:        by,
+		Item:      item,
+		Submitted: time.Now().Unix(),
+		userKey:   userKey,
+	}
+	q.Pending = append(q.Pending, s)
+	q.lastSubmit[userKey] = time.Now()
+	q.lastSubmit[ipKey] = time.Now()
+	return s, nil
+}
+
+// Take removes the suggestion from the queue and returns it
+func (q *SuggestionQueue) Take(id int64) (Suggestion, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	for i, s := range q.Pending {
+		if s.ID == id {
+			q.Pending = append(q.Pending[:i], q.Pending[i+1:]...)
+			return s, nil
+		}
+	}
+	return Suggestion{}, ErrSuggestionNotFound
+}
+
+func (q *SuggestionQueue) List() []Suggestion {
+	q.Lock()
+	defer q.Unlock()
+
+	out := make([]Suggestion, len(q.Pending))
+	copy(out, q.Pending)
+	return out
+}
+
+func (s *Server) suggestionLimits() (int, time.Duration) {
+	s.configLock.RLock()
+	limit := s.config.SuggestionLimit
+	cooldown := s.config.SuggestionCooldown
+	s.configLock.RUnlock()
+
+	if limit < 1 {
+		limit = DefaultSuggestionLimit
+	}
+	if cooldown < 0 {
+		cooldown = 0
+	} else if cooldown == 0 {
+		cooldown = DefaultSuggestionCooldown
+	}
+	return limit, time.Duration(cooldown) * time.Second
+}
+
+type SuggestRequest struct {
+	// Either a search or browse result
+	Source string `json:"source"`
+	ID     string `json:"id"`
+
+	// Or a path inside the media roots
+	Path string `json:"path"`
+}
+
+type SuggestionsReply struct {
+	Pending []Suggestion `json:"pending"`
+}
+
+type SuggestionRejectRequest struct {
+	ID     int64  `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type SuggestionApproveRequest struct {
+	ID       int64 `json:"id"`
+	PlayNext bool  `json:"playNext"`
+}
+
+// resolveSuggestion turns the request into a single playable item
+func (s *Server) resolveSuggestion(req SuggestRequest) (PlaylistItem, error) {
+	if req.Path != "" {
+		path, err := s.ResolveMediaFile(req.Path)
+		if err != nil {
+			return PlaylistItem{}, err
+		}
+		if !IsVideoFile(path) {
+			return PlaylistItem{}, errors.New("That's not a video file")
+		}
+		if entry, ok := s.library.Get(path); ok {
+			return s.entryPlaylistItem(&entry), nil
+		}
+		return s.newMediaItem(path), nil
+	}
+
+	if req.ID == "" {
+		return PlaylistItem{}, errors.New("Nothing to suggest")
+	}
+
+	source, err := s.GetMediaSource(req.Source)
+	if err != nil {
+		return PlaylistItem{}, err
+	}
+
+	items, err := source.Resolve(req.ID, ResolveOptions{})
+	if err != nil {
+		return PlaylistItem{}, err
+	}
+	items = s.filterAllowedItems(items)
+	if len(items) < 1 {
+		return PlaylistItem{}, ErrPathNotAllowed
+	}
+	if len(items) > 1 {
+		return PlaylistItem{}, errors.New("You can only suggest a single movie or episode")
+	}
+
+	if source.ID() != SourceLocal {
+		s.applyLocalMetadata(&items[0])
+	}
+	return items[0], nil
+}
+
+func (s *Server) handleSuggest(session fnet.Session, req SuggestRequest) {
+	if s.checkBanned(session, true) {
+		return
+	}
+
+	item, err := s.resolveSuggestion(req)
+	if s.checkError(session, err, EvtSuggest) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	name, _ := session.Data.GetString("name")
+	limit, cooldown := s.suggestionLimits()
+	sug, err := room.Suggestions.Add(viewerKey(session), session.Conn.IP(), name, item, limit, cooldown)
+	if s.checkError(session, err, EvtSuggest) {
+		return
+	}
+
+	log.Printf("{%s} '%s' suggested %s\n", session.Conn.IP(), name, item.Path)
+	err = s.netEngine.CreateAndSend(session, EvtSuggest, sug)
+	if err != nil {
+		log.Println("Error sending suggestion reply: ", err)
+	}
+
+	room.broadcastNotification(fmt.Sprintf("%s Suggested %s", name, item.Title), true)
+	room.broadcastSuggestions()
+}
+
+// Responds with the pending suggestions
+func (s *Server) handleSuggestions(session fnet.Session) {
+	err := s.netEngine.CreateAndSend(session, EvtSuggestions, SuggestionsReply{Pending: s.sessionRoom(session).Suggestions.List()})
+	if err != nil {
+		log.Println("Error sending suggestions: ", err)
+	}
+}
+
+func (s *Server) handleSuggestionApprove(session fnet.Session, req SuggestionApproveRequest) {
+	if !s.checkRole(session, RoleMod, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	sug, err := room.Suggestions.Take(req.ID)
+	if s.checkError(session, err, EvtSuggestionApprove) {
+		return
+	}
+
+	// The media roots could have changed since it was suggested
+	if _, err := s.ResolveMediaFile(sug.Item.Path); err != nil {
+		s.sendErrResp(session, err, EvtSuggestionApprove)
+		room.broadcastSuggestions()
+		return
+	}
+
+	// It's the suggesters item for the DJ rotation
+	sug.Item.AddedBy = sug.By
+	sug.Item.owner = sug.userKey
+
+	name, _ := session.Data.GetString("name")
+	if req.PlayNext {
+		room.Player.InsertNext(name, []PlaylistItem{sug.Item})
+	} else {
+		room.Player.AppendItems(name, []PlaylistItem{sug.Item})
+	}
+
+	room.broadcastNotification(fmt.Sprintf("%s Approved %s's suggestion %s", name, sug.By, sug.Item.Title), true)
+	room.broadcastSuggestions()
+	room.broadcastPlaylistStatus()
+}
+
+func (s *Server) handleSuggestionReject(session fnet.Session, req SuggestionRejectRequest) {
+	if !s.checkRole(session, RoleMod, true) {
+		return
+	}
+
+	if len(req.Reason) > 200 {
+		req.Reason = req.Reason[:200]
+	}
+
+	room := s.sessionRoom(session)
+	sug, err := room.Suggestions.Take(req.ID)
+	if s.checkError(session, err, EvtSuggestionReject) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	msg := fmt.Sprintf("%s Rejected %s's suggestion %s", name, sug.By, sug.Item.Title)
+	if req.Reason != "" {
+		msg += ": " + req.Reason
+	}
+	room.broadcastNotification(msg, true)
+	room.broadcastSuggestions()
+}
+
+func (r *Room) broadcastSuggestions() {
+	err := r.CreateAndBroadcast(EvtSuggestions, SuggestionsReply{Pending: r.Suggestions.List()})
+	if err != nil {
+		log.Println("Error broadcasting suggestions: ", err)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuggestionCooldown(t *testing.T) {
+	q := NewSuggestionQueue()
+
+	if _, err := q.Add("id:1", "10.0.0.1", "alice", PlaylistItem{Path: "/a.mkv"}, 3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logging out doesn't get around the cooldown, it's the same ip
+	_, err := q.Add("ip:10.0.0.1", "10.0.0.1", "alice", PlaylistItem{Path: "/b.mkv"}, 3, time.Minute)
+	if err == nil || !strings.HasPrefix(err.Error(), "Wait") {
+		t.Errorf("same ip with another key = %v, want a cooldown error", err)
+	}
+	_, err = q.Add("id:1", "10.0.0.2", "alice", PlaylistItem{Path: "/b.mkv"}, 3, time.Minute)
+	if err == nil || !strings.HasPrefix(err.Error(), "Wait") {
+		t.Errorf("same key from another ip = %v, want a cooldown error", err)
+	}
+	if _, err = q.Add("id:2", "10.0.0.3", "bob", PlaylistItem{Path: "/b.mkv"}, 3, time.Minute); err != nil {
+		t.Errorf("someone else = %v, want no error", err)
+	}
+
+	// Old ones are forgotten
+	q.Lock()
+	for key := range q.lastSubmit {
+		q.lastSubmit[key] = time.Now().Add(-2 * time.Minute)
+	}
+	q.Unlock()
+	if _, err = q.Add("id:1", "10.0.0.1", "alice", PlaylistItem{Path: "/c.mkv"}, 3, time.Minute); err != nil {
+		t.Errorf("after the cooldown = %v, want no error", err)
+	}
+	if len(q.lastSubmit) != 2 {
+		t.Errorf("%d cooldowns remembered, want the 2 from the last suggestion", len(q.lastSubmit))
+	}
+}
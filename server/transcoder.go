@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExitReason is why a transcode ended
+type ExitReason int
+
+const (
+	ExitFinished    ExitReason = iota // Got to the end of the item
+	ExitStopped                       // Stop was called
+	ExitNoSubtitles                   // Burning in subtitles failed, most likely the item has none
+	ExitFailed                        // Anything else, see the error
+)
+
+func (r ExitReason) String() string {
+	switch r {
+	case ExitFinished:
+		return "finished"
+	case ExitStopped:
+		return "stopped"
+	case ExitNoSubtitles:
+		return "no subtitles"
+	case ExitFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// TranscodeJob is what to transcode and where to
+type TranscodeJob struct {
+	Item         PlaylistItem
+	Settings     TranscoderSettings
+	Profile      TranscoderProfile // The one named in Settings, ScaleWidth, MaxRate and Preset are taken from Settings
+	Subs         bool              // Burn in subtitles, Settings.Subs is only what the user wants
+	StartSegment int               // Number of the first hls segment
+	Output       string            // Path of the hls playlist
+	Realtime     bool              // Go at the item's own speed like a live stream, instead of as fast as possible
+	Duration     time.Duration     // Stop after this much of the item, 0 for all of it
+}
+
+// TranscodeProgress is how far a transcode has gotten
+type TranscodeProgress struct {
+	Position time.Duration // Position in the item, not counting the seek
+	Speed    float64       // Times realtime
+	Size     int64         // Bytes written so far
+}
+
+// TranscodeResult is how a transcode ended
+type TranscodeResult struct {
+	Reason ExitReason
+	Err    error  // Set if it failed
+	Output string // Log output, if the transcoder has any
+}
+
+// Transcoder starts transcodes, the player only talks to ffmpeg through this so it can be swapped out
+type Transcoder interface {
+	Start(job TranscodeJob) (Transcode, error)
+}
+
+// Transcode is a running transcode
+type Transcode interface {
+	// Stop asks it to stop, Done still gets a result (ExitStopped) once it has
+	// safe to call more than once and after it ended
+	Stop()
+	// Kill ends it right away, for when Stop takes too long
+	Kill()
+	Progress() TranscodeProgress
+	// Done gets exactly one result when it ends
+	Done() <-chan TranscodeResult
+}
+
+// ffmpegTranscoder transcodes by running ffmpeg, the one from the config
+type ffmpegTranscoder struct {
+	server *Server
+
+	runningLock sync.Mutex
+	running     map[*ffmpegTranscode]bool // Started and not reaped yet, see killAll
+}
+
+func (ft *ffmpegTranscoder) Start(job TranscodeJob) (Transcode, error) {
+	c := ft.server.ffmpegCommand(job)
+	log.Println(c)
+
+	t := &ffmpegTranscode{
+		cmd:        exec.Command(c.Binary, c.Args()...),
+		subs:       job.Subs,
+		done:       make(chan TranscodeResult, 1),
+		transcoder: ft,
+	}
+	// Same writer for both so exec only calls Write from one goroutine at a time
+	t.cmd.Stdout = t
+	t.cmd.Stderr = t
+	t.cmd.SysProcAttr = transcoderProcAttr()
+
+	ft.runningLock.Lock()
+	err := t.cmd.Start()
+	if err != nil {
+		ft.runningLock.Unlock()
+		return nil, err
+	}
+	if ft.running == nil {
+		ft.running = make(map[*ffmpegTranscode]bool)
+	}
+	ft.running[t] = true
+	ft.runningLock.Unlock()
+
+	go t.wait()
+	return t, nil
+}
+
+// killAll kills all the running transcodes, player or not
+func (ft *ffmpegTranscoder) killAll() {
+	ft.runningLock.Lock()
+	defer ft.runningLock.Unlock()
+	for t := range ft.running {
+		t.Kill()
+	}
+}
+
+var (
+	ffmpegTimeRegex  = regexp.MustCompile(`time=\s*(\d+):(\d+):(\d+(?:\.\d+)?)`)
+	ffmpegSpeedRegex = regexp.MustCompile(`speed=\s*([\d.]+)x`)
+	ffmpegSizeRegex  = regexp.MustCompile(`size=\s*(\d+)kB`)
+)
+
+type ffmpegTranscode struct {
+	cmd        *exec.Cmd
+	subs       bool
+	done       chan TranscodeResult
+	transcoder *ffmpegTranscoder
+
+	sync.Mutex
+	output   bytes.Buffer
+	line     []byte
+	progress TranscodeProgress
+	stopped  bool
+	reaped   bool // Wait returned, the pid could belong to something else by now
+}
+
+// Write collects ffmpeg's output and picks the progress out of the stats lines
+func (t *ffmpegTranscode) Write(b []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.output.Write(b)
+	for _, c := range b {
+		// The stats line is redrawn with \r
+		if c == '\r' || c == '\n' {
+			t.parseLine(string(t.line))
+			t.line = t.line[:0]
+			continue
+		}
+		t.line = append(t.line, c)
+	}
+	return len(b), nil
+}
+
+func (t *ffmpegTranscode) parseLine(line string) {
+	if m := ffmpegTimeRegex.FindStringSubmatch(line); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		min, _ := strconv.Atoi(m[2])
+		s, _ := strconv.ParseFloat(m[3], 64)
+		t.progress.Position = time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(s*float64(time.Second))
+	}
+	if m := ffmpegSpeedRegex.FindStringSubmatch(line); m != nil {
+		t.progress.Speed, _ = strconv.ParseFloat(m[1], 64)
+	}
+	if m := ffmpegSizeRegex.FindStringSubmatch(line); m != nil {
+		kb, _ := strconv.ParseInt(m[1], 10, 64)
+		t.progress.Size = kb * 1024
+	}
+}
+
+func (t *ffmpegTranscode) wait() {
+	err := t.cmd.Wait()
+
+	t.transcoder.runningLock.Lock()
+	delete(t.transcoder.running, t)
+	t.transcoder.runningLock.Unlock()
+
+	t.Lock()
+	t.reaped = true
+	output := t.output.String()
+	stopped := t.stopped
+	t.Unlock()
+
+	log.Println(output)
+	log.Println("Ended FFMPEG")
+
+	res := TranscodeResult{Err: err, Output: output}
+	switch {
+	case stopped:
+		res.Reason = ExitStopped
+	case t.subs && strings.Contains(output, "Error initializing filter 'subtitles' with args"):
+		res.Reason = ExitNoSubtitles
+	case err != nil:
+		res.Reason = ExitFailed
+	default:
+		res.Reason = ExitFinished
+	}
+	t.done <- res
+}
+
+func (t *ffmpegTranscode) Stop() {
+	t.Lock()
+	defer t.Unlock()
+	t.stopped = true
+	if !t.reaped {
+		interruptProcess(t.cmd)
+	}
+}
+
+func (t *ffmpegTranscode) Kill() {
+	t.Lock()
+	defer t.Unlock()
+	t.stopped = true
+	if !t.reaped {
+		killProcess(t.cmd)
+	}
+}
+
+func (t *ffmpegTranscode) Progress() TranscodeProgress {
+	t.Lock()
+	defer t.Unlock()
+	return t.progress
+}
+
+func (t *ffmpegTranscode) Done() <-chan TranscodeResult {
+	return t.done
+}
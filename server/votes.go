@@ -0,0 +1,243 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonas747/fnet"
+	"log"
+	"math"
+)
+
+// Things viewers can vote on
+const (
+	VoteSkip  = "skip"
+	VotePause = "pause"
+	VotePlay  = "play"
+)
+
+// Share of the watching viewers that has to vote for something to happen
+const DefaultVoteThreshold = 0.5
+
+var ErrVotingDisabled = errors.New("Voting is not enabled")
+
+type vote struct {
+	context string // What the vote is about, votes are reset when this changes
+	voters  map[string]bool
+	vetoed  bool
+}
+
+type VoteTally struct {
+	Votes  int  `json:"votes"`
+	Needed int  `json:"needed"`
+	Vetoed bool `json:"vetoed"`
+}
+
+type VoteRequest struct {
+	Action string `json:"action"` // One of skip, pause, play
+}
+
+// voteSettings returns if voting is on in the room and the share of votes needed
+func (r *Room) voteSettings() (bool, float64) {
+	settings := r.settings()
+	enabled := settings.VoteMode
+	threshold := settings.VoteThreshold
+
+	if threshold <= 0 || threshold > 1 {
+		threshold = DefaultVoteThreshold
+	}
+	return enabled, threshold
+}
+
+// voteContext returns what a vote for action is currently about, so a skip vote doesn't carry over
+// to the next item and so on
+// runs on the player goroutine
+func (p *Player) voteContext(action string) (string, error) {
+	switch action {
+	case VoteSkip, VotePause:
+		if !p.Playing {
+			return "", errors.New("Nothing is playing")
+		}
+		return fmt.Sprint(p.plays), nil
+	case VotePlay:
+		if p.Playing {
+			return "", errors.New("Already playing")
+		}
+		return fmt.Sprint(p.StoppedPlaying.UnixNano()), nil
+	}
+	return "", errors.New("Unknown vote, has to be skip, pause or play")
+}
+
+// currentVote returns the vote for action, resetting it if it was about something else
+// runs on the player goroutine, the caller must hold votesLock
+func (r *Room) currentVote(action string) (*vote, error) {
+	context, err := r.Player.voteContext(action)
+	if err != nil {
+		return nil, err
+	}
+
+	v := r.votes[action]
+	if v == nil || v.context != context {
+		v = &vote{context: context, voters: make(map[string]bool)}
+		r.votes[action] = v
+	}
+	return v, nil
+}
+
+// votesNeeded returns how many votes are needed, and the keys of the connected viewers so votes from
+// people that left aren't counted
+func (r *Room) votesNeeded(threshold float64) (int, map[string]bool) {
+	connected := make(map[string]bool)
+	watching := 0
+
+	r.viewersMutex.RLock()
+	for _, session := range r.viewers {
+		connected[viewerKey(session)] = true
+		if w, ok := session.Data.Get("watching"); ok {
+			if b, _ := w.(bool); b {
+				watching++
+			}
+		}
+	}
+	r.viewersMutex.RUnlock()
+
+	// Nobody told us they're watching, go by everyone connected
+	if watching < 1 {
+		watching = len(connected)
+	}
+
+	needed := int(math.Ceil(threshold * float64(watching)))
+	if needed < 1 {
+		needed = 1
+	}
+	return needed, connected
+}
+
+func (v *vote) count(connected map[string]bool) int {
+	n := 0
+	for key := range v.voters {
+		if connected[key] {
+			n++
+		}
+	}
+	return n
+}
+
+// voteTallies returns the tallies of the votes going on, for the status message
+// runs on the player goroutine
+func (r *Room) voteTallies() map[string]VoteTally {
+	_, threshold := r.voteSettings()
+	needed, connected := r.votesNeeded(threshold)
+
+	r.votesLock.Lock()
+	defer r.votesLock.Unlock()
+
+	tallies := make(map[string]VoteTally)
+	for action, v := range r.votes {
+		if context, err := r.Player.voteContext(action); err != nil || context != v.context {
+			continue
+		}
+
+		tally := VoteTally{Votes: v.count(connected), Needed: needed, Vetoed: v.vetoed}
+		if tally.Votes > 0 || tally.Vetoed {
+			tallies[action] = tally
+		}
+	}
+	return tallies
+}
+
+func (s *Server) handleVote(session fnet.Session, req VoteRequest) {
+	if s.checkBanned(session, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	enabled, threshold := room.voteSettings()
+	if !enabled {
+		s.sendErrResp(session, ErrVotingDisabled, EvtVote)
+		return
+	}
+	needed, connected := room.votesNeeded(threshold)
+
+	count := 0
+	passed := false
+	err := room.Player.call(func() error {
+		room.votesLock.Lock()
+		defer room.votesLock.Unlock()
+
+		v, err := room.currentVote(req.Action)
+		if err == nil && v.vetoed {
+			err = fmt.Errorf("A mod vetoed the vote to %s", req.Action)
+		}
+		if err != nil {
+			return err
+		}
+
+		v.voters[viewerKey(session)] = true
+		count = v.count(connected)
+		passed = count >= needed
+		if passed {
+			// Whatever happens next changes what the other votes were about anyways
+			room.votes = make(map[string]*vote)
+		}
+		return nil
+	})
+	if s.checkError(session, err, EvtVote) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Voted to %s (%d/%d)", name, req.Action, count, needed), true)
+
+	if passed {
+		room.broadcastNotification(fmt.Sprintf("The vote to %s passed", req.Action), true)
+		executeVote(room.Player, req.Action)
+	}
+	room.broadcastStatus()
+}
+
+func executeVote(player *Player, action string) {
+	var err error
+	switch action {
+	case VoteSkip:
+		err = player.Next()
+	case VotePause:
+		err = player.Pause()
+	case VotePlay:
+		err = player.Play()
+	}
+	if err != nil {
+		log.Printf("Failed executing the vote to %s: %s\n", action, err)
+	}
+}
+
+// Mods can veto a vote, that blocks it until whatever it was about changes
+func (s *Server) handleVoteVeto(session fnet.Session, req VoteRequest) {
+	if !s.checkRole(session, RoleMod, true) {
+		return
+	}
+
+	room := s.sessionRoom(session)
+	if enabled, _ := room.voteSettings(); !enabled {
+		s.sendErrResp(session, ErrVotingDisabled, EvtVoteVeto)
+		return
+	}
+	err := room.Player.call(func() error {
+		room.votesLock.Lock()
+		defer room.votesLock.Unlock()
+
+		v, err := room.currentVote(req.Action)
+		if err == nil {
+			v.vetoed = true
+			v.voters = make(map[string]bool)
+		}
+		return err
+	})
+
+	if s.checkError(session, err, EvtVoteVeto) {
+		return
+	}
+
+	name, _ := session.Data.GetString("name")
+	room.broadcastNotification(fmt.Sprintf("%s Vetoed the vote to %s", name, req.Action), true)
+	room.broadcastStatus()
+}
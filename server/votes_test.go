@@ -0,0 +1,70 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/jogramming/fluffywatch/server"
+	"github.com/jogramming/fluffywatch/transcoderfake"
+)
+
+func TestVoteContextFollowsPlays(t *testing.T) {
+	f := transcoderfake.New()
+	_, room, paths := newTestServer(t, f, "a.mkv", "b.mkv")
+	p := room.Player
+
+	context := func() string {
+		t.Helper()
+		c, err := room.VoteContext(server.VoteSkip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	first := waitStart(t, f, 1, paths[0])
+	playing := context()
+
+	// Seeking and pausing carry on with the same play of the item
+	if err := p.Seek("0:1:0"); err != nil {
+		t.Fatal(err)
+	}
+	waitEnded(t, first)
+	second := waitStart(t, f, 2, paths[0])
+	if c := context(); c != playing {
+		t.Errorf("context changed from %s to %s on a seek", playing, c)
+	}
+
+	if err := p.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	waitEnded(t, second)
+	if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	third := waitStart(t, f, 3, paths[0])
+	if c := context(); c != playing {
+		t.Errorf("context changed from %s to %s on a resume", playing, c)
+	}
+
+	if err := p.Next(); err != nil {
+		t.Fatal(err)
+	}
+	waitEnded(t, third)
+	waitStart(t, f, 4, paths[1])
+	next := context()
+	if next == playing {
+		t.Error("context didn't change for the next item")
+	}
+
+	// Playing the same item again is a new play too
+	if err := p.Jump(1); err != nil {
+		t.Fatal(err)
+	}
+	waitStart(t, f, 5, paths[1])
+	if c := context(); c == next {
+		t.Error("context didn't change when the item was played again")
+	}
+}
@@ -0,0 +1,181 @@
+// Package transcoderfake is a scripted stand in for ffmpeg, so the player can be driven
+// without ffmpeg or any real media. Pass it to the server with server.WithTranscoder
+package transcoderfake
+
+import (
+	"errors"
+	"github.com/jogramming/fluffywatch/server"
+	"sync"
+	"time"
+)
+
+var ErrTimeout = errors.New("Timed out waiting for transcodes")
+
+// Step is what one transcode does
+type Step struct {
+	Duration    time.Duration // How long until it finishes by itself, 0 runs until it's stopped or Finish is called
+	NoSubtitles bool          // If started with subs it ends right away with ExitNoSubtitles
+	StartErr    error         // Start fails with this
+	Err         error         // Ends with ExitFailed and this after Duration instead of finishing
+	IgnoreStop  bool          // Stop does nothing, like a stuck ffmpeg, only Kill ends it
+}
+
+// Transcoder hands out the steps in Script in order, one per Start, and Default once it runs out
+type Transcoder struct {
+	Script  []Step
+	Default Step
+
+	mu      sync.Mutex
+	started []*Transcode
+	changed chan struct{} // Closed and replaced whenever something starts
+}
+
+func New(script ...Step) *Transcoder {
+	return &Transcoder{
+		Script:  script,
+		changed: make(chan struct{}),
+	}
+}
+
+func (t *Transcoder) Start(job server.TranscodeJob) (server.Transcode, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	step := t.Default
+	if len(t.Script) > 0 {
+		step = t.Script[0]
+		t.Script = t.Script[1:]
+	}
+	if step.StartErr != nil {
+		return nil, step.StartErr
+	}
+
+	tc := &Transcode{
+		job:        job,
+		ignoreStop: step.IgnoreStop,
+		done:       make(chan server.TranscodeResult, 1),
+	}
+	t.started = append(t.started, tc)
+	close(t.changed)
+	t.changed = make(chan struct{})
+
+	switch {
+	case job.Subs && step.NoSubtitles:
+		tc.end(server.ExitNoSubtitles, nil)
+	case step.Duration > 0:
+		reason := server.ExitFinished
+		if step.Err != nil {
+			reason = server.ExitFailed
+		}
+		time.AfterFunc(step.Duration, func() { tc.end(reason, step.Err) })
+	}
+	return tc, nil
+}
+
+// Started returns every transcode started so far, oldest first
+func (t *Transcoder) Started() []*Transcode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*Transcode(nil), t.started...)
+}
+
+// Current returns the last started transcode, nil if none were
+func (t *Transcoder) Current() *Transcode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.started) < 1 {
+		return nil
+	}
+	return t.started[len(t.started)-1]
+}
+
+// WaitStarted waits until n transcodes have been started in total and returns them
+func (t *Transcoder) WaitStarted(n int, timeout time.Duration) ([]*Transcode, error) {
+	deadline := time.After(timeout)
+	for {
+		t.mu.Lock()
+		if len(t.started) >= n {
+			started := append([]*Transcode(nil), t.started...)
+			t.mu.Unlock()
+			return started, nil
+		}
+		changed := t.changed
+		t.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// Transcode is a fake running transcode
+type Transcode struct {
+	job        server.TranscodeJob
+	ignoreStop bool
+	done       chan server.TranscodeResult
+
+	mu       sync.Mutex
+	progress server.TranscodeProgress
+	ended    bool
+	reason   server.ExitReason
+}
+
+func (tc *Transcode) Job() server.TranscodeJob {
+	return tc.job
+}
+
+// Finish ends it as if it got to the end of the item
+func (tc *Transcode) Finish() {
+	tc.end(server.ExitFinished, nil)
+}
+
+// Fail ends it with err
+func (tc *Transcode) Fail(err error) {
+	tc.end(server.ExitFailed, err)
+}
+
+func (tc *Transcode) SetProgress(p server.TranscodeProgress) {
+	tc.mu.Lock()
+	tc.progress = p
+	tc.mu.Unlock()
+}
+
+// Ended returns how it ended, ok is false if it's still running
+func (tc *Transcode) Ended() (reason server.ExitReason, ok bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.reason, tc.ended
+}
+
+func (tc *Transcode) end(reason server.ExitReason, err error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.ended {
+		return
+	}
+	tc.ended = true
+	tc.reason = reason
+	tc.done <- server.TranscodeResult{Reason: reason, Err: err}
+}
+
+func (tc *Transcode) Stop() {
+	if !tc.ignoreStop {
+		tc.end(server.ExitStopped, nil)
+	}
+}
+
+func (tc *Transcode) Kill() {
+	tc.end(server.ExitStopped, nil)
+}
+
+func (tc *Transcode) Progress() server.TranscodeProgress {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.progress
+}
+
+func (tc *Transcode) Done() <-chan server.TranscodeResult {
+	return tc.done
+}